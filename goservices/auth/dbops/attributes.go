@@ -0,0 +1,95 @@
+package dbops
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"go.mods/attrs"
+)
+
+//makes sure the order's attributes fit the form of its service, returns them ready to store
+func checkOrderAttributes(ctx context.Context, conn *pgxpool.Pool, serviceId int32, doc json.RawMessage) (json.RawMessage, error) {
+	if len(bytes.TrimSpace(doc)) == 0 || bytes.Equal(bytes.TrimSpace(doc), []byte("null")) {
+		doc = json.RawMessage(`{}`)
+	}
+
+	//cats owns cats_attributes, the lookup is shared with it
+	var owner int32
+	var raw json.RawMessage
+	err := conn.QueryRow(ctx, attrs.LookupSql, serviceId).Scan(&owner, &raw)
+	if err == pgx.ErrNoRows {
+		var values map[string]interface{}
+		if err = json.Unmarshal(doc, &values); err != nil || values == nil {
+			return nil, errors.New("attributes must be an object")
+		}
+		return doc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	schema, err := attrs.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = schema.Validate(doc); err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+//attribute filters on orders.attributes
+func attributesWhere(w *where, conds map[string]attrs.Condition) error {
+	var keys []string
+	for k := range conds {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if !attrs.ValidKey(k) {
+			return errors.New("bad attribute name " + k)
+		}
+		c := conds[k]
+		key := w.arg(k) + `::text`
+
+		if c.Eq != nil {
+			b, err := json.Marshal(c.Eq)
+			if err != nil {
+				return err
+			}
+			w.add(`attributes->` + key + ` = ` + w.arg(string(b)) + `::jsonb`)
+		}
+
+		if len(c.In) > 0 {
+			var in []string
+			for _, v := range c.In {
+				b, err := json.Marshal(v)
+				if err != nil {
+					return err
+				}
+				in = append(in, string(b))
+			}
+			w.add(`attributes->` + key + ` = ANY(` + w.arg(in) + `::text[]::jsonb[])`)
+		}
+
+		//non numeric values never match a range
+		number := `(CASE WHEN jsonb_typeof(attributes->` + key + `) = 'number' THEN (attributes->>` + key + `)::numeric END)`
+		if c.Gte != nil {
+			w.add(number + ` >= ` + w.arg(*c.Gte))
+		}
+		if c.Lte != nil {
+			w.add(number + ` <= ` + w.arg(*c.Lte))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package dbops
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestInnValid(t *testing.T) {
+	cases := []struct {
+		inn  string
+		want bool
+	}{
+		{"7707083893", true},
+		{"7707083894", false},
+		{"500100732259", true},
+		{"500100732258", false},
+		{"500100732269", false},
+		{"770708389", false},
+		{"77070838930", false},
+		{"770708389a", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		if got := innValid(c.inn); got != c.want {
+			t.Errorf("innValid(%q) = %v, want %v", c.inn, got, c.want)
+		}
+	}
+}
+
+func TestCheckRequisites(t *testing.T) {
+	sole := Requisites{Name: " ИП Иванов ", Address: "Москва", Inn: "500100732259", Ogrn: "304500116000157", Kpp: "770701001"}
+	if err := checkRequisites(&sole, LegalSole); err != nil {
+		t.Fatal(err)
+	}
+	if sole.Name != "ИП Иванов" || sole.Kpp != "" {
+		t.Errorf("sole proprietor not cleaned up: %+v", sole)
+	}
+
+	company := Requisites{Name: "ООО Ромашка", Address: "Москва", Inn: "7707083893", Ogrn: "1027700132195", Kpp: "773601001"}
+	if err := checkRequisites(&company, LegalEntity); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkRequisites(&company, LegalSole); err == nil {
+		t.Error("a 10 digit inn passed for a sole proprietor")
+	}
+	noKpp := company
+	noKpp.Kpp = ""
+	if err := checkRequisites(&noKpp, LegalEntity); err == nil {
+		t.Error("a company without a kpp passed")
+	}
+}
+
+func TestRublesInWords(t *testing.T) {
+	cases := []struct {
+		v    int64
+		want string
+	}{
+		{0, "Ноль рублей 00 копеек"},
+		{1, "Один рубль 00 копеек"},
+		{2, "Два рубля 00 копеек"},
+		{11, "Одиннадцать рублей 00 копеек"},
+		{21, "Двадцать один рубль 00 копеек"},
+		{112, "Сто двенадцать рублей 00 копеек"},
+		{1000, "Одна тысяча рублей 00 копеек"},
+		{1500, "Одна тысяча пятьсот рублей 00 копеек"},
+		{2002, "Две тысячи два рубля 00 копеек"},
+		{5000, "Пять тысяч рублей 00 копеек"},
+		{11000, "Одиннадцать тысяч рублей 00 копеек"},
+		{21344, "Двадцать одна тысяча триста сорок четыре рубля 00 копеек"},
+		{1000001, "Один миллион один рубль 00 копеек"},
+		{2000000000, "Два миллиарда рублей 00 копеек"},
+		{-300, "Триста рублей 00 копеек"},
+	}
+	for _, c := range cases {
+		if got := rublesInWords(c.v); got != c.want {
+			t.Errorf("rublesInWords(%d) = %q, want %q", c.v, got, c.want)
+		}
+	}
+}
+
+func TestRublesAndVat(t *testing.T) {
+	if got := rubles(1500000); got != "1 500 000,00" {
+		t.Errorf("rubles = %q", got)
+	}
+	if got := kopecks(123456); got != "1 234,56" {
+		t.Errorf("kopecks = %q", got)
+	}
+	cases := []struct {
+		amount int32
+		rate   int16
+		want   int64
+	}{
+		{1200, 20, 20000},
+		{1000, 20, 16667},
+		{100, 10, 909},
+		{1000, 0, 0},
+	}
+	for _, c := range cases {
+		if got := vatKopecks(c.amount, c.rate); got != c.want {
+			t.Errorf("vatKopecks(%d, %d) = %d, want %d", c.amount, c.rate, got, c.want)
+		}
+	}
+}
+
+func TestBillingRoot(t *testing.T) {
+	defer os.Setenv("BILLING_DIR", os.Getenv("BILLING_DIR"))
+	defer os.Setenv("UPLOADS_DIR", os.Getenv("UPLOADS_DIR"))
+
+	os.Setenv("BILLING_DIR", "")
+	os.Setenv("UPLOADS_DIR", "/home/appuser/appservices/uploads/")
+	if got := billingDir(7); got != "/home/appuser/appservices/billing/7/" {
+		t.Errorf("next to uploads: %q", got)
+	}
+	os.Setenv("BILLING_DIR", "/srv/billing")
+	if got := billingDir(7); got != "/srv/billing/7/" {
+		t.Errorf("BILLING_DIR: %q", got)
+	}
+}
+
+func TestDocumentJsonDirection(t *testing.T) {
+	d := BillingDocument{Kind: DocumentReceipt, Number: "КВ-2021-000001", Title: receiptKinds[LedgerOfferFee], Amount: 300,
+		Direction: DirectionDebit, Status: ReceiptIssued, TransactionId: 5, Created: time.Date(2021, 12, 4, 10, 0, 0, 0, time.UTC)}
+	doc := documentJson(&d, Requisites{}, Requisites{}, map[string]interface{}{"reason": "отклик"})
+	if doc["direction"] != DirectionDebit || doc["total"] != int32(300) || doc["transaction_id"] != int64(5) {
+		t.Errorf("receipt: %v", doc)
+	}
+	if doc["date"] != "2021-12-04" || doc["reason"] != "отклик" {
+		t.Errorf("receipt: %v", doc)
+	}
+}
+
+func TestDocumentPdf(t *testing.T) {
+	if _, err := loadBillingFont(); err != nil {
+		t.Skip(err)
+	}
+	created := time.Date(2021, 12, 4, 10, 0, 0, 0, time.UTC)
+	docs := []BillingDocument{
+		{Kind: DocumentInvoice, Number: "СЧ-2021-000001", Title: receiptKinds[LedgerTopUp], Amount: 1500, Direction: DirectionCredit, VatRate: 20, Created: created},
+		{Kind: DocumentReceipt, Number: "КВ-2021-000001", Title: receiptKinds[LedgerOfferFee], Amount: 300, Direction: DirectionDebit, TransactionId: 5, Created: created},
+	}
+	for _, d := range docs {
+		b, err := documentPdf(&d, Requisites{Name: "ООО Ромашка", Inn: "7707083893"}, Requisites{Name: "Постройка"},
+			map[string]interface{}{"operation": created, "balance_after": int32(1200), "reason": "отклик"})
+		if err != nil {
+			t.Fatal(d.Kind, err)
+		}
+		if len(b) < 1000 {
+			t.Errorf("%s is %d bytes", d.Kind, len(b))
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package dbops
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mods/pdf"
+)
+
+//documents need Cyrillic, BILLING_FONT is a .ttf that has it, DejaVu Sans where the distro puts it otherwise
+var billingFont struct {
+	once sync.Once
+	font *pdf.Font
+	err  error
+}
+
+func loadBillingFont() (*pdf.Font, error) {
+	billingFont.once.Do(func() {
+		paths := []string{"/usr/share/fonts/dejavu/DejaVuSans.ttf", "/usr/share/fonts/truetype/dejavu/DejaVuSans.ttf"}
+		if p := os.Getenv("BILLING_FONT"); p != "" {
+			paths = []string{p}
+		}
+		billingFont.err = errors.New("no font for billing documents, set BILLING_FONT")
+		for _, p := range paths {
+			b, err := ioutil.ReadFile(p)
+			if err != nil {
+				continue
+			}
+			name := strings.TrimSuffix(p[strings.LastIndex(p, "/")+1:], ".ttf")
+			billingFont.font, billingFont.err = pdf.ParseFont(name, b)
+			return
+		}
+	})
+	return billingFont.font, billingFont.err
+}
+
+//1 500,00
+func rubles(v int64) string {
+	if v < 0 {
+		v = -v
+	}
+	s := strconv.FormatInt(v, 10)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + " " + s[i:]
+	}
+	return s + ",00"
+}
+
+//included VAT in kopecks, rounded half up
+func vatKopecks(amount int32, rate int16) int64 {
+	if rate == 0 {
+		return 0
+	}
+	a := int64(amount)
+	if a < 0 {
+		a = -a
+	}
+	return (a*100*int64(rate)*2 + int64(100+rate)) / (int64(100+rate) * 2)
+}
+
+func kopecks(v int64) string {
+	k := strconv.FormatInt(v%100, 10)
+	if len(k) == 1 {
+		k = "0" + k
+	}
+	r := rubles(v / 100)
+	return r[:len(r)-3] + "," + k
+}
+
+var (
+	unitsMale   = []string{"", "один", "два", "три", "четыре", "пять", "шесть", "семь", "восемь", "девять"}
+	unitsFemale = []string{"", "одна", "две", "три", "четыре", "пять", "шесть", "семь", "восемь", "девять"}
+	teens       = []string{"десять", "одиннадцать", "двенадцать", "тринадцать", "четырнадцать", "пятнадцать", "шестнадцать", "семнадцать", "восемнадцать", "девятнадцать"}
+	tens        = []string{"", "", "двадцать", "тридцать", "сорок", "пятьдесят", "шестьдесят", "семьдесят", "восемьдесят", "девяносто"}
+	hundreds    = []string{"", "сто", "двести", "триста", "четыреста", "пятьсот", "шестьсот", "семьсот", "восемьсот", "девятьсот"}
+)
+
+//1 рубль, 2 рубля, 5 рублей
+func plural(n int64, one, few, many string) string {
+	n %= 100
+	if n >= 11 && n <= 19 {
+		return many
+	}
+	switch n % 10 {
+	case 1:
+		return one
+	case 2, 3, 4:
+		return few
+	}
+	return many
+}
+
+func triple(n int64, female bool) []string {
+	var w []string
+	if h := hundreds[n/100]; h != "" {
+		w = append(w, h)
+	}
+	n %= 100
+	if n >= 10 && n < 20 {
+		return append(w, teens[n-10])
+	}
+	if t := tens[n/10]; t != "" {
+		w = append(w, t)
+	}
+	units := unitsMale
+	if female {
+		units = unitsFemale
+	}
+	if u := units[n%10]; u != "" {
+		w = append(w, u)
+	}
+	return w
+}
+
+//"Одна тысяча пятьсот рублей 00 копеек", the amount in words an invoice carries
+func rublesInWords(v int64) string {
+	if v < 0 {
+		v = -v
+	}
+	var w []string
+	if v == 0 {
+		w = []string{"ноль"}
+	}
+	scales := []struct {
+		div          int64
+		female       bool
+		one, few, no string
+	}{
+		{1000000000, false, "миллиард", "миллиарда", "миллиардов"},
+		{1000000, false, "миллион", "миллиона", "миллионов"},
+		{1000, true, "тысяча", "тысячи", "тысяч"},
+	}
+	n := v
+	for _, s := range scales {
+		if t := n / s.div; t > 0 {
+			w = append(append(w, triple(t, s.female)...), plural(t, s.one, s.few, s.no))
+		}
+		n %= s.div
+	}
+	w = append(w, triple(n, false)...)
+	w = append(w, plural(v, "рубль", "рубля", "рублей"), "00 копеек")
+
+	s := strings.Join(w, " ")
+	r := []rune(s)
+	return strings.ToUpper(string(r[0])) + string(r[1:])
+}
+
+//the machine-readable copy, the same facts as the pdf
+func documentJson(d *BillingDocument, buyer Requisites, seller Requisites, extra map[string]interface{}) map[string]interface{} {
+	vat := vatKopecks(d.Amount, d.VatRate)
+	doc := map[string]interface{}{
+		"kind":     d.Kind,
+		"number":   d.Number,
+		"date":     d.Created.Format("2006-01-02"),
+		"created":  d.Created,
+		"currency": "RUB",
+		"seller":   seller,
+		"buyer":    buyer,
+		"lines": []map[string]interface{}{
+			{"title": d.Title, "quantity": 1, "price": d.Amount, "amount": d.Amount},
+		},
+		"total":          d.Amount,
+		"total_in_words": rublesInWords(int64(d.Amount)),
+		"vat_rate":       d.VatRate,
+		"vat_kopecks":    vat,
+		"direction":      d.Direction,
+	}
+	if d.TransactionId != 0 {
+		doc["transaction_id"] = d.TransactionId
+	}
+	if d.InvoiceId != 0 {
+		doc["invoice_id"] = d.InvoiceId
+	}
+	for k, v := range extra {
+		doc[k] = v
+	}
+	return doc
+}
+
+func requisiteLines(r Requisites) []string {
+	lines := []string{r.Name}
+	ids := "ИНН " + r.Inn
+	if r.Kpp != "" {
+		ids += ", КПП " + r.Kpp
+	}
+	if r.Ogrn != "" {
+		ids += ", ОГРН " + r.Ogrn
+	}
+	if r.Inn != "" {
+		lines = append(lines, ids)
+	}
+	if r.Address != "" {
+		lines = append(lines, r.Address)
+	}
+	return lines
+}
+
+//one A4 page, the bank block on top for invoices
+func documentPdf(d *BillingDocument, buyer Requisites, seller Requisites, extra map[string]interface{}) ([]byte, error) {
+	font, err := loadBillingFont()
+	if err != nil {
+		return nil, err
+	}
+
+	doc := pdf.New(font)
+	p := doc.AddPage()
+	left, right := 50.0, pdf.PageWidth-50
+	y := pdf.PageHeight - 60
+
+	if d.Kind == DocumentInvoice {
+		doc.SetTitle("Счёт на оплату № " + d.Number)
+		p.Rect(left, y-62, right-left, 70, 0.5)
+		p.Text(left+6, y-8, 9, seller.Bank)
+		p.Text(left+6, y-22, 9, "БИК "+seller.Bik+"    Сч. № "+seller.CorrAccount)
+		p.Text(left+6, y-36, 9, "ИНН "+seller.Inn+"    КПП "+seller.Kpp+"    Сч. № "+seller.Account)
+		p.Text(left+6, y-50, 9, "Получатель: "+seller.Name)
+		y -= 100
+		p.Text(left, y, 14, "Счёт на оплату № "+d.Number+" от "+d.Created.Format("02.01.2006"))
+	} else {
+		doc.SetTitle("Квитанция № " + d.Number)
+		p.Text(left, y, 14, "Квитанция № "+d.Number+" от "+d.Created.Format("02.01.2006"))
+	}
+	y -= 10
+	p.Line(left, y, right, y, 1)
+	y -= 22
+
+	party := func(label string, r Requisites) {
+		p.Text(left, y, 9, label)
+		for _, l := range requisiteLines(r) {
+			for _, w := range doc.Wrap(9, right-left-90, l) {
+				p.Text(left+90, y, 9, w)
+				y -= 13
+			}
+		}
+		y -= 6
+	}
+	party("Поставщик:", seller)
+	party("Покупатель:", buyer)
+
+	//the table, a single line: what and how much
+	y -= 6
+	cols := []float64{left, left + 30, right - 190, right - 140, right - 70, right}
+	p.Line(left, y+12, right, y+12, 0.5)
+	for i, h := range []string{"№", "Наименование", "Кол-во", "Цена", "Сумма"} {
+		p.Text(cols[i]+4, y, 9, h)
+	}
+	y -= 6
+	p.Line(left, y, right, y, 0.5)
+	y -= 14
+	title := doc.Wrap(9, cols[2]-cols[1]-8, d.Title)
+	p.Text(cols[0]+4, y, 9, "1")
+	p.Text(cols[2]+4, y, 9, "1 усл.")
+	p.TextRight(cols[4]-4, y, 9, rubles(int64(d.Amount)))
+	p.TextRight(cols[5]-4, y, 9, rubles(int64(d.Amount)))
+	for _, l := range title {
+		p.Text(cols[1]+4, y, 9, l)
+		y -= 13
+	}
+	y += 7
+	p.Line(left, y, right, y, 0.5)
+	for _, x := range cols {
+		p.Line(x, y, x, y+32+float64(len(title)-1)*13, 0.5)
+	}
+
+	y -= 18
+	p.TextRight(right-80, y, 10, "Итого:")
+	p.TextRight(right-4, y, 10, rubles(int64(d.Amount)))
+	y -= 14
+	if d.VatRate > 0 {
+		p.TextRight(right-80, y, 10, "В том числе НДС "+strconv.Itoa(int(d.VatRate))+"%:")
+		p.TextRight(right-4, y, 10, kopecks(vatKopecks(d.Amount, d.VatRate)))
+	} else {
+		p.TextRight(right-80, y, 10, "Без НДС")
+		p.TextRight(right-4, y, 10, "-")
+	}
+	y -= 24
+
+	if d.Kind == DocumentInvoice {
+		p.Text(left, y, 10, "Всего к оплате: "+rubles(int64(d.Amount))+" руб.")
+		y -= 14
+		p.Text(left, y, 10, rublesInWords(int64(d.Amount)))
+		y -= 20
+		for _, l := range doc.Wrap(8, right-left, "Оплата счёта означает согласие с условиями оказания услуг. Сумма зачисляется на баланс в личном кабинете после поступления средств на расчётный счёт. В назначении платежа укажите номер счёта.") {
+			p.Text(left, y, 8, l)
+			y -= 11
+		}
+	} else {
+		what := "Зачислено на баланс: "
+		if d.Direction == DirectionDebit {
+			what = "Списано с баланса: "
+		}
+		p.Text(left, y, 10, what+rubles(int64(d.Amount))+" руб. ("+rublesInWords(int64(d.Amount))+")")
+		y -= 14
+		if t, ok := extra["operation"].(time.Time); ok {
+			p.Text(left, y, 9, "Операция № "+strconv.FormatInt(d.TransactionId, 10)+" от "+t.Format("02.01.2006 15:04"))
+			y -= 13
+		}
+		if b, ok := extra["balance_after"].(int32); ok {
+			p.Text(left, y, 9, "Остаток на балансе: "+rubles(int64(b))+" руб.")
+			y -= 13
+		}
+		if r, ok := extra["reason"].(string); ok && r != "" {
+			for _, l := range doc.Wrap(9, right-left, "Основание: "+r) {
+				p.Text(left, y, 9, l)
+				y -= 13
+			}
+		}
+	}
+
+	y -= 30
+	p.Text(left, y, 10, "Поставщик")
+	p.Line(left+70, y-2, left+250, y-2, 0.5)
+	p.Text(left+260, y, 9, "документ сформирован автоматически")
+
+	return doc.Bytes()
+}
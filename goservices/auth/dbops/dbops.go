@@ -6,12 +6,16 @@ import (
 	"errors"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/georgysavva/scany/pgxscan"
 	"github.com/jackc/pgx/v4/pgxpool"
 
+	"go.mods/attrs"
 	"go.mods/hashing"
+	"go.mods/outbox"
+	"go.mods/paging"
 )
 
 type User struct {
@@ -36,6 +40,8 @@ type User struct {
 	RegionId     int16  `json:"region_id"`
 	Legal        int16  `json:"legal"`
 	Company      int16  `json:"company"`
+	//ranking score from master_ratings, only in master lists
+	Score float64 `json:"score"`
 }
 
 type Country struct {
@@ -67,17 +73,21 @@ type Choice struct {
 }
 
 type Comment struct {
-	Id          int32  `json:"id"`
-	MasterId    int32  `json:"master_id"`
-	ClientId    int32  `json:"client_id"`
-	OrderId     int32  `json:"order_id"`
-	ClientName  string `json:"client_name"`
-	Politeness  int16  `json:"politeness"`
-	Punctuality int16  `json:"punctuality"`
-	Speed       int16  `json:"speed"`
-	Balance     int16  `json:"balance"`
-	Overall     int16  `json:"overall"`
-	Text        string `json:"text"`
+	Id          int32      `json:"id"`
+	MasterId    int32      `json:"master_id"`
+	ClientId    int32      `json:"client_id"`
+	OrderId     int32      `json:"order_id"`
+	ClientName  string     `json:"client_name"`
+	Politeness  int16      `json:"politeness"`
+	Punctuality int16      `json:"punctuality"`
+	Speed       int16      `json:"speed"`
+	Balance     int16      `json:"balance"`
+	Overall     int16      `json:"overall"`
+	Text        string     `json:"text"`
+	Created     time.Time  `json:"created"`
+	Edited      *time.Time `json:"edited"`
+	Reply       string     `json:"reply"`
+	Replied     *time.Time `json:"replied"`
 }
 
 type Cell struct {
@@ -99,29 +109,32 @@ type PortfolioWork struct {
 }
 
 type Order struct {
-	Id          int32  `json:"id"`
-	LoginId     int32  `json:"login_id"`
-	ServiceId   int32  `json:"service_id"`
-	Name        string `json:"name"`
-	Title       string `json:"title"`
-	Description string `json:"description"`
-	RegionId  	int16  `json:"region_id"`
-	TownId		int32  `json:"town_id"`
-	Budget      int32  `json:"budget"`
-	Created  time.Time `json:"created"`
-	Completed   bool   `json:"completed"`
-	Time 		string `json:"time"`
+	Id          int32           `json:"id"`
+	LoginId     int32           `json:"login_id"`
+	ServiceId   int32           `json:"service_id"`
+	Name        string          `json:"name"`
+	Title       string          `json:"title"`
+	Description string          `json:"description"`
+	RegionId    int16           `json:"region_id"`
+	TownId      int32           `json:"town_id"`
+	Budget      int32           `json:"budget"`
+	Created     time.Time       `json:"created"`
+	Completed   bool            `json:"completed"`
+	Time        string          `json:"time"`
+	Attributes  json.RawMessage `json:"attributes"`
+	Status      string          `json:"status"`
+	MasterId    int32           `json:"master_id"`
 }
 
 type Offer struct {
-	Id          int32  `json:"id"`
-	OrderId     int32  `json:"order_id"`
-	CustomerId  int32  `json:"customer_id"`
-	MasterId    int32  `json:"master_id"`
-	Accept      int16  `json:"accept"`
-	Price       string `json:"price"`
-	Meeting     string `json:"meeting"`
-	Description string `json:"description"`
+	Id          int32     `json:"id"`
+	OrderId     int32     `json:"order_id"`
+	CustomerId  int32     `json:"customer_id"`
+	MasterId    int32     `json:"master_id"`
+	Accept      int16     `json:"accept"`
+	Price       string    `json:"price"`
+	Meeting     string    `json:"meeting"`
+	Description string    `json:"description"`
 	Created     time.Time `json:"created"`
 }
 
@@ -164,6 +177,15 @@ func selectWhereIn(table string, info string, dst interface{}) error {
 	return nil
 }
 
+//what update-cell may write, balance goes through the ledger and rating is computed from reviews
+var cellColumns = map[string]map[string]bool{
+	"logins": {"login": true, "level": true, "avatar": true, "email": true, "phone": true, "first_name": true, "last_name": true,
+		"paternal_name": true, "about": true, "town_id": true, "region_id": true, "legal": true, "company": true, "last_online": true},
+	"regions": {"name": true, "country_id": true, "slug": true},
+	"towns":   {"name": true, "country_id": true, "region_id": true, "slug": true},
+	"offers":  {"price": true, "meeting": true, "description": true},
+}
+
 func UpdateCell(info string) error {
 	var c Cell
 
@@ -172,11 +194,22 @@ func UpdateCell(info string) error {
 		return err
 	}
 
-	if c.Table != "logins" && c.Table != "regions" && c.Table != "towns" && c.Table != "offers" {
+	columns, ok := cellColumns[c.Table]
+	if !ok {
 		err = errors.New("access denied")
 		return err
 	}
 
+	if c.Table == "offers" && c.Column == "accept" {
+		err = errors.New("use accept-offer")
+		return err
+	}
+
+	if !columns[c.Column] {
+		err = errors.New("column " + c.Column + " of " + c.Table + " can't be set directly")
+		return err
+	}
+
 	ctx := context.Background()
 	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
 	if err != nil {
@@ -356,7 +389,13 @@ func TryRegister(u User) (string, error) {
 		}
 	}
 
-	row := conn.QueryRow(ctx, "INSERT INTO logins (password, created, email, phone, first_name, last_name, paternal_name, last_online, town_id, region_id, legal, level)"+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	row := tx.QueryRow(ctx, "INSERT INTO logins (password, created, email, phone, first_name, last_name, paternal_name, last_online, town_id, region_id, legal, level)"+
 		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id",
 		u.Password, u.Created, u.Email, u.Phone, u.FirstName, u.LastName, u.PaternalName, u.LastOnline, u.TownId, u.RegionId, u.Legal, u.Level)
 
@@ -367,6 +406,14 @@ func TryRegister(u User) (string, error) {
 	u.Id = id
 
 	u.Password = ""
+	if err = outbox.Write(ctx, tx, TopicLoginRegistered, outboxKey(u.Id), u); err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
 	jm, err := json.Marshal(u)
 
 	return string(jm), nil
@@ -398,8 +445,15 @@ func UpdateLogin(u User) error {
 		}
 	}
 
-	ct, err := conn.Exec(ctx, `UPDATE logins SET login = $1, level = $2, avatar = $3, email = $4, phone = $5, first_name = $6, last_name = $7, paternal_name = $8, about = $9, balance = $10, town_id = $11, region_id = $12, legal = $13, company = $14 WHERE id = $15`,
-		u.Login, u.Level, u.Avatar, u.Email, u.Phone, u.FirstName, u.LastName, u.PaternalName, u.About, u.Balance, u.TownId, u.RegionId, u.Legal, u.Company, u.Id)
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	//balance only moves through the ledger, see ledger.go
+	ct, err := tx.Exec(ctx, `UPDATE logins SET login = $1, level = $2, avatar = $3, email = $4, phone = $5, first_name = $6, last_name = $7, paternal_name = $8, about = $9, town_id = $10, region_id = $11, legal = $12, company = $13 WHERE id = $14`,
+		u.Login, u.Level, u.Avatar, u.Email, u.Phone, u.FirstName, u.LastName, u.PaternalName, u.About, u.TownId, u.RegionId, u.Legal, u.Company, u.Id)
 	if err != nil {
 		return err
 	}
@@ -409,7 +463,19 @@ func UpdateLogin(u User) error {
 		return err
 	}
 
-	return nil
+	if err = screen(ctx, tx, ContentProfile, u.Id, u.About); err != nil {
+		return err
+	}
+
+	if err = pgxscan.Get(ctx, tx, &u, `SELECT * FROM logins WHERE id = $1`, u.Id); err != nil {
+		return err
+	}
+	u.Password, u.Refresh = "", nil
+	if err = outbox.Write(ctx, tx, TopicLoginUpdated, outboxKey(u.Id), u); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
 }
 
 func UpdateLastOnline(u User) error {
@@ -501,22 +567,69 @@ func TryRefresh(id string, hash string) (User, error) {
 	return user, err
 }
 
-func GetMasters(info string) (string, error) {
+var masterSorts = map[string]paging.Key{
+	"id":          {Column: "id", Desc: true},
+	"id_asc":      {Column: "id"},
+	"created":     {Column: "created", Cast: "timestamptz", Desc: true},
+	"last_online": {Column: "last_online", Cast: "timestamptz", Desc: true},
+	"rating":      {Column: "rating", Cast: "smallint", Desc: true},
+	"score":       {Column: "score", Cast: "float8", Desc: true},
+}
+
+func masterKey(u *User, sort string) (string, int64) {
+	switch masterSorts[sort].Column {
+	case "created":
+		return timeKey(u.Created), int64(u.Id)
+	case "last_online":
+		return timeKey(u.LastOnline), int64(u.Id)
+	case "rating":
+		return intKey(int64(u.Rating)), int64(u.Id)
+	case "score":
+		return strconv.FormatFloat(u.Score, 'g', -1, 64), int64(u.Id)
+	}
+	return "", int64(u.Id)
+}
+
+const masterSummary = `about, avatar, balance, company, created, email, first_name, id, last_name, last_online, legal, level, paternal_name, phone, rating, region_id, town_id`
 
+//logins with their ranking score, masters not scored yet have 0
+const mastersScored = `SELECT l.*, COALESCE(r.score, 0)::float8 AS score FROM logins l LEFT JOIN master_ratings r ON r.login_id = l.id`
+
+//masters, a page of them when asked for, shared by GetMasters and GetExpandedMasters
+func mastersPage(ctx context.Context, conn *pgxpool.Pool, info string) ([]*User, paging.Page, bool, error) {
 	limits := struct {
-		LoginId  []int `json:"login_id"`
+		paging.Request
+		LoginId []int  `json:"login_id"`
+		OrderBy string `json:"order_by"`
 	}{}
-	err := json.Unmarshal([]byte(info), &limits)
+	if err := json.Unmarshal([]byte(info), &limits); err != nil {
+		return nil, paging.Page{}, false, err
+	}
+
+	var w where
+	w.add(`level = 2`)
+	w.add(visibleSql(ContentProfile, "m.id"))
+	w.in("id", limits.LoginId)
+
+	sort := limits.OrderBy
+	order, isPaged, err := w.pageIfAsked(limits.Request, masterSorts, &sort, "id_asc")
 	if err != nil {
-		return "", err
+		return nil, paging.Page{}, false, err
 	}
 
-	summary := `about, avatar, balance, company, created, email,first_name, id, last_name, last_online, legal, level, paternal_name, phone, rating, region_id, town_id`
-	sql := `SELECT `+summary+` FROM logins WHERE level = 2`
-	if len(limits.LoginId) > 0 {
-		sql += `AND ` + inSqlFromInts(limits.LoginId, "id")
+	items := []*User{}
+	if err = pgxscan.Select(ctx, conn, &items, `SELECT `+masterSummary+`, score FROM (`+mastersScored+`) m`+w.sql()+order, w.args...); err != nil {
+		return nil, paging.Page{}, false, err
 	}
 
+	if !isPaged {
+		return items, paging.Page{}, false, nil
+	}
+	page := limits.Finish(&items, sort, func(i int) (string, int64) { return masterKey(items[i], sort) })
+	return items, page, true, nil
+}
+
+func GetMasters(info string) (string, error) {
 	ctx := context.Background()
 	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
 	if err != nil {
@@ -524,17 +637,22 @@ func GetMasters(info string) (string, error) {
 	}
 	defer conn.Close()
 
-	var items []*User
-	err = pgxscan.Select(ctx, conn, &items, sql)
+	found := struct {
+		paging.Page
+		Masters []*User `json:"masters"`
+	}{}
+	var isPaged bool
+	found.Masters, found.Page, isPaged, err = mastersPage(ctx, conn, info)
 	if err != nil {
 		return "", err
 	}
 
-	if len(items) < 1 {
-		return "", nil
+	var jm []byte
+	if isPaged {
+		jm, err = json.Marshal(found)
+	} else {
+		jm, err = json.Marshal(found.Masters)
 	}
-
-	jm, err := json.Marshal(items)
 	if err != nil {
 		return "", err
 	}
@@ -543,20 +661,6 @@ func GetMasters(info string) (string, error) {
 }
 
 func GetExpandedMasters(info string) (string, error) {
-	limits := struct {
-		LoginId  []int `json:"login_id"`
-	}{}
-	err := json.Unmarshal([]byte(info), &limits)
-	if err != nil {
-		return "", err
-	}
-
-	summary := `about, avatar, balance, company, created, email, first_name, id, last_name, last_online, legal, level, paternal_name, phone, rating, region_id, town_id`
-	sql := `SELECT `+summary+` FROM logins WHERE level = 2`
-	if len(limits.LoginId) > 0 {
-		sql += `AND ` + inSqlFromInts(limits.LoginId, "id")
-	}
-
 	ctx := context.Background()
 	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
 	if err != nil {
@@ -565,37 +669,45 @@ func GetExpandedMasters(info string) (string, error) {
 	defer conn.Close()
 
 	expanded := struct {
-		Masters []*User  `json:"masters"`
-		Towns   []*Town  `json:"towns"`
+		paging.Page
+		Masters []*User   `json:"masters"`
+		Towns   []*Town   `json:"towns"`
 		Regions []*Region `json:"regions"`
 	}{}
 
-	err = pgxscan.Select(ctx, conn, &expanded.Masters, sql)
+	var isPaged bool
+	expanded.Masters, expanded.Page, isPaged, err = mastersPage(ctx, conn, info)
 	if err != nil {
 		return "", err
 	}
 
-	townsSql := "SELECT * FROM towns WHERE id IN ("
+	//towns and regions only for the masters returned
+	var towns, regions []int
 	for _, v := range expanded.Masters {
-		townsSql += strconv.Itoa(int(v.TownId)) + `,`
+		towns = append(towns, int(v.TownId))
+		regions = append(regions, int(v.RegionId))
 	}
-	townsSql = townsSql[:len(townsSql)-1] + ")"
-	err = pgxscan.Select(ctx, conn, &expanded.Towns, townsSql)
+
+	err = pgxscan.Select(ctx, conn, &expanded.Towns, `SELECT * FROM towns WHERE id = ANY($1)`, towns)
 	if err != nil {
 		return "", err
 	}
 
-	regionSql := "SELECT * FROM regions WHERE id IN ("
-	for _, v := range expanded.Masters {
-		regionSql += strconv.Itoa(int(v.RegionId)) + `,`
-	}
-	regionSql = regionSql[:len(regionSql)-1] + ")"
-	err = pgxscan.Select(ctx, conn, &expanded.Regions, regionSql)
+	err = pgxscan.Select(ctx, conn, &expanded.Regions, `SELECT * FROM regions WHERE id = ANY($1)`, regions)
 	if err != nil {
 		return "", err
 	}
 
-	jm, err := json.Marshal(expanded)
+	var jm []byte
+	if isPaged {
+		jm, err = json.Marshal(expanded)
+	} else {
+		jm, err = json.Marshal(struct {
+			Masters []*User   `json:"masters"`
+			Towns   []*Town   `json:"towns"`
+			Regions []*Region `json:"regions"`
+		}{expanded.Masters, expanded.Towns, expanded.Regions})
+	}
 	if err != nil {
 		return "", err
 	}
@@ -845,11 +957,19 @@ func GetMastersChoices(id int32) ([]Choice, error) {
 	return cs, nil
 }
 
+//lists that only page by id
+var idSorts = map[string]paging.Key{
+	"id":     {Column: "id", Desc: true},
+	"id_asc": {Column: "id"},
+}
+
 func GetChoices(info string) (string, error) {
 	limits := struct {
-		Id  	  []int `json:"id"`
-		LoginId   []int `json:"login_id"`
-		ServiceId []int `json:"service_id"`
+		paging.Request
+		Id        []int  `json:"id"`
+		LoginId   []int  `json:"login_id"`
+		ServiceId []int  `json:"service_id"`
+		OrderBy   string `json:"order_by"`
 	}{}
 
 	err := json.Unmarshal([]byte(info), &limits)
@@ -857,15 +977,15 @@ func GetChoices(info string) (string, error) {
 		return "", err
 	}
 
-	sql := `SELECT * FROM choices WHERE id > 0`
-	if len(limits.Id) > 0 {
-		sql += `AND ` + inSqlFromInts(limits.Id, "id")
-	}
-	if len(limits.LoginId) > 0 {
-		sql += `AND ` + inSqlFromInts(limits.LoginId, "login_id")
-	}
-	if len(limits.ServiceId) > 0 {
-		sql += `AND ` + inSqlFromInts(limits.ServiceId, "service_id")
+	var w where
+	w.in("id", limits.Id)
+	w.in("login_id", limits.LoginId)
+	w.in("service_id", limits.ServiceId)
+
+	sort := limits.OrderBy
+	order, isPaged, err := w.pageIfAsked(limits.Request, idSorts, &sort, "id_asc")
+	if err != nil {
+		return "", err
 	}
 
 	ctx := context.Background()
@@ -875,17 +995,26 @@ func GetChoices(info string) (string, error) {
 	}
 	defer conn.Close()
 
-	var items []*Choice
-	err = pgxscan.Select(ctx, conn, &items, sql)
+	found := struct {
+		paging.Page
+		Choices []*Choice `json:"choices"`
+	}{Choices: []*Choice{}}
+	err = pgxscan.Select(ctx, conn, &found.Choices, `SELECT * FROM choices`+w.sql()+order, w.args...)
 	if err != nil {
 		return "", err
 	}
 
-	if len(items) < 1 {
-		return "", nil
+	if !isPaged {
+		jm, err := json.Marshal(found.Choices)
+		if err != nil {
+			return "", err
+		}
+		return string(jm), nil
 	}
 
-	jm, err := json.Marshal(items)
+	found.Page = limits.Finish(&found.Choices, sort, func(i int) (string, int64) { return "", int64(found.Choices[i].Id) })
+
+	jm, err := json.Marshal(found)
 	if err != nil {
 		return "", err
 	}
@@ -1081,20 +1210,24 @@ func GetPortfolio(info string) (string, error) {
 
 func MastersPortfolios(info string) (string, error) {
 	limits := struct {
+		paging.Request
 		LoginId   []int  `json:"login_id"`
 		ServiceId []int  `json:"service_id"`
+		OrderBy   string `json:"order_by"`
 	}{}
 	err := json.Unmarshal([]byte(info), &limits)
 	if err != nil {
 		return "", err
 	}
 
-	sql := `SELECT * FROM portfolio WHERE id > 0`
-	if len(limits.LoginId) > 0 {
-		sql += `AND ` + inSqlFromInts(limits.LoginId, "login_id")
-	}
-	if len(limits.ServiceId) > 0 {
-		sql += `AND ` + inSqlFromInts(limits.ServiceId, "service_id")
+	var w where
+	w.in("login_id", limits.LoginId)
+	w.in("service_id", limits.ServiceId)
+
+	sort := limits.OrderBy
+	order, isPaged, err := w.pageIfAsked(limits.Request, idSorts, &sort, "id")
+	if err != nil {
+		return "", err
 	}
 
 	ctx := context.Background()
@@ -1104,17 +1237,26 @@ func MastersPortfolios(info string) (string, error) {
 	}
 	defer conn.Close()
 
-	var items []*PortfolioWork
-	err = pgxscan.Select(ctx, conn, &items, sql)
+	found := struct {
+		paging.Page
+		Portfolios []*PortfolioWork `json:"portfolios"`
+	}{Portfolios: []*PortfolioWork{}}
+	err = pgxscan.Select(ctx, conn, &found.Portfolios, `SELECT * FROM portfolio`+w.sql()+order, w.args...)
 	if err != nil {
 		return "", err
 	}
 
-	if len(items) < 1 {
-		return "", nil
+	if !isPaged {
+		jm, err := json.Marshal(found.Portfolios)
+		if err != nil {
+			return "", err
+		}
+		return string(jm), nil
 	}
 
-	jm, err := json.Marshal(items)
+	found.Page = limits.Finish(&found.Portfolios, sort, func(i int) (string, int64) { return "", int64(found.Portfolios[i].Id) })
+
+	jm, err := json.Marshal(found)
 	if err != nil {
 		return "", err
 	}
@@ -1132,11 +1274,15 @@ func GetProfileComments(id int32) ([]Comment, error) {
 	}
 	defer conn.Close()
 
-	err = pgxscan.Select(ctx, conn, &cs, `SELECT * FROM comments WHERE master_id = $1`, id)
+	err = pgxscan.Select(ctx, conn, &cs, `SELECT * FROM comments WHERE master_id = $1 AND `+visibleSql(ContentReview, "comments.id"), id)
 	if err != nil {
 		return cs, err
 	}
 
+	if err = hideReplies(ctx, conn, cs); err != nil {
+		return cs, err
+	}
+
 	return cs, nil
 }
 
@@ -1155,73 +1301,159 @@ func AddOrder(info string) (string, error) {
 	}
 	defer conn.Close()
 
-	sql := `INSERT INTO orders (login_id, service_id, name, title, description, region_id, town_id, budget, created, time) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`
-	row := conn.QueryRow(ctx, sql, o.LoginId, o.ServiceId, o.Name, o.Title, o.Description, o.RegionId, o.TownId, o.Budget, o.Created, o.Time)
+	o.Attributes, err = checkOrderAttributes(ctx, conn, o.ServiceId, o.Attributes)
+	if err != nil {
+		return "", err
+	}
+
+	//new orders are either drafts or go straight out to masters
+	if o.Status != OrderDraft {
+		o.Status = OrderPublished
+	}
+	o.Completed = false
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	sql := `INSERT INTO orders (login_id, service_id, name, title, description, region_id, town_id, budget, created, time, attributes, status) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id`
+	row := tx.QueryRow(ctx, sql, o.LoginId, o.ServiceId, o.Name, o.Title, o.Description, o.RegionId, o.TownId, o.Budget, o.Created, o.Time, o.Attributes, o.Status)
 	if err = row.Scan(&o.Id); err != nil {
 		return "", err
 	}
 
+	_, err = tx.Exec(ctx, `INSERT INTO order_transitions (order_id, from_status, to_status, login_id, created) VALUES ($1, '', $2, $3, $4)`, o.Id, o.Status, o.LoginId, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	if err = screen(ctx, tx, ContentOrder, o.Id, o.Title, o.Description); err != nil {
+		return "", err
+	}
+
+	if err = announceOrder(ctx, tx, o); err != nil {
+		return "", err
+	}
+
+	if err = outbox.Write(ctx, tx, TopicOrderCreated, outboxKey(o.Id), o); err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
 	jm, err := json.Marshal(o)
 
 	return string(jm), nil
 }
 
+//columns orders can be sorted by, anything else falls back to newest first
+var orderSorts = map[string]paging.Key{
+	"created":     {Column: "created", Cast: "timestamptz", Desc: true},
+	"created_asc": {Column: "created", Cast: "timestamptz"},
+	"budget":      {Column: "budget", Cast: "int", Desc: true},
+	"budget_asc":  {Column: "budget", Cast: "int"},
+	"id":          {Column: "id", Desc: true},
+	"id_asc":      {Column: "id"},
+}
+
+func orderKey(o *Order, sort string) (string, int64) {
+	switch orderSorts[sort].Column {
+	case "created":
+		return timeKey(o.Created), int64(o.Id)
+	case "budget":
+		return intKey(int64(o.Budget)), int64(o.Id)
+	}
+	return "", int64(o.Id)
+}
+
 func GetOrders(info string) (string, error) {
 	limits := struct {
-		OrderBy    string `json:"order_by"`
-		Limit         int `json:"limit"`
-		Offset        int `json:"offset"`
-		Id 		    []int `json:"id"`
-		ServiceId   []int `json:"service_id"`
-		TownId      []int `json:"town_id"`
-		RegionId    []int `json:"region_id"`
-		LoginId     []int `json:"login_id"`
+		paging.Request
+		OrderBy     string                     `json:"order_by"`
+		Id          []int                      `json:"id"`
+		ServiceId   []int                      `json:"service_id"`
+		ServiceTree []int                      `json:"service_tree"`
+		TownId      []int                      `json:"town_id"`
+		RegionId    []int                      `json:"region_id"`
+		CountryId   []int                      `json:"country_id"`
+		LoginId     []int                      `json:"login_id"`
+		MasterId    []int                      `json:"master_id"`
+		Status      []string                   `json:"status"`
+		BudgetMin   int                        `json:"budget_min"`
+		BudgetMax   int                        `json:"budget_max"`
+		CreatedFrom time.Time                  `json:"created_from"`
+		CreatedTo   time.Time                  `json:"created_to"`
+		Query       string                     `json:"query"`
+		Attributes  map[string]attrs.Condition `json:"attributes"`
+		//older exclusive bounds
 		BudgetGreater int `json:"budget_greater"`
 		BudgetLess    int `json:"budget_less"`
+		//owners and moderators also see what moderation keeps from the public
+		WithHidden bool `json:"with_hidden"`
 	}{}
 	err := json.Unmarshal([]byte(info), &limits)
 	if err != nil {
 		return "", err
 	}
 
-	sql := `SELECT * FROM orders WHERE id > 0`
-	if len(limits.Id) > 0 {
-		sql += `AND ` + inSqlFromInts(limits.Id, "id")
+	var w where
+	if !limits.WithHidden {
+		w.add(visibleSql(ContentOrder, "orders.id"))
 	}
+	w.in("id", limits.Id)
+	w.in("service_id", limits.ServiceId)
+	w.in("town_id", limits.TownId)
+	w.in("region_id", limits.RegionId)
+	w.in("login_id", limits.LoginId)
+	w.in("master_id", limits.MasterId)
 
-	if len(limits.ServiceId) > 0 {
-		sql += `AND ` + inSqlFromInts(limits.ServiceId, "service_id")
+	//whole branches of the cats tree
+	if len(limits.ServiceTree) > 0 {
+		w.add(`service_id IN (WITH RECURSIVE sub AS (
+			SELECT id FROM cats WHERE id = ANY(` + w.arg(limits.ServiceTree) + `)
+			UNION SELECT c.id FROM cats c JOIN sub ON c.parent_id = sub.id
+		) SELECT id FROM sub)`)
 	}
 
-	if len(limits.TownId) > 0 {
-		sql += `AND ` + inSqlFromInts(limits.TownId, "town_id")
+	if len(limits.CountryId) > 0 {
+		w.add(`region_id IN (SELECT id FROM regions WHERE country_id = ANY(` + w.arg(limits.CountryId) + `))`)
 	}
 
-	if len(limits.RegionId) > 0 {
-		sql += `AND ` + inSqlFromInts(limits.RegionId, "region_id")
+	if len(limits.Status) > 0 {
+		w.add(`status = ANY(` + w.arg(limits.Status) + `)`)
 	}
 
-	if len(limits.LoginId) > 0 {
-		sql += `AND ` + inSqlFromInts(limits.LoginId, "login_id")
+	if limits.BudgetMin != 0 {
+		w.add(`budget >= ` + w.arg(limits.BudgetMin))
+	}
+	if limits.BudgetMax != 0 {
+		w.add(`budget <= ` + w.arg(limits.BudgetMax))
 	}
-
 	if limits.BudgetGreater != 0 {
-		sql += `AND WHERE budget > `+strconv.Itoa(limits.BudgetGreater)
+		w.add(`budget > ` + w.arg(limits.BudgetGreater))
 	}
-
-	if limits.BudgetLess != 0 && limits.BudgetGreater < limits.BudgetLess {
-		sql += `AND WHERE budget < `+strconv.Itoa(limits.BudgetLess)
+	if limits.BudgetLess != 0 {
+		w.add(`budget < ` + w.arg(limits.BudgetLess))
 	}
-	if limits.OrderBy != "" {
-		sql += ` ORDER BY `+limits.OrderBy
+
+	if !limits.CreatedFrom.IsZero() {
+		w.add(`created >= ` + w.arg(limits.CreatedFrom))
 	}
-	if limits.Limit != 0 {
-		sql += ` LIMIT `+strconv.Itoa(limits.Limit)
+	if !limits.CreatedTo.IsZero() {
+		w.add(`created < ` + w.arg(limits.CreatedTo))
 	}
-	if limits.Offset != 0 {
-		sql += ` OFFSET `+strconv.Itoa(limits.Offset)
+
+	if strings.TrimSpace(limits.Query) != "" {
+		w.add(orderSearchVector + ` @@ plainto_tsquery('russian', ` + w.arg(limits.Query) + `)`)
 	}
 
+	if err = attributesWhere(&w, limits.Attributes); err != nil {
+		return "", err
+	}
 
 	ctx := context.Background()
 	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
@@ -1230,18 +1462,42 @@ func GetOrders(info string) (string, error) {
 	}
 	defer conn.Close()
 
-	var orders []*Order
-	err = pgxscan.Select(ctx, conn, &orders, sql)
+	found := struct {
+		paging.Page
+		Total  int      `json:"total"`
+		Orders []*Order `json:"orders"`
+	}{Orders: []*Order{}}
+
+	//the total covers the filters, not the page
+	err = conn.QueryRow(ctx, `SELECT COUNT(*) FROM orders`+w.sql(), w.args...).Scan(&found.Total)
 	if err != nil {
 		return "", err
 	}
 
-	if len(orders) < 1 {
-		err = errors.New("no records found")
+	sort := limits.OrderBy
+	order, isPaged, err := w.pageIfAsked(limits.Request, orderSorts, &sort, "created")
+	if err != nil {
 		return "", err
 	}
 
-	jm, err := json.Marshal(orders)
+	err = pgxscan.Select(ctx, conn, &found.Orders, `SELECT * FROM orders`+w.sql()+order, w.args...)
+	if err != nil {
+		return "", err
+	}
+
+	if !isPaged {
+		jm, err := json.Marshal(struct {
+			Total  int      `json:"total"`
+			Orders []*Order `json:"orders"`
+		}{found.Total, found.Orders})
+		if err != nil {
+			return "", err
+		}
+		return string(jm), nil
+	}
+	found.Page = limits.Finish(&found.Orders, sort, func(i int) (string, int64) { return orderKey(found.Orders[i], sort) })
+
+	jm, err := json.Marshal(found)
 	if err != nil {
 		return "", err
 	}
@@ -1264,24 +1520,79 @@ func AddOffer(info string) (string, error) {
 	}
 	defer conn.Close()
 
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	//offers only go to open orders, the first one starts the negotiation
+	var order Order
+	if err = pgxscan.Get(ctx, tx, &order, `SELECT * FROM orders WHERE id = $1 FOR UPDATE`, o.OrderId); err != nil {
+		return "", err
+	}
+	if !orderIsOpen(order.Status) {
+		err = errors.New("order is " + order.Status + ", offers are closed")
+		return "", err
+	}
+	o.CustomerId = order.LoginId
+	o.Accept = OfferPending
+
 	sql := `INSERT INTO offers (order_id, customer_id, master_id, accept, price, meeting, description, created) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
-	row := conn.QueryRow(ctx, sql, o.OrderId, o.CustomerId, o.MasterId, o.Accept, o.Price, o.Meeting, o.Description, o.Created)
+	row := tx.QueryRow(ctx, sql, o.OrderId, o.CustomerId, o.MasterId, o.Accept, o.Price, o.Meeting, o.Description, o.Created)
 	if err = row.Scan(&o.Id); err != nil {
 		return "", err
 	}
 
+	if err = screen(ctx, tx, ContentOffer, o.Id, o.Description, o.Meeting); err != nil {
+		return "", err
+	}
+
+	//a master who can't pay for the offer doesn't get to make it
+	if err = chargeOffer(ctx, tx, &order, &o); err != nil {
+		return "", err
+	}
+
+	if order.Status == OrderPublished {
+		if _, err = transitionOrder(ctx, tx, order.Id, OrderInNegotiation, o.MasterId, "first offer"); err != nil {
+			return "", err
+		}
+	}
+
+	if err = emitEvent(ctx, tx, Event{Kind: EventNewOffer, LoginId: o.CustomerId, OrderId: o.OrderId, OfferId: o.Id, Payload: payload(o)}); err != nil {
+		return "", err
+	}
+
+	if err = outbox.Write(ctx, tx, TopicOfferCreated, outboxKey(o.Id), o); err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
 	jm, err := json.Marshal(o)
 
 	return string(jm), nil
 }
 
+var offerSorts = map[string]paging.Key{
+	"created":     {Column: "created", Cast: "timestamptz", Desc: true},
+	"created_asc": {Column: "created", Cast: "timestamptz"},
+	"id":          {Column: "id", Desc: true},
+	"id_asc":      {Column: "id"},
+}
+
 func GetOffers(info string) (string, error) {
 	limits := struct {
-		Id  	   []int `json:"id"`
-		OrderId    []int `json:"order_id"`
-		CustomerId []int `json:"customer_id"`
-		MasterId   []int `json:"master_id"`
+		paging.Request
+		Id         []int  `json:"id"`
+		OrderId    []int  `json:"order_id"`
+		CustomerId []int  `json:"customer_id"`
+		MasterId   []int  `json:"master_id"`
 		OrderBy    string `json:"order_by"`
+		//the customer reading their offers, it makes the masters' charges final
+		ViewerId int32 `json:"viewer_id"`
 	}{}
 
 	err := json.Unmarshal([]byte(info), &limits)
@@ -1289,21 +1600,16 @@ func GetOffers(info string) (string, error) {
 		return "", err
 	}
 
-	sql := `SELECT * FROM offers WHERE id > 0`
-	if len(limits.Id) > 0 {
-		sql += `AND ` + inSqlFromInts(limits.Id, "id")
-	}
-	if len(limits.OrderId) > 0 {
-		sql += `AND ` + inSqlFromInts(limits.OrderId, "order_id")
-	}
-	if len(limits.CustomerId) > 0 {
-		sql += `AND ` + inSqlFromInts(limits.CustomerId, "customer_id")
-	}
-	if len(limits.MasterId) > 0 {
-		sql += `AND ` + inSqlFromInts(limits.MasterId, "master_id")
-	}
-	if limits.OrderBy != "" {
-		sql += ` ORDER BY `+limits.OrderBy
+	var w where
+	w.in("id", limits.Id)
+	w.in("order_id", limits.OrderId)
+	w.in("customer_id", limits.CustomerId)
+	w.in("master_id", limits.MasterId)
+
+	sort := limits.OrderBy
+	order, isPaged, err := w.pageIfAsked(limits.Request, offerSorts, &sort, "created")
+	if err != nil {
+		return "", err
 	}
 
 	ctx := context.Background()
@@ -1313,18 +1619,43 @@ func GetOffers(info string) (string, error) {
 	}
 	defer conn.Close()
 
-	var offers []*Offer
-	err = pgxscan.Select(ctx, conn, &offers, sql)
+	found := struct {
+		paging.Page
+		Offers []*Offer `json:"offers"`
+	}{Offers: []*Offer{}}
+	err = pgxscan.Select(ctx, conn, &found.Offers, `SELECT * FROM offers`+w.sql()+order, w.args...)
 	if err != nil {
 		return "", err
 	}
 
-	if len(offers) < 1 {
+	if len(found.Offers) < 1 && !isPaged {
 		err = errors.New("no records found")
 		return "", err
 	}
 
-	jm, err := json.Marshal(offers)
+	if isPaged {
+		found.Page = limits.Finish(&found.Offers, sort, func(i int) (string, int64) {
+			if offerSorts[sort].Column == "created" {
+				return timeKey(found.Offers[i].Created), int64(found.Offers[i].Id)
+			}
+			return "", int64(found.Offers[i].Id)
+		})
+	}
+
+	var seen []int32
+	for _, v := range found.Offers {
+		seen = append(seen, v.Id)
+	}
+	if err = markOffersViewed(ctx, conn, limits.ViewerId, seen); err != nil {
+		return "", err
+	}
+
+	var jm []byte
+	if isPaged {
+		jm, err = json.Marshal(found)
+	} else {
+		jm, err = json.Marshal(found.Offers)
+	}
 	if err != nil {
 		return "", err
 	}
@@ -1346,9 +1677,17 @@ func UpdateOffer(info string) error {
 		return err
 	}
 	defer conn.Close()
-	ct, err := conn.Exec(ctx,
-		`UPDATE offers SET price = $1, description = $2, meeting = $3, accept = $4 WHERE id = $5`,
-		o.Price, o.Description, o.Meeting, o.Accept, o.Id)
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	//accept only changes through accept-offer, and only the author edits a still open offer
+	ct, err := tx.Exec(ctx,
+		`UPDATE offers SET price = $1, description = $2, meeting = $3 WHERE id = $4 AND master_id = $5 AND accept = $6`,
+		o.Price, o.Description, o.Meeting, o.Id, o.MasterId, OfferPending)
 	if err != nil {
 		return err
 	}
@@ -1358,5 +1697,17 @@ func UpdateOffer(info string) error {
 		return err
 	}
 
-	return nil
+	if err = screen(ctx, tx, ContentOffer, o.Id, o.Description, o.Meeting); err != nil {
+		return err
+	}
+
+	if err = pgxscan.Get(ctx, tx, &o, `SELECT * FROM offers WHERE id = $1`, o.Id); err != nil {
+		return err
+	}
+
+	if err = outbox.Write(ctx, tx, TopicOfferUpdated, outboxKey(o.Id), o); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
 }
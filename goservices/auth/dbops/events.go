@@ -0,0 +1,84 @@
+package dbops
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"go.mods/outbox"
+)
+
+//event kinds, login_id on an event is the user it's meant for
+const (
+	EventNewOffer       = "new_offer"
+	EventOfferAccepted  = "offer_accepted"
+	EventOfferDeclined  = "offer_declined"
+	EventOfferWithdrawn = "offer_withdrawn"
+	EventOrderStatus    = "order_status"
+	EventNewReview      = "new_review"
+	EventReviewReply    = "review_reply"
+	EventNewMessage     = "new_message"
+	EventMessagesRead   = "messages_read"
+	EventMatchingOrder  = "matching_order"
+)
+
+//outbox topics of the writes other components follow, events go out as event.{kind}
+const (
+	TopicOrderCreated    = "order.created"
+	TopicOrderUpdated    = "order.updated"
+	TopicOrderStatus     = "order.status"
+	TopicOfferCreated    = "offer.created"
+	TopicOfferUpdated    = "offer.updated"
+	TopicLoginRegistered = "login.registered"
+	TopicLoginUpdated    = "login.updated"
+	topicEvent           = "event"
+)
+
+func outboxKey(id int32) string {
+	return strconv.Itoa(int(id))
+}
+
+type Event struct {
+	Id      int64           `json:"id"`
+	Kind    string          `json:"kind"`
+	LoginId int32           `json:"login_id"`
+	OrderId int32           `json:"order_id"`
+	OfferId int32           `json:"offer_id"`
+	Payload json.RawMessage `json:"payload"`
+	Created time.Time       `json:"created"`
+	Txid    int64           `json:"-"`
+}
+
+//written in the same transaction as the change it describes, so nothing is announced that didn't happen
+//the notify goes out on commit and wakes subscribers on every replica, see listen.go
+//the outbox copy is what notifications and the audit log consume, see relay.go
+func emitEvent(ctx context.Context, tx pgx.Tx, e Event) error {
+	if len(e.Payload) == 0 {
+		e.Payload = json.RawMessage(`{}`)
+	}
+	e.Created = time.Now()
+
+	err := tx.QueryRow(ctx, `INSERT INTO events (kind, login_id, order_id, offer_id, payload, created) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		e.Kind, e.LoginId, e.OrderId, e.OfferId, e.Payload, e.Created).Scan(&e.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `SELECT pg_notify('`+eventsChannel+`', json_build_object('id', $1::bigint, 'login_id', $2::int)::text)`, e.Id, e.LoginId)
+	if err != nil {
+		return err
+	}
+
+	return outbox.Write(ctx, tx, topicEvent+"."+e.Kind, strconv.Itoa(int(e.LoginId)), e)
+}
+
+func payload(v interface{}) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return json.RawMessage(`{}`)
+	}
+	return b
+}
@@ -0,0 +1,383 @@
+package dbops
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//a payment provider that lives in this process, for local runs and tests
+//the server side keeps everything in memory, the client side talks to it over http like a real gateway would
+const ProviderFake = "fake"
+
+const (
+	fakeSignatureHeader = "X-Fake-Signature"
+	fakeTimestampHeader = "X-Fake-Timestamp"
+	//older webhooks are replays
+	fakeWebhookWindow = 5 * time.Minute
+)
+
+//the fake provider is never on by accident, it needs its own key and a secret that isn't the old default
+func fakeConfigured() error {
+	if os.Getenv("PAYMENTS_FAKE_KEY") == "" {
+		return errors.New("PAYMENTS_FAKE_KEY is not set")
+	}
+	if s := os.Getenv("PAYMENTS_FAKE_SECRET"); s == "" || s == ProviderFake {
+		return errors.New("PAYMENTS_FAKE_SECRET is not set or is the default")
+	}
+	return nil
+}
+
+//hex hmac-sha256 over "timestamp.body"
+func fakeSign(secret string, ts string, body []byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(ts + "."))
+	m.Write(body)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+type fakeClient struct {
+	url    string
+	key    string
+	secret string
+	http   *http.Client
+}
+
+//PAYMENTS_FAKE_URL is where the fake server answers, PAYMENTS_FAKE_KEY and PAYMENTS_FAKE_SECRET must match its own
+func newFakeClient() *fakeClient {
+	c := &fakeClient{url: strings.TrimRight(os.Getenv("PAYMENTS_FAKE_URL"), "/"), key: os.Getenv("PAYMENTS_FAKE_KEY"), secret: os.Getenv("PAYMENTS_FAKE_SECRET"),
+		http: &http.Client{Timeout: 15 * time.Second}}
+	if c.url == "" {
+		c.url = "http://localhost:50014"
+	}
+	return c
+}
+
+func (c *fakeClient) call(ctx context.Context, method string, path string, key string, in interface{}) (ProviderState, error) {
+	var s ProviderState
+	var body []byte
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return s, err
+		}
+		body = b
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.url+path, bytes.NewReader(body))
+	if err != nil {
+		return s, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.key)
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return s, err
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return s, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return s, errors.New(res.Status + ": " + strings.TrimSpace(string(b)))
+	}
+	err = json.Unmarshal(b, &s)
+	return s, err
+}
+
+func (c *fakeClient) Create(ctx context.Context, p *Payment, key string) (ProviderState, error) {
+	return c.call(ctx, http.MethodPost, "/payments", key, map[string]interface{}{
+		"amount":      p.Amount,
+		"description": "balance top-up for login " + strconv.Itoa(int(p.LoginId)),
+	})
+}
+
+func (c *fakeClient) Get(ctx context.Context, externalId string) (ProviderState, error) {
+	return c.call(ctx, http.MethodGet, "/payments/"+externalId, "", nil)
+}
+
+func (c *fakeClient) Refund(ctx context.Context, r *PaymentRefund, externalPaymentId string, key string) (ProviderState, error) {
+	return c.call(ctx, http.MethodPost, "/refunds", key, map[string]interface{}{"payment_id": externalPaymentId, "amount": r.Amount})
+}
+
+func (c *fakeClient) Webhook(header http.Header, body []byte) (ProviderState, error) {
+	var s ProviderState
+	ts := header.Get(fakeTimestampHeader)
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return s, errors.New("webhook without a timestamp")
+	}
+	if d := time.Since(time.Unix(sec, 0)); d > fakeWebhookWindow || d < -fakeWebhookWindow {
+		return s, errors.New("webhook is too old")
+	}
+	if !hmac.Equal([]byte(header.Get(fakeSignatureHeader)), []byte(fakeSign(c.secret, ts, body))) {
+		return s, errors.New("bad webhook signature")
+	}
+
+	err = json.Unmarshal(body, &s)
+	return s, err
+}
+
+//the fake gateway itself
+type fakeServer struct {
+	mu       sync.Mutex
+	key      string
+	secret   string
+	webhook  string
+	public   string
+	auto     string
+	next     int
+	payments map[string]*ProviderState
+	refunds  map[string]*ProviderState
+	refunded map[string]int32
+	keys     map[string]string
+	client   *http.Client
+}
+
+//serves the fake gateway on PAYMENTS_FAKE_ADDR, nothing happens when it's empty
+//payments wait on /checkout/{id}?result=succeeded|canceled unless PAYMENTS_FAKE_AUTO settles them right away
+//every change is posted, signed, to PAYMENTS_WEBHOOK_URL
+func StartFakeProvider() {
+	addr := os.Getenv("PAYMENTS_FAKE_ADDR")
+	if addr == "" {
+		return
+	}
+	if err := fakeConfigured(); err != nil {
+		log.Println("fake payment provider not started: ", err)
+		return
+	}
+
+	f := &fakeServer{
+		key:      os.Getenv("PAYMENTS_FAKE_KEY"),
+		secret:   os.Getenv("PAYMENTS_FAKE_SECRET"),
+		webhook:  os.Getenv("PAYMENTS_WEBHOOK_URL"),
+		public:   strings.TrimRight(os.Getenv("PAYMENTS_FAKE_URL"), "/"),
+		auto:     os.Getenv("PAYMENTS_FAKE_AUTO"),
+		payments: map[string]*ProviderState{},
+		refunds:  map[string]*ProviderState{},
+		refunded: map[string]int32{},
+		keys:     map[string]string{},
+		client:   &http.Client{Timeout: 15 * time.Second},
+	}
+	if f.webhook == "" {
+		f.webhook = "http://localhost:50013/payments/webhook/" + ProviderFake
+	}
+	if f.public == "" {
+		f.public = "http://localhost:50014"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/payments", f.authorized(f.create))
+	mux.HandleFunc("/payments/", f.authorized(f.get))
+	mux.HandleFunc("/refunds", f.authorized(f.refund))
+	mux.HandleFunc("/checkout/", f.checkout)
+
+	go func() {
+		log.Println("fake payment provider listening on " + addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Println("fake payment provider stopped: ", err)
+		}
+	}()
+}
+
+func (f *fakeServer) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+f.key {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (f *fakeServer) reply(w http.ResponseWriter, s ProviderState) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+//the same idempotency key gets the same object back, whatever the body says this time
+func (f *fakeServer) create(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	in := struct {
+		Amount int32 `json:"amount"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil || in.Amount <= 0 {
+		http.Error(w, "bad payment", http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	key := "payment:" + r.Header.Get("Idempotency-Key")
+	if id, ok := f.keys[key]; ok && key != "payment:" {
+		s := *f.payments[id]
+		f.mu.Unlock()
+		f.reply(w, s)
+		return
+	}
+	f.next++
+	id := "fp_" + strconv.Itoa(f.next)
+	s := &ProviderState{ExternalId: id, Status: PaymentPending, Amount: in.Amount, ConfirmationUrl: f.public + "/checkout/" + id}
+	f.payments[id] = s
+	f.keys[key] = id
+	out := *s
+	f.mu.Unlock()
+
+	if f.auto == PaymentSucceeded || f.auto == PaymentCanceled {
+		go f.settle(id, f.auto)
+	}
+	f.reply(w, out)
+}
+
+func (f *fakeServer) get(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/payments/")
+	f.mu.Lock()
+	s, ok := f.payments[id]
+	var out ProviderState
+	if ok {
+		out = *s
+	}
+	f.mu.Unlock()
+	if !ok {
+		http.Error(w, "no such payment", http.StatusNotFound)
+		return
+	}
+	f.reply(w, out)
+}
+
+//what the user would see after following confirmation_url
+func (f *fakeServer) checkout(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/checkout/")
+	result := r.URL.Query().Get("result")
+	if result == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<a href="?result=succeeded">pay</a> <a href="?result=canceled">cancel</a>`))
+		return
+	}
+	if result != PaymentSucceeded && result != PaymentCanceled {
+		http.Error(w, "result is succeeded or canceled", http.StatusBadRequest)
+		return
+	}
+	if err := f.settle(id, result); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Write([]byte("payment " + id + " " + result + "\n"))
+}
+
+func (f *fakeServer) settle(id string, status string) error {
+	f.mu.Lock()
+	s, ok := f.payments[id]
+	if !ok {
+		f.mu.Unlock()
+		return errors.New("no such payment")
+	}
+	if s.Status != PaymentPending {
+		f.mu.Unlock()
+		return errors.New("payment is already " + s.Status)
+	}
+	s.Status = status
+	out := *s
+	f.mu.Unlock()
+
+	go f.notify(out)
+	return nil
+}
+
+//a refund can't take back more than was paid, asking for too much fails it like a real gateway would
+func (f *fakeServer) refund(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	in := struct {
+		PaymentId string `json:"payment_id"`
+		Amount    int32  `json:"amount"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil || in.Amount <= 0 {
+		http.Error(w, "bad refund", http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	key := "refund:" + r.Header.Get("Idempotency-Key")
+	if id, ok := f.keys[key]; ok && key != "refund:" {
+		s := *f.refunds[id]
+		f.mu.Unlock()
+		f.reply(w, s)
+		return
+	}
+	p, ok := f.payments[in.PaymentId]
+	if !ok {
+		f.mu.Unlock()
+		http.Error(w, "no such payment", http.StatusNotFound)
+		return
+	}
+	f.next++
+	id := "fr_" + strconv.Itoa(f.next)
+	s := &ProviderState{Refund: true, ExternalId: id, Status: PaymentSucceeded, Amount: in.Amount}
+	if p.Status != PaymentSucceeded || f.refunded[p.ExternalId]+in.Amount > p.Amount {
+		s.Status = PaymentFailed
+	} else {
+		f.refunded[p.ExternalId] += in.Amount
+	}
+	f.refunds[id] = s
+	f.keys[key] = id
+	out := *s
+	f.mu.Unlock()
+
+	go f.notify(out)
+	f.reply(w, out)
+}
+
+//a few tries, the reconciler picks up whatever still gets lost
+func (f *fakeServer) notify(s ProviderState) {
+	body, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	for i := 0; i < 5; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * time.Second)
+		}
+		req, err := http.NewRequest(http.MethodPost, f.webhook, bytes.NewReader(body))
+		if err != nil {
+			log.Println("fake payment provider: ", err)
+			return
+		}
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(fakeTimestampHeader, ts)
+		req.Header.Set(fakeSignatureHeader, fakeSign(f.secret, ts, body))
+
+		res, err := f.client.Do(req)
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				return
+			}
+			err = errors.New(res.Status)
+		}
+		log.Println("fake payment provider webhook for "+s.ExternalId+" failed: ", err)
+	}
+}
@@ -0,0 +1,134 @@
+package dbops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"go.mods/paging"
+)
+
+//an order in a master's feed, fit counts an exact skill and an exact town, 0 to 2
+type FeedOrder struct {
+	Order
+	Fit  int32     `json:"fit"`
+	Rank time.Time `json:"-"`
+}
+
+//how far each point of fit lifts an order above newer ones, FEED_FIT_BOOST_HOURS
+func feedFitBoost() string {
+	if h, err := strconv.Atoi(os.Getenv("FEED_FIT_BOOST_HOURS")); err == nil && h >= 0 {
+		return strconv.Itoa(h) + " hours"
+	}
+	return "24 hours"
+}
+
+//open orders the master can serve and hasn't offered on yet
+//services are those in choices plus, for choices that cover subcategories, everything under them
+//masters without territories see orders from everywhere
+var feedOrders = `WITH RECURSIVE covered AS (
+		SELECT service_id AS id, parent AS deep, 1 AS exact FROM choices WHERE login_id = $1
+		UNION SELECT c.id, true, 0 FROM cats c JOIN covered cv ON c.parent_id = cv.id WHERE cv.deep
+	),
+	skills AS (SELECT id, MAX(exact) AS exact FROM covered GROUP BY id),
+	areas AS (SELECT region_id, town_id FROM territories WHERE login_id = $1)
+	SELECT * FROM (
+		SELECT o.*, o.created + o.fit * $2::interval AS rank FROM (
+			SELECT o.*, (s.exact + CASE WHEN EXISTS (SELECT 1 FROM areas a WHERE a.town_id = o.town_id AND o.town_id != 0) THEN 1 ELSE 0 END)::int AS fit
+			FROM orders o JOIN skills s ON s.id = o.service_id
+			WHERE o.status = ANY($3)
+			AND o.login_id != $1
+			AND NOT EXISTS (SELECT 1 FROM offers f WHERE f.order_id = o.id AND f.master_id = $1)
+			AND ` + visibleOrders + `
+			AND (NOT EXISTS (SELECT 1 FROM areas)
+				OR EXISTS (SELECT 1 FROM areas a WHERE (a.town_id != 0 AND a.town_id = o.town_id) OR (a.town_id = 0 AND a.region_id = o.region_id)))
+		) o
+	) feed`
+
+var visibleOrders = visibleSql(ContentOrder, "o.id")
+
+var feedSort = map[string]paging.Key{
+	"rank": {Column: "rank", Cast: "timestamptz", Desc: true},
+}
+
+//the master's personal list of open orders, best fit and newest first
+func GetOrderFeed(info string) (string, error) {
+	in := struct {
+		paging.Request
+		MasterId int32     `json:"master_id"`
+		Since    time.Time `json:"since"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+	if in.MasterId == 0 {
+		return "", errors.New("master_id is required")
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	var level int16
+	var lastOnline time.Time
+	if err = conn.QueryRow(ctx, `SELECT level, last_online FROM logins WHERE id = $1`, in.MasterId).Scan(&level, &lastOnline); err != nil {
+		return "", err
+	}
+	if level != 2 {
+		return "", errors.New("only masters have an order feed")
+	}
+
+	//new since the last visit unless the caller knows better
+	since := lastOnline
+	if !in.Since.IsZero() {
+		since = in.Since
+	}
+
+	var w where
+	w.arg(in.MasterId)
+	w.arg(feedFitBoost())
+	w.arg([]string{OrderPublished, OrderInNegotiation})
+
+	found := struct {
+		paging.Page
+		New    int          `json:"new"`
+		Since  time.Time    `json:"since"`
+		Orders []*FeedOrder `json:"orders"`
+	}{Since: since, Orders: []*FeedOrder{}}
+
+	err = conn.QueryRow(ctx, `SELECT COUNT(*) FROM (`+feedOrders+`) n WHERE created > $4`, append(w.args[:3:3], since)...).Scan(&found.New)
+	if err != nil {
+		return "", err
+	}
+
+	sort := "rank"
+	order, err := w.page(in.Request, feedSort, &sort, "rank")
+	if err != nil {
+		return "", err
+	}
+
+	err = pgxscan.Select(ctx, conn, &found.Orders, feedOrders+w.sql()+order, w.args...)
+	if err != nil {
+		return "", err
+	}
+
+	found.Page = in.Finish(&found.Orders, sort, func(i int) (string, int64) {
+		return timeKey(found.Orders[i].Rank), int64(found.Orders[i].Id)
+	})
+
+	jm, err := json.Marshal(found)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
@@ -2,11 +2,15 @@ module go.mods/dbops
 
 go 1.17
 
-replace go.mods/hashing => ../hashing
+replace (
+	go.mods/attrs => ../../shared/attrs
+	go.mods/hashing => ../hashing
+)
 
 require (
 	github.com/georgysavva/scany v0.2.9
 	github.com/jackc/pgx/v4 v4.13.0
+	go.mods/attrs v0.0.0-00010101000000-000000000000
 	go.mods/hashing v0.0.0-00010101000000-000000000000
 )
 
@@ -24,7 +28,16 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/objx v0.2.0 // indirect
 	github.com/stretchr/testify v1.7.0 // indirect
+	go.mods/outbox v0.0.0-00010101000000-000000000000
+	go.mods/paging v0.0.0-00010101000000-000000000000
+	go.mods/pdf v0.0.0-00010101000000-000000000000
 	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5 // indirect
 	golang.org/x/text v0.3.6 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
+
+replace go.mods/paging => ../../shared/paging
+
+replace go.mods/outbox => ../../shared/outbox
+
+replace go.mods/pdf => ../../shared/pdf
@@ -0,0 +1,379 @@
+package dbops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+//what a master pays for
+const (
+	LeadOffer    = "offer"
+	LeadContacts = "contacts"
+)
+
+var leadFees = map[string]string{
+	LeadOffer:    LedgerOfferFee,
+	LeadContacts: LedgerContactsFee,
+}
+
+//service 0 and region 0 price every category and every region
+type LeadPrice struct {
+	Id        int32     `json:"id"`
+	Action    string    `json:"action"`
+	ServiceId int32     `json:"service_id"`
+	RegionId  int16     `json:"region_id"`
+	Price     int32     `json:"price"`
+	Updated   time.Time `json:"updated"`
+}
+
+//the closest category up the cats tree wins, a price for the order's region beats one for every region
+const leadPriceLookup = `WITH RECURSIVE up AS (
+		SELECT id, parent_id, 0 AS depth FROM cats WHERE id = $1
+		UNION ALL
+		SELECT c.id, c.parent_id, up.depth + 1 FROM cats c JOIN up ON c.id = up.parent_id WHERE up.depth < 32
+	)
+	SELECT p.price FROM lead_prices p LEFT JOIN up ON up.id = p.service_id
+	WHERE p.action = $3 AND (p.service_id = 0 OR up.id IS NOT NULL) AND p.region_id IN (0, $2)
+	ORDER BY COALESCE(up.depth, 1000), p.region_id = 0 LIMIT 1`
+
+//without a configured price LEAD_PRICE_OFFER and LEAD_PRICE_CONTACTS apply, free by default
+func defaultLeadPrice(action string) int32 {
+	key := "LEAD_PRICE_OFFER"
+	if action == LeadContacts {
+		key = "LEAD_PRICE_CONTACTS"
+	}
+	if p, err := strconv.Atoi(os.Getenv(key)); err == nil && p > 0 {
+		return int32(p)
+	}
+	return 0
+}
+
+//a pool or a transaction
+type rowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+func leadPrice(ctx context.Context, q rowQuerier, action string, o *Order) (int32, error) {
+	var price int32
+	err := q.QueryRow(ctx, leadPriceLookup, o.ServiceId, o.RegionId, action).Scan(&price)
+	if err == pgx.ErrNoRows {
+		return defaultLeadPrice(action), nil
+	}
+	return price, err
+}
+
+//debits the master for an action on the order, ref keeps a retried call from charging twice
+//nothing is posted for a free action, the returned transaction id is 0 then
+func chargeLead(ctx context.Context, tx pgx.Tx, action string, o *Order, masterId int32, ref string) (int32, int64, error) {
+	price, err := leadPrice(ctx, tx, action, o)
+	if err != nil || price == 0 {
+		return 0, 0, err
+	}
+
+	t, err := postLedger(ctx, tx, LedgerTransaction{LoginId: masterId, Kind: leadFees[action], Amount: -price,
+		Reason: action + " on order " + strconv.Itoa(int(o.Id)), Ref: ref, ActorId: masterId})
+	if err != nil {
+		return 0, 0, err
+	}
+	return price, t.Id, nil
+}
+
+//the offer was charged for, it's paid back while the customer hasn't looked at it
+func chargeOffer(ctx context.Context, tx pgx.Tx, o *Order, offer *Offer) error {
+	ref := "offer:" + strconv.Itoa(int(offer.Id))
+	price, tid, err := chargeLead(ctx, tx, LeadOffer, o, offer.MasterId, ref)
+	if err != nil || price == 0 {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO offer_charges (offer_id, order_id, master_id, amount, transaction_id, created) VALUES ($1, $2, $3, $4, $5, $6)`,
+		offer.Id, o.Id, offer.MasterId, price, tid, time.Now())
+	return err
+}
+
+//the customer has seen these offers, their charges are final
+func markOffersViewed(ctx context.Context, q *pgxpool.Pool, customerId int32, ids []int32) error {
+	if customerId == 0 || len(ids) == 0 {
+		return nil
+	}
+	_, err := q.Exec(ctx, `UPDATE offer_charges c SET viewed = $1 FROM offers o
+		WHERE o.id = c.offer_id AND o.customer_id = $2 AND c.offer_id = ANY($3) AND c.viewed IS NULL`, time.Now(), customerId, ids)
+	return err
+}
+
+//pays back every charge on the order the customer never saw, called when the customer cancels it
+func refundUnseenOffers(ctx context.Context, tx pgx.Tx, orderId int32) error {
+	type charge struct {
+		OfferId  int32
+		MasterId int32
+		Amount   int32
+	}
+	var cs []*charge
+	err := pgxscan.Select(ctx, tx, &cs, `SELECT offer_id, master_id, amount FROM offer_charges
+		WHERE order_id = $1 AND viewed IS NULL AND refund_id IS NULL ORDER BY master_id FOR UPDATE`, orderId)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range cs {
+		id := strconv.Itoa(int(c.OfferId))
+		t, err := postLedger(ctx, tx, LedgerTransaction{LoginId: c.MasterId, Kind: LedgerRefund, Amount: c.Amount,
+			Reason: "order " + strconv.Itoa(int(orderId)) + " cancelled before the offer was seen", Ref: "offer:" + id})
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, `UPDATE offer_charges SET refund_id = $1 WHERE offer_id = $2`, t.Id, c.OfferId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//what the master would pay on this order, before offering or unlocking
+func QuoteLead(info string) (string, error) {
+	in := struct {
+		OrderId  int32 `json:"order_id"`
+		MasterId int32 `json:"master_id"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	var o Order
+	if err = pgxscan.Get(ctx, conn, &o, `SELECT * FROM orders WHERE id = $1`, in.OrderId); err != nil {
+		return "", err
+	}
+
+	q := struct {
+		OrderId  int32 `json:"order_id"`
+		Offer    int32 `json:"offer"`
+		Contacts int32 `json:"contacts"`
+		Unlocked bool  `json:"unlocked"`
+		Balance  int32 `json:"balance"`
+	}{OrderId: o.Id}
+	if q.Offer, err = leadPrice(ctx, conn, LeadOffer, &o); err != nil {
+		return "", err
+	}
+	if q.Contacts, err = leadPrice(ctx, conn, LeadContacts, &o); err != nil {
+		return "", err
+	}
+	err = conn.QueryRow(ctx, `SELECT balance, EXISTS (SELECT 1 FROM contact_unlocks WHERE order_id = $2 AND master_id = $1) FROM logins WHERE id = $1`,
+		in.MasterId, o.Id).Scan(&q.Balance, &q.Unlocked)
+	if err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(q)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+type CustomerContacts struct {
+	OrderId   int32  `json:"order_id"`
+	LoginId   int32  `json:"login_id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+	Phone     string `json:"phone"`
+	Price     int32  `json:"price"`
+}
+
+//the customer's contacts for a master, paid once per order, the assigned master sees them for free
+func UnlockContacts(info string) (string, error) {
+	in := struct {
+		OrderId  int32 `json:"order_id"`
+		MasterId int32 `json:"master_id"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	//contacts are for masters only, anyone else would read them for free
+	if in.MasterId == 0 {
+		return "", errors.New("master_id is required")
+	}
+	var level int16
+	if err = tx.QueryRow(ctx, `SELECT level FROM logins WHERE id = $1`, in.MasterId).Scan(&level); err != nil {
+		return "", err
+	}
+	if level != 2 {
+		return "", errors.New("only masters unlock contacts")
+	}
+
+	var o Order
+	if err = pgxscan.Get(ctx, tx, &o, `SELECT * FROM orders WHERE id = $1 FOR UPDATE`, in.OrderId); err != nil {
+		return "", err
+	}
+	if o.LoginId == in.MasterId {
+		err = errors.New("it's your own order")
+		return "", err
+	}
+
+	c := CustomerContacts{OrderId: o.Id, LoginId: o.LoginId}
+	var unlocked bool
+	err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM contact_unlocks WHERE order_id = $1 AND master_id = $2)`, o.Id, in.MasterId).Scan(&unlocked)
+	if err != nil {
+		return "", err
+	}
+
+	//the assigned master has them for free
+	assigned := o.MasterId != 0 && o.MasterId == in.MasterId
+	if !unlocked && !assigned {
+		if !orderIsOpen(o.Status) {
+			err = errors.New("order is " + o.Status + ", contacts are closed")
+			return "", err
+		}
+
+		ref := "contacts:" + strconv.Itoa(int(o.Id)) + ":" + strconv.Itoa(int(in.MasterId))
+		var tid int64
+		if c.Price, tid, err = chargeLead(ctx, tx, LeadContacts, &o, in.MasterId, ref); err != nil {
+			return "", err
+		}
+		_, err = tx.Exec(ctx, `INSERT INTO contact_unlocks (order_id, master_id, amount, transaction_id, created) VALUES ($1, $2, $3, $4, $5)`,
+			o.Id, in.MasterId, c.Price, tid, time.Now())
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = tx.QueryRow(ctx, `SELECT first_name, last_name, email, phone FROM logins WHERE id = $1`, o.LoginId).Scan(&c.FirstName, &c.LastName, &c.Email, &c.Phone)
+	if err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+//sets a price, price 0 makes the action free there, delete drops the row so a wider price applies again
+func SetLeadPrice(info string) (string, error) {
+	in := struct {
+		LeadPrice
+		AdminId int32 `json:"admin_id"`
+		Delete  bool  `json:"delete"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+	if _, ok := leadFees[in.Action]; !ok {
+		return "", errors.New("unknown action " + in.Action)
+	}
+	if in.Price < 0 {
+		return "", errors.New("price can't be negative")
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if err = checkLedgerAdmin(ctx, conn, in.AdminId); err != nil {
+		return "", err
+	}
+
+	p := in.LeadPrice
+	if in.Delete {
+		_, err = conn.Exec(ctx, `DELETE FROM lead_prices WHERE action = $1 AND service_id = $2 AND region_id = $3`, p.Action, p.ServiceId, p.RegionId)
+		if err != nil {
+			return "", err
+		}
+		return `{"deleted":true}`, nil
+	}
+
+	p.Updated = time.Now()
+	err = conn.QueryRow(ctx, `INSERT INTO lead_prices (action, service_id, region_id, price, updated) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (action, service_id, region_id) DO UPDATE SET price = EXCLUDED.price, updated = EXCLUDED.updated RETURNING id`,
+		p.Action, p.ServiceId, p.RegionId, p.Price, p.Updated).Scan(&p.Id)
+	if err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+func GetLeadPrices(info string) (string, error) {
+	in := struct {
+		Action    string `json:"action"`
+		ServiceId []int  `json:"service_id"`
+		RegionId  []int  `json:"region_id"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+
+	var w where
+	if in.Action != "" {
+		w.add(`action = ` + w.arg(in.Action))
+	}
+	w.in("service_id", in.ServiceId)
+	w.in("region_id", in.RegionId)
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	found := struct {
+		Prices   []*LeadPrice `json:"prices"`
+		Offer    int32        `json:"offer"`
+		Contacts int32        `json:"contacts"`
+	}{[]*LeadPrice{}, defaultLeadPrice(LeadOffer), defaultLeadPrice(LeadContacts)}
+	if err = pgxscan.Select(ctx, conn, &found.Prices, `SELECT * FROM lead_prices`+w.sql()+` ORDER BY action, service_id, region_id`, w.args...); err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(found)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
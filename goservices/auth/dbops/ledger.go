@@ -0,0 +1,374 @@
+package dbops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"go.mods/outbox"
+	"go.mods/paging"
+)
+
+//what moved the money
+const (
+	LedgerTopUp       = "topup"
+	LedgerOfferFee    = "offer_fee"
+	LedgerContactsFee = "contacts_fee"
+	LedgerRefund      = "refund"
+	LedgerAdjustment  = "adjustment"
+	//money sent back to the card, and put back if the provider refuses
+	LedgerPaymentRefund = "payment_refund"
+	//balances that existed before the ledger did
+	LedgerOpening = "opening"
+)
+
+//every transaction is two entries that sum to zero, the user's account and one of the platform's
+const (
+	AccountUser        = "user"
+	AccountCash        = "cash"
+	AccountRevenue     = "revenue"
+	AccountAdjustments = "adjustments"
+)
+
+var ledgerCounterparts = map[string]string{
+	LedgerTopUp:         AccountCash,
+	LedgerOfferFee:      AccountRevenue,
+	LedgerContactsFee:   AccountRevenue,
+	LedgerRefund:        AccountRevenue,
+	LedgerAdjustment:    AccountAdjustments,
+	LedgerPaymentRefund: AccountCash,
+	LedgerOpening:       AccountAdjustments,
+}
+
+//which way a kind moves the user's balance, 0 is either way
+var ledgerSigns = map[string]int{
+	LedgerTopUp:         1,
+	LedgerOfferFee:      -1,
+	LedgerContactsFee:   -1,
+	LedgerRefund:        1,
+	LedgerAdjustment:    0,
+	LedgerPaymentRefund: 0,
+	LedgerOpening:       0,
+}
+
+const TopicLedgerPosted = "ledger.posted"
+
+var ErrInsufficientBalance = errors.New("insufficient balance")
+
+//amount is signed from the user's side, ref makes a posting idempotent within its kind
+type LedgerTransaction struct {
+	Id      int64          `json:"id"`
+	LoginId int32          `json:"login_id"`
+	Kind    string         `json:"kind"`
+	Amount  int32          `json:"amount"`
+	Reason  string         `json:"reason"`
+	Ref     string         `json:"ref"`
+	ActorId int32          `json:"actor_id"`
+	Created time.Time      `json:"created"`
+	Entries []*LedgerEntry `json:"entries" db:"-"`
+}
+
+//balance_after is kept for user accounts only, platform accounts would be one hot row
+type LedgerEntry struct {
+	Id            int64  `json:"id"`
+	TransactionId int64  `json:"transaction_id"`
+	Kind          string `json:"kind"`
+	Account       string `json:"account"`
+	LoginId       int32  `json:"login_id"`
+	Amount        int32  `json:"amount"`
+	BalanceAfter  *int32 `json:"balance_after"`
+}
+
+//the platform account on the other side, once the amount goes the way the kind allows
+func checkLedgerAmount(kind string, amount int32) (string, error) {
+	counterpart, ok := ledgerCounterparts[kind]
+	if !ok {
+		return "", errors.New("unknown ledger kind " + kind)
+	}
+	if amount == 0 {
+		return "", errors.New("amount can't be 0")
+	}
+	if sign := ledgerSigns[kind]; (sign > 0 && amount < 0) || (sign < 0 && amount > 0) {
+		return "", errors.New(kind + " can't move the balance that way")
+	}
+	return counterpart, nil
+}
+
+//only opening balances may leave a user below zero
+func balanceAfter(balance int32, kind string, amount int32) (int32, error) {
+	after := int64(balance) + int64(amount)
+	if after < 0 && kind != LedgerOpening {
+		return 0, ErrInsufficientBalance
+	}
+	if after > math.MaxInt32 {
+		return 0, errors.New("balance would overflow")
+	}
+	return int32(after), nil
+}
+
+//posts a transaction and moves logins.balance with it, the caller commits
+//the logins row lock serializes postings per user, so the balance check can't race
+//a ref already posted returns the earlier transaction instead of charging twice
+func postLedger(ctx context.Context, tx pgx.Tx, t LedgerTransaction) (LedgerTransaction, error) {
+	counterpart, err := checkLedgerAmount(t.Kind, t.Amount)
+	if err != nil {
+		return t, err
+	}
+	t.Reason = strings.TrimSpace(t.Reason)
+
+	var balance int32
+	if err := tx.QueryRow(ctx, `SELECT balance FROM logins WHERE id = $1 FOR UPDATE`, t.LoginId).Scan(&balance); err != nil {
+		return t, err
+	}
+
+	if t.Ref != "" {
+		var done []*LedgerTransaction
+		if err := pgxscan.Select(ctx, tx, &done, `SELECT * FROM ledger_transactions WHERE kind = $1 AND ref = $2`, t.Kind, t.Ref); err != nil {
+			return t, err
+		}
+		if len(done) > 0 {
+			return *done[0], nil
+		}
+	}
+
+	b, err := balanceAfter(balance, t.Kind, t.Amount)
+	if err != nil {
+		return t, err
+	}
+
+	t.Created = time.Now()
+	err = tx.QueryRow(ctx, `INSERT INTO ledger_transactions (login_id, kind, amount, reason, ref, actor_id, created) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+		t.LoginId, t.Kind, t.Amount, t.Reason, t.Ref, t.ActorId, t.Created).Scan(&t.Id)
+	if err != nil {
+		return t, err
+	}
+
+	t.Entries = []*LedgerEntry{
+		{TransactionId: t.Id, Kind: t.Kind, Account: AccountUser, LoginId: t.LoginId, Amount: t.Amount, BalanceAfter: &b},
+		{TransactionId: t.Id, Kind: t.Kind, Account: counterpart, Amount: -t.Amount},
+	}
+	for _, e := range t.Entries {
+		err = tx.QueryRow(ctx, `INSERT INTO ledger_entries (transaction_id, kind, account, login_id, amount, balance_after) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+			e.TransactionId, e.Kind, e.Account, e.LoginId, e.Amount, e.BalanceAfter).Scan(&e.Id)
+		if err != nil {
+			return t, err
+		}
+	}
+
+	if _, err = tx.Exec(ctx, `UPDATE logins SET balance = $1 WHERE id = $2`, b, t.LoginId); err != nil {
+		return t, err
+	}
+
+	if err = outbox.Write(ctx, tx, TopicLedgerPosted, outboxKey(t.LoginId), t); err != nil {
+		return t, err
+	}
+
+	return t, nil
+}
+
+//logins at this level and above adjust balances, LEDGER_ADMIN_LEVEL, moderators by default
+func ledgerAdminLevel() int16 {
+	if l, err := strconv.Atoi(os.Getenv("LEDGER_ADMIN_LEVEL")); err == nil && l > 0 {
+		return int16(l)
+	}
+	return moderatorLevel()
+}
+
+func checkLedgerAdmin(ctx context.Context, conn *pgxpool.Pool, id int32) error {
+	var level int16
+	if err := conn.QueryRow(ctx, `SELECT level FROM logins WHERE id = $1`, id).Scan(&level); err != nil {
+		return err
+	}
+	if level < ledgerAdminLevel() {
+		return errors.New("not allowed to adjust balances")
+	}
+	return nil
+}
+
+//a manual correction, always signed by the admin with a reason
+func AdjustBalance(info string) (string, error) {
+	in := struct {
+		AdminId int32  `json:"admin_id"`
+		LoginId int32  `json:"login_id"`
+		Amount  int32  `json:"amount"`
+		Reason  string `json:"reason"`
+		Ref     string `json:"ref"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(in.Reason) == "" {
+		return "", errors.New("adjustments need a reason")
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if err = checkLedgerAdmin(ctx, conn, in.AdminId); err != nil {
+		return "", err
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	t, err := postLedger(ctx, tx, LedgerTransaction{LoginId: in.LoginId, Kind: LedgerAdjustment, Amount: in.Amount, Reason: in.Reason, Ref: in.Ref, ActorId: in.AdminId})
+	if err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+//the stored balance next to the one the ledger adds up to, they only differ if something wrote around the ledger
+func GetBalance(info string) (string, error) {
+	in := struct {
+		LoginId int32 `json:"login_id"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	b := struct {
+		LoginId    int32 `json:"login_id"`
+		Balance    int32 `json:"balance"`
+		Ledger     int64 `json:"ledger"`
+		Consistent bool  `json:"consistent"`
+	}{LoginId: in.LoginId}
+	err = conn.QueryRow(ctx, `SELECT balance, (SELECT COALESCE(SUM(amount), 0) FROM ledger_entries WHERE account = $2 AND login_id = $1) FROM logins WHERE id = $1`,
+		in.LoginId, AccountUser).Scan(&b.Balance, &b.Ledger)
+	if err != nil {
+		return "", err
+	}
+	b.Consistent = int64(b.Balance) == b.Ledger
+
+	jm, err := json.Marshal(b)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+//one line of a statement, balance is what the user had right after it
+type StatementLine struct {
+	Id      int64     `json:"id"`
+	Kind    string    `json:"kind"`
+	Amount  int32     `json:"amount"`
+	Balance int32     `json:"balance"`
+	Reason  string    `json:"reason"`
+	Ref     string    `json:"ref"`
+	ActorId int32     `json:"actor_id"`
+	Created time.Time `json:"created"`
+}
+
+var statementSorts = map[string]paging.Key{
+	"id": {Column: "id", Desc: true},
+}
+
+const statementLines = `SELECT t.id, t.kind, t.amount, e.balance_after AS balance, t.reason, t.ref, t.actor_id, t.created
+	FROM ledger_transactions t JOIN ledger_entries e ON e.transaction_id = t.id AND e.account = 'user'`
+
+//a user's transactions between from and to, newest first, with the balances the period opened and closed at
+func GetStatement(info string) (string, error) {
+	in := struct {
+		paging.Request
+		LoginId int32      `json:"login_id"`
+		From    *time.Time `json:"from"`
+		To      *time.Time `json:"to"`
+		Kinds   []string   `json:"kinds"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+	if in.From == nil {
+		from := time.Time{}
+		in.From = &from
+	}
+	if in.To == nil {
+		to := time.Now()
+		in.To = &to
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	found := struct {
+		paging.Page
+		LoginId int32            `json:"login_id"`
+		From    time.Time        `json:"from"`
+		To      time.Time        `json:"to"`
+		Opening int32            `json:"opening"`
+		Closing int32            `json:"closing"`
+		Lines   []*StatementLine `json:"lines"`
+	}{LoginId: in.LoginId, From: *in.From, To: *in.To, Lines: []*StatementLine{}}
+
+	balanceAt := `SELECT COALESCE((SELECT e.balance_after FROM ledger_entries e JOIN ledger_transactions t ON t.id = e.transaction_id
+		WHERE e.account = 'user' AND e.login_id = $1 AND t.created < $2 ORDER BY t.id DESC LIMIT 1), 0)`
+	if err = conn.QueryRow(ctx, balanceAt, in.LoginId, in.From).Scan(&found.Opening); err != nil {
+		return "", err
+	}
+	if err = conn.QueryRow(ctx, balanceAt, in.LoginId, in.To).Scan(&found.Closing); err != nil {
+		return "", err
+	}
+
+	var w where
+	w.add(`t.login_id = ` + w.arg(in.LoginId))
+	w.add(`t.created >= ` + w.arg(*in.From))
+	w.add(`t.created < ` + w.arg(*in.To))
+	if len(in.Kinds) > 0 {
+		w.add(`t.kind = ANY(` + w.arg(in.Kinds) + `)`)
+	}
+	sort := "id"
+	order, err := w.page(in.Request, statementSorts, &sort, "id")
+	if err != nil {
+		return "", err
+	}
+
+	if err = pgxscan.Select(ctx, conn, &found.Lines, `SELECT * FROM (`+statementLines+`) t`+w.sql()+order, w.args...); err != nil {
+		return "", err
+	}
+	found.Page = in.Finish(&found.Lines, sort, func(i int) (string, int64) { return "", found.Lines[i].Id })
+
+	jm, err := json.Marshal(found)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
@@ -0,0 +1,78 @@
+package dbops
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLedgerKinds(t *testing.T) {
+	for kind := range ledgerCounterparts {
+		if _, ok := ledgerSigns[kind]; !ok {
+			t.Errorf("%s has no sign", kind)
+		}
+		if ledgerCounterparts[kind] == AccountUser {
+			t.Errorf("%s posts against the user account twice", kind)
+		}
+	}
+	for kind := range ledgerSigns {
+		if _, ok := ledgerCounterparts[kind]; !ok {
+			t.Errorf("%s has no counterpart", kind)
+		}
+	}
+}
+
+func TestCheckLedgerAmount(t *testing.T) {
+	cases := []struct {
+		kind        string
+		amount      int32
+		counterpart string
+		ok          bool
+	}{
+		{LedgerTopUp, 500, AccountCash, true},
+		{LedgerTopUp, -500, "", false},
+		{LedgerOfferFee, -50, AccountRevenue, true},
+		{LedgerOfferFee, 50, "", false},
+		{LedgerContactsFee, -100, AccountRevenue, true},
+		{LedgerRefund, 50, AccountRevenue, true},
+		{LedgerRefund, -50, "", false},
+		{LedgerAdjustment, -10, AccountAdjustments, true},
+		{LedgerAdjustment, 10, AccountAdjustments, true},
+		{LedgerPaymentRefund, -300, AccountCash, true},
+		{LedgerPaymentRefund, 300, AccountCash, true},
+		{LedgerOpening, 1000, AccountAdjustments, true},
+		{LedgerTopUp, 0, "", false},
+		{"bonus", 10, "", false},
+	}
+	for _, c := range cases {
+		counterpart, err := checkLedgerAmount(c.kind, c.amount)
+		if (err == nil) != c.ok || counterpart != c.counterpart {
+			t.Errorf("checkLedgerAmount(%s, %d) = %q, %v", c.kind, c.amount, counterpart, err)
+		}
+	}
+}
+
+func TestBalanceAfter(t *testing.T) {
+	cases := []struct {
+		balance int32
+		kind    string
+		amount  int32
+		want    int32
+		err     error
+	}{
+		{100, LedgerOfferFee, -50, 50, nil},
+		{50, LedgerOfferFee, -50, 0, nil},
+		{49, LedgerOfferFee, -50, 0, ErrInsufficientBalance},
+		{0, LedgerAdjustment, -1, 0, ErrInsufficientBalance},
+		{0, LedgerOpening, -200, -200, nil},
+		{0, LedgerTopUp, 100, 100, nil},
+	}
+	for _, c := range cases {
+		got, err := balanceAfter(c.balance, c.kind, c.amount)
+		if got != c.want || err != c.err {
+			t.Errorf("balanceAfter(%d, %s, %d) = %d, %v", c.balance, c.kind, c.amount, got, err)
+		}
+	}
+	if _, err := balanceAfter(math.MaxInt32, LedgerTopUp, 1); err == nil {
+		t.Error("balance overflowed")
+	}
+}
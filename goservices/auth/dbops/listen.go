@@ -0,0 +1,221 @@
+package dbops
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+//emitEvent notifies here, the payload only says whom to wake, the events table stays the source of truth
+const eventsChannel = "events"
+
+//events sent to a subscriber per query
+const eventsBatch = 100
+
+//a missed notify costs at most this much delay
+const eventsPoll = 30 * time.Second
+
+//one LISTEN connection per process, subscribers of a login get woken through it
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[int32]map[chan struct{}]bool
+}
+
+var hub = &eventHub{subs: map[int32]map[chan struct{}]bool{}}
+
+func (h *eventHub) add(loginId int32) chan struct{} {
+	ch := make(chan struct{}, 1)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[loginId] == nil {
+		h.subs[loginId] = map[chan struct{}]bool{}
+	}
+	h.subs[loginId][ch] = true
+	return ch
+}
+
+func (h *eventHub) remove(loginId int32, ch chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs[loginId], ch)
+	if len(h.subs[loginId]) == 0 {
+		delete(h.subs, loginId)
+	}
+}
+
+//never blocks, a pending wakeup already covers the new event
+func (h *eventHub) wake(loginId int32) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[loginId] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+//after a reconnect nobody knows what was missed
+func (h *eventHub) wakeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, chs := range h.subs {
+		for ch := range chs {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (h *eventHub) listen(ctx context.Context) error {
+	conn, err := pgx.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	if _, err = conn.Exec(ctx, `LISTEN `+eventsChannel); err != nil {
+		return err
+	}
+	h.wakeAll()
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var e struct {
+			LoginId int32 `json:"login_id"`
+		}
+		if err = json.Unmarshal([]byte(n.Payload), &e); err != nil {
+			log.Println("bad events notification: ", err)
+			continue
+		}
+		h.wake(e.LoginId)
+	}
+}
+
+//keeps the LISTEN connection up for the life of the process
+func StartEventListener() {
+	go func() {
+		for {
+			if err := hub.listen(context.Background()); err != nil {
+				log.Println("events listener failed: ", err)
+			}
+			time.Sleep(time.Second)
+		}
+	}()
+}
+
+//every Subscribe stream reads through this one pool, idle streams hold no connection
+//EVENTS_POOL_SIZE caps the connections, 4 by default
+var streams struct {
+	sync.Mutex
+	pool *pgxpool.Pool
+}
+
+func streamPool(ctx context.Context) (*pgxpool.Pool, error) {
+	streams.Lock()
+	defer streams.Unlock()
+	if streams.pool != nil {
+		return streams.pool, nil
+	}
+
+	conf, err := pgxpool.ParseConfig(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return nil, err
+	}
+	conf.MaxConns = 4
+	if n, err := strconv.Atoi(os.Getenv("EVENTS_POOL_SIZE")); err == nil && n > 0 {
+		conf.MaxConns = int32(n)
+	}
+
+	pool, err := pgxpool.ConnectConfig(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+	streams.pool = pool
+	return pool, nil
+}
+
+//events of one login after a known one, for a Subscribe stream
+//ids are taken before commit, so a later id can become visible before an earlier one
+//the stream goes by (txid, id) instead and only reads transactions older than every running one, those can't change any more
+type EventStream struct {
+	conn     *pgxpool.Pool
+	loginId  int32
+	last     int64
+	lastTxid int64
+	kinds    []string
+	wake     chan struct{}
+}
+
+//last is the id of the last event the client has seen, 0 replays everything kept
+func OpenEventStream(ctx context.Context, loginId int32, last int64, kinds []string) (*EventStream, error) {
+	conn, err := streamPool(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &EventStream{conn: conn, loginId: loginId, last: last, kinds: kinds}
+	if last > 0 {
+		//a client from before txid was kept, or one with an id that's gone, resumes by id alone
+		err = conn.QueryRow(ctx, `SELECT txid FROM events WHERE id = $1 AND login_id = $2`, last, loginId).Scan(&s.lastTxid)
+		if err != nil && err != pgx.ErrNoRows {
+			return nil, err
+		}
+	}
+
+	s.wake = hub.add(loginId)
+	return s, nil
+}
+
+func (s *EventStream) Close() {
+	hub.remove(s.loginId, s.wake)
+}
+
+//blocks until there is something after the last event returned or ctx is done
+func (s *EventStream) Next(ctx context.Context) ([]*Event, error) {
+	for {
+		w := &where{}
+		w.add("login_id = " + w.arg(s.loginId))
+		w.add("txid < txid_snapshot_xmin(txid_current_snapshot())")
+		if s.lastTxid > 0 {
+			w.add("(txid, id) > (" + w.arg(s.lastTxid) + ", " + w.arg(s.last) + ")")
+		} else {
+			w.add("id > " + w.arg(s.last))
+		}
+		if len(s.kinds) > 0 {
+			w.add("kind = ANY(" + w.arg(s.kinds) + ")")
+		}
+
+		var es []*Event
+		err := pgxscan.Select(ctx, s.conn, &es, `SELECT * FROM events`+w.sql()+` ORDER BY txid, id LIMIT `+strconv.Itoa(eventsBatch), w.args...)
+		if err != nil {
+			return nil, err
+		}
+		if len(es) > 0 {
+			s.last, s.lastTxid = es[len(es)-1].Id, es[len(es)-1].Txid
+			return es, nil
+		}
+
+		select {
+		case <-s.wake:
+		case <-time.After(eventsPoll):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package dbops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"go.mods/paging"
+)
+
+//how much each factor counts, every factor scores from 0 to 1 before weighting
+type MatchWeights struct {
+	Skill     float64 `json:"skill"`
+	Territory float64 `json:"territory"`
+	Price     float64 `json:"price"`
+	Rating    float64 `json:"rating"`
+	Activity  float64 `json:"activity"`
+}
+
+//MATCH_WEIGHT_* override the defaults, a request can override them again
+func matchWeights() MatchWeights {
+	w := MatchWeights{Skill: 40, Territory: 25, Price: 15, Rating: 10, Activity: 10}
+	for key, p := range map[string]*float64{
+		"MATCH_WEIGHT_SKILL":     &w.Skill,
+		"MATCH_WEIGHT_TERRITORY": &w.Territory,
+		"MATCH_WEIGHT_PRICE":     &w.Price,
+		"MATCH_WEIGHT_RATING":    &w.Rating,
+		"MATCH_WEIGHT_ACTIVITY":  &w.Activity,
+	} {
+		if v, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil && v >= 0 {
+			*p = v
+		}
+	}
+	return w
+}
+
+//days of silence that halve the activity factor
+func activityHalfLife() float64 {
+	if v, err := strconv.ParseFloat(os.Getenv("MATCH_ACTIVITY_HALFLIFE_DAYS"), 64); err == nil && v > 0 {
+		return v
+	}
+	return 7
+}
+
+//ranking scores are on a five point scale
+const ratingScale = 5
+
+type MatchFactor struct {
+	Value  float64 `json:"value"`
+	Weight float64 `json:"weight"`
+	Points float64 `json:"points"`
+	Reason string  `json:"reason"`
+}
+
+type MasterMatch struct {
+	Master  *User                  `json:"master"`
+	Score   float64                `json:"score"`
+	Factors map[string]MatchFactor `json:"factors"`
+}
+
+//what a master offers for the order's service, depth 0 is the service itself, 1 its parent and so on
+type skillMatch struct {
+	LoginId   int32
+	ServiceId int32
+	Price     int32
+	Depth     int32
+}
+
+//masters with a choice on the service, or on an ancestor of it that covers subcategories
+const matchCandidates = `WITH RECURSIVE up AS (
+		SELECT id, parent_id, 0 AS depth FROM cats WHERE id = $1
+		UNION ALL SELECT c.id, c.parent_id, up.depth + 1 FROM cats c JOIN up ON c.id = up.parent_id WHERE up.depth < 16
+	)
+	SELECT DISTINCT ON (ch.login_id) ch.login_id, ch.service_id, ch.price, up.depth
+	FROM choices ch
+	JOIN up ON up.id = ch.service_id
+	JOIN logins l ON l.id = ch.login_id AND l.level = 2
+	WHERE (up.depth = 0 OR ch.parent) AND ch.login_id != $2
+	ORDER BY ch.login_id, up.depth, ch.price`
+
+//tells every master who can take the order that it's out, held orders wait for the moderator
+//publishing the same order again announces it again, notifications dedup it per master
+func announceOrder(ctx context.Context, tx pgx.Tx, o Order) error {
+	if o.Status != OrderPublished {
+		return nil
+	}
+
+	var visible bool
+	if err := tx.QueryRow(ctx, `SELECT `+visibleSql(ContentOrder, "$1::int"), o.Id).Scan(&visible); err != nil {
+		return err
+	}
+	if !visible {
+		return nil
+	}
+
+	var skills []*skillMatch
+	if err := pgxscan.Select(ctx, tx, &skills, matchCandidates, o.ServiceId, o.LoginId); err != nil {
+		return err
+	}
+
+	for _, s := range skills {
+		if err := emitEvent(ctx, tx, Event{Kind: EventMatchingOrder, LoginId: s.LoginId, OrderId: o.Id, Payload: payload(o)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func factor(value float64, weight float64, reason string) MatchFactor {
+	return MatchFactor{Value: round2(value), Weight: weight, Points: round2(value * weight), Reason: reason}
+}
+
+func round2(f float64) float64 {
+	return math.Round(f*100) / 100
+}
+
+func skillFactor(s skillMatch, weight float64) MatchFactor {
+	if s.Depth == 0 {
+		return factor(1, weight, "offers this service")
+	}
+	return factor(1/float64(s.Depth+1), weight, "offers a parent category "+strconv.Itoa(int(s.Depth))+" level(s) up")
+}
+
+func territoryFactor(o Order, ts []*Territory, weight float64) MatchFactor {
+	if o.TownId == 0 && o.RegionId == 0 {
+		return factor(0.5, weight, "order has no location")
+	}
+
+	best := factor(0, weight, "does not work in the order's region")
+	for _, t := range ts {
+		switch {
+		case o.TownId != 0 && t.TownId == o.TownId:
+			return factor(1, weight, "works in the order's town")
+		case t.RegionId == o.RegionId && t.TownId == 0 && best.Value < 0.8:
+			best = factor(0.8, weight, "works across the order's region")
+		case t.RegionId == o.RegionId && best.Value < 0.4:
+			best = factor(0.4, weight, "works in another town of the order's region")
+		}
+	}
+	return best
+}
+
+func priceFactor(o Order, s skillMatch, weight float64) MatchFactor {
+	if o.Budget <= 0 || s.Price <= 0 {
+		return factor(0.5, weight, "no budget or no price to compare")
+	}
+	if s.Price <= o.Budget {
+		return factor(1, weight, "price "+strconv.Itoa(int(s.Price))+" fits the budget "+strconv.Itoa(int(o.Budget)))
+	}
+	return factor(float64(o.Budget)/float64(s.Price), weight, "price "+strconv.Itoa(int(s.Price))+" is over the budget "+strconv.Itoa(int(o.Budget)))
+}
+
+//the same ranking score get-masters sorts by
+func ratingFactor(u *User, weight float64) MatchFactor {
+	r := math.Min(math.Max(u.Score, 0), ratingScale)
+	return factor(r/ratingScale, weight, "score "+strconv.FormatFloat(round2(u.Score), 'f', -1, 64)+" of "+strconv.Itoa(ratingScale))
+}
+
+//request weights go over the env ones, missing ones keep their env value
+func mergeWeights(w MatchWeights, raw json.RawMessage) (MatchWeights, error) {
+	if len(raw) > 0 && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &w); err != nil {
+			return w, err
+		}
+	}
+	for _, v := range []float64{w.Skill, w.Territory, w.Price, w.Rating, w.Activity} {
+		if v < 0 {
+			return w, errors.New("weights must not be negative")
+		}
+	}
+	if w.Skill+w.Territory+w.Price+w.Rating+w.Activity == 0 {
+		return w, errors.New("at least one weight must be above 0")
+	}
+	return w, nil
+}
+
+func activityFactor(u *User, now time.Time, weight float64) MatchFactor {
+	if u.LastOnline.IsZero() {
+		return factor(0, weight, "never online")
+	}
+	days := now.Sub(u.LastOnline).Hours() / 24
+	if days < 0 {
+		days = 0
+	}
+	return factor(math.Pow(0.5, days/activityHalfLife()), weight, "last online "+strconv.Itoa(int(days))+" day(s) ago")
+}
+
+//ranks masters for an order, every score comes with the factors it was made of
+func MatchMasters(info string) (string, error) {
+	in := struct {
+		OrderId int32           `json:"order_id"`
+		Limit   int             `json:"limit"`
+		Weights json.RawMessage `json:"weights"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+	if in.OrderId == 0 {
+		return "", errors.New("order_id is required")
+	}
+	if in.Limit < 1 || in.Limit > paging.MaxLimit {
+		in.Limit = paging.DefaultLimit
+	}
+
+	weights, err := mergeWeights(matchWeights(), in.Weights)
+	if err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	var o Order
+	if err = pgxscan.Get(ctx, conn, &o, `SELECT * FROM orders WHERE id = $1`, in.OrderId); err != nil {
+		return "", err
+	}
+
+	var skills []*skillMatch
+	if err = pgxscan.Select(ctx, conn, &skills, matchCandidates, o.ServiceId, o.LoginId); err != nil {
+		return "", err
+	}
+
+	found := struct {
+		OrderId int32          `json:"order_id"`
+		Weights MatchWeights   `json:"weights"`
+		Masters []*MasterMatch `json:"masters"`
+	}{o.Id, weights, []*MasterMatch{}}
+
+	if len(skills) > 0 {
+		var ids []int
+		for _, s := range skills {
+			ids = append(ids, int(s.LoginId))
+		}
+
+		var masters []*User
+		if err = pgxscan.Select(ctx, conn, &masters, `SELECT `+masterSummary+`, score FROM (`+mastersScored+`) m WHERE id = ANY($1)`, ids); err != nil {
+			return "", err
+		}
+		byId := map[int32]*User{}
+		for _, u := range masters {
+			byId[u.Id] = u
+		}
+
+		var territories []*Territory
+		if err = pgxscan.Select(ctx, conn, &territories, `SELECT * FROM territories WHERE login_id = ANY($1) AND region_id = $2`, ids, o.RegionId); err != nil {
+			return "", err
+		}
+		served := map[int32][]*Territory{}
+		for _, t := range territories {
+			served[t.LoginId] = append(served[t.LoginId], t)
+		}
+
+		now := time.Now()
+		for _, s := range skills {
+			u, ok := byId[s.LoginId]
+			if !ok {
+				continue
+			}
+
+			m := &MasterMatch{Master: u, Factors: map[string]MatchFactor{
+				"skill":     skillFactor(*s, weights.Skill),
+				"territory": territoryFactor(o, served[s.LoginId], weights.Territory),
+				"price":     priceFactor(o, *s, weights.Price),
+				"rating":    ratingFactor(u, weights.Rating),
+				"activity":  activityFactor(u, now, weights.Activity),
+			}}
+			for _, f := range m.Factors {
+				m.Score += f.Points
+			}
+			m.Score = round2(m.Score)
+			found.Masters = append(found.Masters, m)
+		}
+	}
+
+	sort.Slice(found.Masters, func(i, j int) bool {
+		if found.Masters[i].Score != found.Masters[j].Score {
+			return found.Masters[i].Score > found.Masters[j].Score
+		}
+		return found.Masters[i].Master.Id < found.Masters[j].Master.Id
+	})
+	if len(found.Masters) > in.Limit {
+		found.Masters = found.Masters[:in.Limit]
+	}
+
+	jm, err := json.Marshal(found)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
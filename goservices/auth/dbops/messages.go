@@ -0,0 +1,496 @@
+package dbops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"go.mods/paging"
+)
+
+//one conversation per offer, between the order's customer and the offering master
+type Thread struct {
+	Id          int32     `json:"id"`
+	OrderId     int32     `json:"order_id"`
+	OfferId     int32     `json:"offer_id"`
+	CustomerId  int32     `json:"customer_id"`
+	MasterId    int32     `json:"master_id"`
+	Created     time.Time `json:"created"`
+	LastMessage time.Time `json:"last_message"`
+}
+
+type Message struct {
+	Id          int32           `json:"id"`
+	ThreadId    int32           `json:"thread_id"`
+	SenderId    int32           `json:"sender_id"`
+	Text        string          `json:"text"`
+	Attachments json.RawMessage `json:"attachments"`
+	Created     time.Time       `json:"created"`
+}
+
+//files are uploaded beforehand to UPLOADS_DIR/messages/{thread_id}/, images get their size recorded
+type Attachment struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Width  int32  `json:"width,omitempty"`
+	Height int32  `json:"height,omitempty"`
+}
+
+func threadDir(threadId int32) string {
+	return os.Getenv("UPLOADS_DIR") + "messages/" + strconv.Itoa(int(threadId)) + "/"
+}
+
+func attachment(threadId int32, name string) (Attachment, error) {
+	a := Attachment{Name: name}
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return a, errors.New("bad attachment name " + name)
+	}
+
+	f, err := os.Open(threadDir(threadId) + name)
+	if err != nil {
+		return a, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return a, err
+	}
+	a.Size = st.Size()
+
+	//not every attachment is an image
+	if conf, _, err := image.DecodeConfig(f); err == nil {
+		a.Width, a.Height = int32(conf.Width), int32(conf.Height)
+	}
+
+	return a, nil
+}
+
+var (
+	emailPattern = regexp.MustCompile(`[\p{L}0-9._%+-]+@[\p{L}0-9.-]+\.[\p{L}]{2,}`)
+	phonePattern = regexp.MustCompile(`\+?[0-9][0-9\s\-().]{5,}[0-9]`)
+)
+
+const masked = "***"
+
+//contacts stay hidden until the offer is accepted so the deal doesn't leave the site
+func maskContacts(text string) string {
+	text = emailPattern.ReplaceAllString(text, masked)
+	return phonePattern.ReplaceAllStringFunc(text, func(s string) string {
+		digits := 0
+		for _, r := range s {
+			if r >= '0' && r <= '9' {
+				digits++
+			}
+		}
+		//prices and dates are shorter than phone numbers
+		if digits < 7 {
+			return s
+		}
+		return masked
+	})
+}
+
+func maskMessages(ms []*Message) {
+	for _, m := range ms {
+		m.Text = maskContacts(m.Text)
+	}
+}
+
+//the thread of an offer, made on first use, locked for the caller's transaction
+func offerThread(ctx context.Context, tx pgx.Tx, offerId int32) (Thread, Offer, error) {
+	var t Thread
+	var o Offer
+	if err := pgxscan.Get(ctx, tx, &o, `SELECT * FROM offers WHERE id = $1`, offerId); err != nil {
+		return t, o, err
+	}
+
+	now := time.Now()
+	_, err := tx.Exec(ctx, `INSERT INTO threads (order_id, offer_id, customer_id, master_id, created, last_message) VALUES ($1, $2, $3, $4, $5, $5)
+		ON CONFLICT (offer_id) DO NOTHING`, o.OrderId, o.Id, o.CustomerId, o.MasterId, now)
+	if err != nil {
+		return t, o, err
+	}
+
+	err = pgxscan.Get(ctx, tx, &t, `SELECT * FROM threads WHERE offer_id = $1 FOR UPDATE`, offerId)
+	return t, o, err
+}
+
+func (t Thread) other(loginId int32) int32 {
+	if loginId == t.CustomerId {
+		return t.MasterId
+	}
+	return t.CustomerId
+}
+
+func (t Thread) member(loginId int32) bool {
+	return loginId != 0 && (loginId == t.CustomerId || loginId == t.MasterId)
+}
+
+func SendMessage(info string) (string, error) {
+	in := struct {
+		OfferId     int32    `json:"offer_id"`
+		SenderId    int32    `json:"sender_id"`
+		Text        string   `json:"text"`
+		Attachments []string `json:"attachments"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+	in.Text = strings.TrimSpace(in.Text)
+	if in.Text == "" && len(in.Attachments) == 0 {
+		return "", errors.New("message is empty")
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	t, o, err := offerThread(ctx, tx, in.OfferId)
+	if err != nil {
+		return "", err
+	}
+	if !t.member(in.SenderId) {
+		err = errors.New("not your conversation")
+		return "", err
+	}
+	if o.Accept == OfferDeclined || o.Accept == OfferWithdrawn {
+		err = errors.New("offer is closed")
+		return "", err
+	}
+
+	files := []Attachment{}
+	for _, name := range in.Attachments {
+		a, err := attachment(t.Id, name)
+		if err != nil {
+			return "", err
+		}
+		files = append(files, a)
+	}
+
+	m := Message{ThreadId: t.Id, SenderId: in.SenderId, Text: in.Text, Attachments: payload(files), Created: time.Now()}
+	row := tx.QueryRow(ctx, `INSERT INTO messages (thread_id, sender_id, text, attachments, created) VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		m.ThreadId, m.SenderId, m.Text, m.Attachments, m.Created)
+	if err = row.Scan(&m.Id); err != nil {
+		return "", err
+	}
+
+	if _, err = tx.Exec(ctx, `UPDATE threads SET last_message = $1 WHERE id = $2`, m.Created, t.Id); err != nil {
+		return "", err
+	}
+
+	//what you wrote you've read
+	if err = markRead(ctx, tx, t.Id, in.SenderId, m.Id); err != nil {
+		return "", err
+	}
+
+	shown := m
+	if o.Accept != OfferAccepted {
+		shown.Text = maskContacts(m.Text)
+	}
+	err = emitEvent(ctx, tx, Event{Kind: EventNewMessage, LoginId: t.other(in.SenderId), OrderId: t.OrderId, OfferId: t.OfferId, Payload: payload(shown)})
+	if err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(shown)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+//read receipts only move forward
+func markRead(ctx context.Context, tx pgx.Tx, threadId int32, loginId int32, messageId int32) error {
+	_, err := tx.Exec(ctx, `INSERT INTO thread_reads (thread_id, login_id, last_read_id, read_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (thread_id, login_id) DO UPDATE SET last_read_id = GREATEST(thread_reads.last_read_id, EXCLUDED.last_read_id), read_at = EXCLUDED.read_at`,
+		threadId, loginId, messageId, time.Now())
+	return err
+}
+
+func lastRead(ctx context.Context, q pgxscan.Querier, threadId int32, loginId int32) (int32, error) {
+	var ids []int32
+	if err := pgxscan.Select(ctx, q, &ids, `SELECT last_read_id FROM thread_reads WHERE thread_id = $1 AND login_id = $2`, threadId, loginId); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	return ids[0], nil
+}
+
+//marks the thread read up to message_id, or to the end when it's 0, and tells the other side
+func MarkRead(info string) (string, error) {
+	in := struct {
+		ThreadId  int32 `json:"thread_id"`
+		LoginId   int32 `json:"login_id"`
+		MessageId int32 `json:"message_id"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var t Thread
+	if err = pgxscan.Get(ctx, tx, &t, `SELECT * FROM threads WHERE id = $1`, in.ThreadId); err != nil {
+		return "", err
+	}
+	if !t.member(in.LoginId) {
+		err = errors.New("not your conversation")
+		return "", err
+	}
+
+	if in.MessageId == 0 {
+		if err = tx.QueryRow(ctx, `SELECT COALESCE(MAX(id), 0) FROM messages WHERE thread_id = $1`, t.Id).Scan(&in.MessageId); err != nil {
+			return "", err
+		}
+	} else {
+		//an id from elsewhere would mark messages that don't exist yet as read
+		var n int
+		if err = tx.QueryRow(ctx, `SELECT COUNT(*) FROM messages WHERE id = $1 AND thread_id = $2`, in.MessageId, t.Id).Scan(&n); err != nil {
+			return "", err
+		}
+		if n == 0 {
+			err = errors.New("message is not in this conversation")
+			return "", err
+		}
+	}
+
+	if err = markRead(ctx, tx, t.Id, in.LoginId, in.MessageId); err != nil {
+		return "", err
+	}
+
+	read, err := lastRead(ctx, tx, t.Id, in.LoginId)
+	if err != nil {
+		return "", err
+	}
+
+	receipt := struct {
+		ThreadId   int32 `json:"thread_id"`
+		LoginId    int32 `json:"login_id"`
+		LastReadId int32 `json:"last_read_id"`
+	}{t.Id, in.LoginId, read}
+	err = emitEvent(ctx, tx, Event{Kind: EventMessagesRead, LoginId: t.other(in.LoginId), OrderId: t.OrderId, OfferId: t.OfferId, Payload: payload(receipt)})
+	if err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(receipt)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+var messageSorts = map[string]paging.Key{
+	"id": {Column: "id", Desc: true},
+}
+
+//a page of a thread, newest first, with how far the other side has read
+func GetMessages(info string) (string, error) {
+	in := struct {
+		paging.Request
+		ThreadId int32 `json:"thread_id"`
+		OfferId  int32 `json:"offer_id"`
+		LoginId  int32 `json:"login_id"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	found := struct {
+		paging.Page
+		Thread      Thread     `json:"thread"`
+		OtherReadId int32      `json:"other_read_id"`
+		Messages    []*Message `json:"messages"`
+	}{Messages: []*Message{}}
+
+	if in.ThreadId != 0 {
+		err = pgxscan.Get(ctx, conn, &found.Thread, `SELECT * FROM threads WHERE id = $1`, in.ThreadId)
+	} else {
+		err = pgxscan.Get(ctx, conn, &found.Thread, `SELECT * FROM threads WHERE offer_id = $1`, in.OfferId)
+	}
+	if err != nil {
+		return "", err
+	}
+	if !found.Thread.member(in.LoginId) {
+		return "", errors.New("not your conversation")
+	}
+
+	var accept int16
+	if err = conn.QueryRow(ctx, `SELECT accept FROM offers WHERE id = $1`, found.Thread.OfferId).Scan(&accept); err != nil {
+		return "", err
+	}
+
+	if found.OtherReadId, err = lastRead(ctx, conn, found.Thread.Id, found.Thread.other(in.LoginId)); err != nil {
+		return "", err
+	}
+
+	var w where
+	w.add(`thread_id = ` + w.arg(found.Thread.Id))
+	sort := "id"
+	order, err := w.page(in.Request, messageSorts, &sort, "id")
+	if err != nil {
+		return "", err
+	}
+
+	if err = pgxscan.Select(ctx, conn, &found.Messages, `SELECT * FROM messages`+w.sql()+order, w.args...); err != nil {
+		return "", err
+	}
+	found.Page = in.Finish(&found.Messages, sort, func(i int) (string, int64) { return "", int64(found.Messages[i].Id) })
+
+	if accept != OfferAccepted {
+		maskMessages(found.Messages)
+	}
+
+	jm, err := json.Marshal(found)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+type ThreadSummary struct {
+	Thread
+	Unread int32 `json:"unread"`
+}
+
+//messages from the other side after what loginId ($1) has read
+const unreadCount = `(SELECT COUNT(*) FROM messages m WHERE m.thread_id = t.id AND m.sender_id != $1
+	AND m.id > COALESCE((SELECT r.last_read_id FROM thread_reads r WHERE r.thread_id = t.id AND r.login_id = $1), 0))::int`
+
+var threadSorts = map[string]paging.Key{
+	"last_message": {Column: "last_message", Cast: "timestamptz", Desc: true},
+}
+
+//the user's conversations, most recently active first
+func GetThreads(info string) (string, error) {
+	in := struct {
+		paging.Request
+		LoginId int32 `json:"login_id"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	var w where
+	login := w.arg(in.LoginId)
+	w.add(`(customer_id = ` + login + ` OR master_id = ` + login + `)`)
+	sort := "last_message"
+	order, err := w.page(in.Request, threadSorts, &sort, "last_message")
+	if err != nil {
+		return "", err
+	}
+
+	found := struct {
+		paging.Page
+		Threads []*ThreadSummary `json:"threads"`
+	}{Threads: []*ThreadSummary{}}
+	err = pgxscan.Select(ctx, conn, &found.Threads, `SELECT * FROM (SELECT t.*, `+unreadCount+` AS unread FROM threads t) t`+w.sql()+order, w.args...)
+	if err != nil {
+		return "", err
+	}
+	found.Page = in.Finish(&found.Threads, sort, func(i int) (string, int64) {
+		return timeKey(found.Threads[i].LastMessage), int64(found.Threads[i].Id)
+	})
+
+	jm, err := json.Marshal(found)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+func UnreadCount(info string) (string, error) {
+	in := struct {
+		LoginId int32 `json:"login_id"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	unread := struct {
+		Messages int32 `json:"messages"`
+		Threads  int32 `json:"threads"`
+	}{}
+	err = conn.QueryRow(ctx, `SELECT COALESCE(SUM(unread), 0)::int, COUNT(*) FILTER (WHERE unread > 0)::int FROM (
+		SELECT `+unreadCount+` AS unread FROM threads t WHERE t.customer_id = $1 OR t.master_id = $1) u`, in.LoginId).Scan(&unread.Messages, &unread.Threads)
+	if err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(unread)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
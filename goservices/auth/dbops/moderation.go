@@ -0,0 +1,519 @@
+package dbops
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"go.mods/paging"
+)
+
+//what can be reported, and the table each kind lives in
+const (
+	ContentReview  = "review"
+	ContentOrder   = "order"
+	ContentOffer   = "offer"
+	ContentProfile = "profile"
+	//a master's answer to a review, screened apart so it can't take the review down with it
+	ContentReply = "reply"
+)
+
+var contentTables = map[string]string{
+	ContentReview:  "comments",
+	ContentOrder:   "orders",
+	ContentOffer:   "offers",
+	ContentProfile: "logins",
+	ContentReply:   "comments",
+}
+
+//content without a moderation row counts as approved
+const (
+	ModerationPending  = "pending"
+	ModerationApproved = "approved"
+	ModerationHidden   = "hidden"
+)
+
+//held items are out of public lists until a moderator looks at them, plain reports leave them up
+type Moderation struct {
+	Id      int32     `json:"id"`
+	Kind    string    `json:"kind"`
+	ItemId  int32     `json:"item_id"`
+	Status  string    `json:"status"`
+	Held    bool      `json:"held"`
+	Reason  string    `json:"reason"`
+	Updated time.Time `json:"updated"`
+	Reports int32     `json:"reports"`
+}
+
+type ContentReport struct {
+	Id         int32     `json:"id"`
+	Kind       string    `json:"kind"`
+	ItemId     int32     `json:"item_id"`
+	ReporterId int32     `json:"reporter_id"`
+	Reason     string    `json:"reason"`
+	Resolved   bool      `json:"resolved"`
+	Created    time.Time `json:"created"`
+}
+
+//moderator_id 0 is the automatic screening
+type ModerationAction struct {
+	Id          int32     `json:"id"`
+	Kind        string    `json:"kind"`
+	ItemId      int32     `json:"item_id"`
+	ModeratorId int32     `json:"moderator_id"`
+	FromStatus  string    `json:"from_status"`
+	ToStatus    string    `json:"to_status"`
+	Reason      string    `json:"reason"`
+	Created     time.Time `json:"created"`
+}
+
+//condition that keeps hidden and held items of a kind out, column is the item's id
+func visibleSql(kind string, column string) string {
+	return `NOT EXISTS (SELECT 1 FROM moderation m WHERE m.kind = '` + kind + `' AND m.item_id = ` + column +
+		` AND (m.status = 'hidden' OR (m.status = 'pending' AND m.held)))`
+}
+
+//logins at this level and above moderate, MODERATOR_LEVEL
+func moderatorLevel() int16 {
+	if l, err := strconv.Atoi(os.Getenv("MODERATOR_LEVEL")); err == nil && l > 0 {
+		return int16(l)
+	}
+	return 3
+}
+
+//distinct open reports that hold an item without waiting for a moderator, MODERATION_REPORTS_TO_HOLD
+func reportsToHold() int {
+	if n, err := strconv.Atoi(os.Getenv("MODERATION_REPORTS_TO_HOLD")); err == nil && n > 0 {
+		return n
+	}
+	return 3
+}
+
+var linkPattern = regexp.MustCompile(`(?i)(https?://|www\.)\S+|\b[\p{L}0-9-]+\.(ru|рф|su|com|net|org|kz|by|ua|info|biz|io|me)\b`)
+
+//the wordlist is read once, one lower case word per line, # starts a comment
+var wordlist struct {
+	sync.Once
+	words map[string]bool
+}
+
+func holdWords() map[string]bool {
+	wordlist.Do(func() {
+		wordlist.words = map[string]bool{}
+		f, err := os.Open(os.Getenv("MODERATION_WORDLIST"))
+		if err != nil {
+			return
+		}
+		defer f.Close()
+
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			w := strings.ToLower(strings.TrimSpace(sc.Text()))
+			if w != "" && !strings.HasPrefix(w, "#") {
+				wordlist.words[w] = true
+			}
+		}
+	})
+	return wordlist.words
+}
+
+//why texts should be held, "" when they're fine
+func holdReason(texts ...string) string {
+	words := holdWords()
+	for _, t := range texts {
+		if os.Getenv("MODERATION_HOLD_LINKS") == "yes" && linkPattern.MatchString(t) {
+			return "auto: link in text"
+		}
+		if len(words) == 0 {
+			continue
+		}
+		for _, w := range strings.FieldsFunc(strings.ToLower(t), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+			if words[w] {
+				return "auto: wordlist"
+			}
+		}
+	}
+	return ""
+}
+
+//moves an item to a state and records who did it and why, hidden items are left alone when held is set
+func setModeration(ctx context.Context, tx pgx.Tx, kind string, itemId int32, to string, held bool, moderatorId int32, reason string) error {
+	from := ModerationApproved
+	var m []*Moderation
+	if err := pgxscan.Select(ctx, tx, &m, `SELECT *, 0 AS reports FROM moderation WHERE kind = $1 AND item_id = $2 FOR UPDATE`, kind, itemId); err != nil {
+		return err
+	}
+	if len(m) > 0 {
+		from = m[0].Status
+	}
+
+	//automatic holds never bring back what a moderator hid
+	if held && from == ModerationHidden {
+		return nil
+	}
+
+	now := time.Now()
+	_, err := tx.Exec(ctx, `INSERT INTO moderation (kind, item_id, status, held, reason, updated) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (kind, item_id) DO UPDATE SET status = EXCLUDED.status, held = EXCLUDED.held, reason = EXCLUDED.reason, updated = EXCLUDED.updated`,
+		kind, itemId, to, held, reason, now)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO moderation_actions (kind, item_id, moderator_id, from_status, to_status, reason, created) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		kind, itemId, moderatorId, from, to, reason, now)
+	return err
+}
+
+//hiding or bringing back a review changes its master's rating
+func rescoreModerated(ctx context.Context, tx pgx.Tx, kind string, itemId int32) error {
+	if kind != ContentReview {
+		return nil
+	}
+	var masterId int32
+	if err := tx.QueryRow(ctx, `SELECT master_id FROM comments WHERE id = $1`, itemId).Scan(&masterId); err != nil {
+		return err
+	}
+	return recomputeRating(ctx, tx, masterId)
+}
+
+//holds new or changed content that trips the automatic rules, a held review leaves its master's rating
+func screen(ctx context.Context, tx pgx.Tx, kind string, itemId int32, texts ...string) error {
+	reason := holdReason(texts...)
+	if reason == "" {
+		return nil
+	}
+	if err := setModeration(ctx, tx, kind, itemId, ModerationPending, true, 0, reason); err != nil {
+		return err
+	}
+	return rescoreModerated(ctx, tx, kind, itemId)
+}
+
+//blanks replies that are held or hidden, the reviews themselves stay
+func hideReplies(ctx context.Context, conn *pgxpool.Pool, cs []Comment) error {
+	var ids []int32
+	for _, c := range cs {
+		if c.Reply != "" {
+			ids = append(ids, c.Id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	var hidden []int32
+	err := pgxscan.Select(ctx, conn, &hidden, `SELECT id FROM comments WHERE id = ANY($1) AND NOT `+visibleSql(ContentReply, "comments.id"), ids)
+	if err != nil {
+		return err
+	}
+	for _, id := range hidden {
+		for i := range cs {
+			if cs[i].Id == id {
+				cs[i].Reply, cs[i].Replied = "", nil
+			}
+		}
+	}
+	return nil
+}
+
+func ReportContent(info string) (string, error) {
+	var r ContentReport
+	if err := json.Unmarshal([]byte(info), &r); err != nil {
+		return "", err
+	}
+	table, ok := contentTables[r.Kind]
+	if !ok {
+		return "", errors.New("can't report " + r.Kind)
+	}
+	r.Reason = strings.TrimSpace(r.Reason)
+	if r.Reason == "" || r.ReporterId == 0 {
+		return "", errors.New("reporter_id and reason are required")
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var n int
+	if err = tx.QueryRow(ctx, `SELECT COUNT(*) FROM `+table+` WHERE id = $1`, r.ItemId).Scan(&n); err != nil {
+		return "", err
+	}
+	if n == 0 {
+		err = errors.New(r.Kind + " " + strconv.Itoa(int(r.ItemId)) + " not found")
+		return "", err
+	}
+
+	r.Created = time.Now()
+	err = tx.QueryRow(ctx, `INSERT INTO content_reports (kind, item_id, reporter_id, reason, created) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (kind, item_id, reporter_id) WHERE NOT resolved DO NOTHING RETURNING id`,
+		r.Kind, r.ItemId, r.ReporterId, r.Reason, r.Created).Scan(&r.Id)
+	if err == pgx.ErrNoRows {
+		err = errors.New("already reported")
+		return "", err
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var m []*Moderation
+	if err = pgxscan.Select(ctx, tx, &m, `SELECT *, 0 AS reports FROM moderation WHERE kind = $1 AND item_id = $2`, r.Kind, r.ItemId); err != nil {
+		return "", err
+	}
+
+	var open int
+	if err = tx.QueryRow(ctx, `SELECT COUNT(*) FROM content_reports WHERE kind = $1 AND item_id = $2 AND NOT resolved`, r.Kind, r.ItemId).Scan(&open); err != nil {
+		return "", err
+	}
+
+	switch {
+	case open >= reportsToHold():
+		err = setModeration(ctx, tx, r.Kind, r.ItemId, ModerationPending, true, 0, "auto: "+strconv.Itoa(open)+" reports")
+		if err == nil {
+			err = rescoreModerated(ctx, tx, r.Kind, r.ItemId)
+		}
+	case len(m) == 0 || m[0].Status == ModerationApproved:
+		//into the queue, still visible
+		err = setModeration(ctx, tx, r.Kind, r.ItemId, ModerationPending, false, 0, "reported: "+r.Reason)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+func checkModerator(ctx context.Context, conn *pgxpool.Pool, id int32) error {
+	var level int16
+	if err := conn.QueryRow(ctx, `SELECT level FROM logins WHERE id = $1`, id).Scan(&level); err != nil {
+		return err
+	}
+	if level < moderatorLevel() {
+		return errors.New("not a moderator")
+	}
+	return nil
+}
+
+//a moderator decision, it resolves the open reports on the item
+func Moderate(info string) (string, error) {
+	in := struct {
+		Kind        string `json:"kind"`
+		ItemId      int32  `json:"item_id"`
+		ModeratorId int32  `json:"moderator_id"`
+		Status      string `json:"status"`
+		Reason      string `json:"reason"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+	if _, ok := contentTables[in.Kind]; !ok {
+		return "", errors.New("unknown kind " + in.Kind)
+	}
+	if in.Status != ModerationPending && in.Status != ModerationApproved && in.Status != ModerationHidden {
+		return "", errors.New("status is pending, approved or hidden")
+	}
+	in.Reason = strings.TrimSpace(in.Reason)
+	if in.Reason == "" {
+		return "", errors.New("moderator actions need a reason")
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if err = checkModerator(ctx, conn, in.ModeratorId); err != nil {
+		return "", err
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var wasVisible bool
+	if err = tx.QueryRow(ctx, `SELECT `+visibleSql(in.Kind, "$1::int"), in.ItemId).Scan(&wasVisible); err != nil {
+		return "", err
+	}
+
+	//an automatic hold stays until a moderator approves the item, sending it back to the queue doesn't release it
+	var held bool
+	err = tx.QueryRow(ctx, `SELECT COALESCE((SELECT held FROM moderation WHERE kind = $1 AND item_id = $2), false)`, in.Kind, in.ItemId).Scan(&held)
+	if err != nil {
+		return "", err
+	}
+	held = held && in.Status != ModerationApproved
+
+	if err = setModeration(ctx, tx, in.Kind, in.ItemId, in.Status, held, in.ModeratorId, in.Reason); err != nil {
+		return "", err
+	}
+
+	if err = rescoreModerated(ctx, tx, in.Kind, in.ItemId); err != nil {
+		return "", err
+	}
+
+	//an order held on the way out reaches the masters once it's approved, not again on every approval
+	if in.Kind == ContentOrder && in.Status == ModerationApproved && !wasVisible {
+		var o Order
+		if err = pgxscan.Get(ctx, tx, &o, `SELECT * FROM orders WHERE id = $1`, in.ItemId); err != nil {
+			return "", err
+		}
+		if err = announceOrder(ctx, tx, o); err != nil {
+			return "", err
+		}
+	}
+
+	if in.Status != ModerationPending {
+		if _, err = tx.Exec(ctx, `UPDATE content_reports SET resolved = true WHERE kind = $1 AND item_id = $2 AND NOT resolved`, in.Kind, in.ItemId); err != nil {
+			return "", err
+		}
+	}
+
+	var m Moderation
+	if err = pgxscan.Get(ctx, tx, &m, `SELECT *, 0 AS reports FROM moderation WHERE kind = $1 AND item_id = $2`, in.Kind, in.ItemId); err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+//the queue, oldest first so nothing waits forever
+func GetModerationQueue(info string) (string, error) {
+	in := struct {
+		paging.Request
+		ModeratorId int32  `json:"moderator_id"`
+		Status      string `json:"status"`
+		Kind        string `json:"kind"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+	if in.Status == "" {
+		in.Status = ModerationPending
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if err = checkModerator(ctx, conn, in.ModeratorId); err != nil {
+		return "", err
+	}
+
+	var w where
+	w.add(`status = ` + w.arg(in.Status))
+	if in.Kind != "" {
+		w.add(`kind = ` + w.arg(in.Kind))
+	}
+
+	sort := "id_asc"
+	order, err := w.page(in.Request, idSorts, &sort, "id_asc")
+	if err != nil {
+		return "", err
+	}
+
+	found := struct {
+		paging.Page
+		Items []*Moderation `json:"items"`
+	}{Items: []*Moderation{}}
+	err = pgxscan.Select(ctx, conn, &found.Items, `SELECT * FROM (SELECT q.*, (SELECT COUNT(*) FROM content_reports r WHERE r.kind = q.kind AND r.item_id = q.item_id AND NOT r.resolved)::int AS reports FROM moderation q) q`+w.sql()+order, w.args...)
+	if err != nil {
+		return "", err
+	}
+
+	found.Page = in.Finish(&found.Items, sort, func(i int) (string, int64) { return "", int64(found.Items[i].Id) })
+
+	jm, err := json.Marshal(found)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+//reports and decisions on one item, newest first
+func GetModerationHistory(info string) (string, error) {
+	in := struct {
+		ModeratorId int32  `json:"moderator_id"`
+		Kind        string `json:"kind"`
+		ItemId      int32  `json:"item_id"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if err = checkModerator(ctx, conn, in.ModeratorId); err != nil {
+		return "", err
+	}
+
+	history := struct {
+		Reports []*ContentReport    `json:"reports"`
+		Actions []*ModerationAction `json:"actions"`
+	}{[]*ContentReport{}, []*ModerationAction{}}
+
+	err = pgxscan.Select(ctx, conn, &history.Reports, `SELECT * FROM content_reports WHERE kind = $1 AND item_id = $2 ORDER BY id DESC`, in.Kind, in.ItemId)
+	if err != nil {
+		return "", err
+	}
+	err = pgxscan.Select(ctx, conn, &history.Actions, `SELECT * FROM moderation_actions WHERE kind = $1 AND item_id = $2 ORDER BY id DESC`, in.Kind, in.ItemId)
+	if err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(history)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
@@ -0,0 +1,402 @@
+package dbops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"go.mods/paging"
+)
+
+//notification states
+const (
+	NotifyPending = "pending"
+	NotifySending = "sending"
+	NotifySent    = "sent"
+	NotifyFailed  = "failed"
+)
+
+//one message on one channel, rendered when queued so a template change doesn't touch what's waiting
+type Notification struct {
+	Id          int64      `json:"id"`
+	LoginId     int32      `json:"login_id"`
+	EventId     int64      `json:"event_id"`
+	Kind        string     `json:"kind"`
+	Channel     string     `json:"channel"`
+	Address     string     `json:"address"`
+	Locale      string     `json:"locale"`
+	Subject     string     `json:"subject"`
+	Body        string     `json:"body"`
+	Dedup       string     `json:"-"`
+	Status      string     `json:"status"`
+	Attempts    int32      `json:"attempts"`
+	NextAttempt time.Time  `json:"-"`
+	Error       string     `json:"error,omitempty"`
+	Created     time.Time  `json:"created"`
+	Sent        *time.Time `json:"sent"`
+	Read        *time.Time `json:"read"`
+}
+
+//users without a row get the defaults, muted lists event kinds they don't want at all
+type NotifyPrefs struct {
+	LoginId int32    `json:"login_id"`
+	Locale  string   `json:"locale"`
+	Email   bool     `json:"email"`
+	Sms     bool     `json:"sms"`
+	InApp   bool     `json:"inapp"`
+	Muted   []string `json:"muted"`
+}
+
+func defaultPrefs(loginId int32) NotifyPrefs {
+	return NotifyPrefs{LoginId: loginId, Locale: defaultLocale(), Email: true, InApp: true, Muted: []string{}}
+}
+
+func notifyPrefs(ctx context.Context, q pgxscan.Querier, loginId int32) (NotifyPrefs, error) {
+	var ps []*NotifyPrefs
+	if err := pgxscan.Select(ctx, q, &ps, `SELECT * FROM notify_prefs WHERE login_id = $1`, loginId); err != nil {
+		return NotifyPrefs{}, err
+	}
+	if len(ps) == 0 {
+		return defaultPrefs(loginId), nil
+	}
+	return *ps[0], nil
+}
+
+func (p NotifyPrefs) muted(kind string) bool {
+	for _, k := range p.Muted {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+//give up after NOTIFY_MAX_ATTEMPTS, waits double from a minute up to six hours
+func maxAttempts() int32 {
+	if n, err := strconv.Atoi(os.Getenv("NOTIFY_MAX_ATTEMPTS")); err == nil && n > 0 {
+		return int32(n)
+	}
+	return 8
+}
+
+func retryDelay(attempts int32) time.Duration {
+	d := time.Minute * time.Duration(math.Pow(2, float64(attempts-1)))
+	if d > 6*time.Hour || d <= 0 {
+		d = 6 * time.Hour
+	}
+	return d
+}
+
+//one queued row per event and channel, an order is announced to a master once however often it's republished
+func dedupKey(e *Event, channel string) string {
+	if e.Kind == EventMatchingOrder {
+		return e.Kind + ":" + strconv.Itoa(int(e.OrderId)) + ":" + strconv.Itoa(int(e.LoginId)) + ":" + channel
+	}
+	return "event:" + strconv.FormatInt(e.Id, 10) + ":" + channel
+}
+
+//renders an event for each channel the user wants, called by the relay for every event.* message
+func queueEvent(ctx context.Context, tx pgx.Tx, e *Event) (int, error) {
+	if e.LoginId == 0 {
+		return 0, nil
+	}
+
+	prefs, err := notifyPrefs(ctx, tx, e.LoginId)
+	if err != nil {
+		return 0, err
+	}
+	if prefs.muted(e.Kind) {
+		return 0, nil
+	}
+
+	var to struct {
+		FirstName string
+		Email     string
+		Phone     string
+	}
+	if err = pgxscan.Get(ctx, tx, &to, `SELECT first_name, email, phone FROM logins WHERE id = $1`, e.LoginId); err != nil {
+		if pgxscan.NotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	data := notifyData{Name: to.FirstName, Payload: map[string]interface{}{}}
+	json.Unmarshal(e.Payload, &data.Payload)
+	if e.OrderId != 0 {
+		var orders []*Order
+		if err = pgxscan.Select(ctx, tx, &orders, `SELECT * FROM orders WHERE id = $1`, e.OrderId); err != nil {
+			return 0, err
+		}
+		if len(orders) > 0 {
+			data.Order = *orders[0]
+		}
+	}
+
+	subject, body, ok, err := renderNotification(e.Kind, prefs.Locale, data)
+	if !ok {
+		return 0, nil
+	}
+	if err != nil {
+		log.Println("notification template "+e.Kind+"."+prefs.Locale+" failed: ", err)
+		return 0, nil
+	}
+
+	channels := map[string]string{}
+	if prefs.Email && to.Email != "" {
+		channels[ChannelEmail] = to.Email
+	}
+	if prefs.Sms && to.Phone != "" {
+		channels[ChannelSms] = to.Phone
+	}
+	if prefs.InApp {
+		channels[ChannelInApp] = ""
+	}
+
+	queued := 0
+	now := time.Now()
+	for channel, address := range channels {
+		tag, err := tx.Exec(ctx, `INSERT INTO notifications (login_id, event_id, kind, channel, address, locale, subject, body, dedup, status, attempts, next_attempt, error, created)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, 0, $11, '', $11) ON CONFLICT (dedup) DO NOTHING`,
+			e.LoginId, e.Id, e.Kind, channel, address, prefs.Locale, subject, body, dedupKey(e, channel), NotifyPending, now)
+		if err != nil {
+			return 0, err
+		}
+		queued += int(tag.RowsAffected())
+	}
+
+	return queued, nil
+}
+
+//notifications sent per pass
+const deliverBatch = 100
+
+//a claimed notification nobody finished within this long is taken again, its sender died mid batch
+const claimLease = 10 * time.Minute
+
+//claims what's due and commits, then sends and records each result on its own
+//a failed write of one result can't undo the others, two replicas never claim the same row
+func deliverNotifications(ctx context.Context, conn *pgxpool.Pool) (int, error) {
+	now := time.Now()
+	var ns []*Notification
+	err := pgxscan.Select(ctx, conn, &ns, `UPDATE notifications SET status = $1, attempts = attempts + 1, next_attempt = $2
+		WHERE id IN (SELECT id FROM notifications WHERE status IN ($3, $1) AND next_attempt <= $4 ORDER BY id LIMIT `+strconv.Itoa(deliverBatch)+` FOR UPDATE SKIP LOCKED)
+		RETURNING *`,
+		NotifySending, now.Add(claimLease), NotifyPending, now)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, n := range ns {
+		now := time.Now()
+
+		s, err := senderFor(n.Channel)
+		if err == nil {
+			err = s.Send(ctx, n)
+		}
+
+		if err == nil {
+			n.Status, n.Sent, n.Error = NotifySent, &now, ""
+			sent++
+		} else {
+			n.Status, n.Error = NotifyPending, err.Error()
+			n.NextAttempt = now.Add(retryDelay(n.Attempts))
+			if n.Attempts >= maxAttempts() {
+				n.Status = NotifyFailed
+			}
+		}
+
+		_, err = conn.Exec(ctx, `UPDATE notifications SET status = $1, next_attempt = $2, error = $3, sent = $4 WHERE id = $5 AND status = $6`,
+			n.Status, n.NextAttempt, n.Error, n.Sent, n.Id, NotifySending)
+		if err != nil {
+			log.Println("notification "+strconv.FormatInt(n.Id, 10)+" result not saved: ", err)
+		}
+	}
+
+	return sent, nil
+}
+
+//sends what's due every NOTIFY_POLL_SECONDS, 0 turns sending off on this replica, queueing is the relay's
+func StartNotifier() {
+	seconds := envFloat("NOTIFY_POLL_SECONDS", 5)
+	if seconds == 0 {
+		return
+	}
+
+	go func() {
+		ctx := context.Background()
+		for {
+			conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+			if err == nil {
+				if _, err = deliverNotifications(ctx, conn); err != nil {
+					log.Println("sending notifications failed: ", err)
+				}
+				conn.Close()
+			} else {
+				log.Println("notifier can't connect: ", err)
+			}
+			time.Sleep(time.Duration(seconds * float64(time.Second)))
+		}
+	}()
+}
+
+func GetNotifyPrefs(info string) (string, error) {
+	in := struct {
+		LoginId int32 `json:"login_id"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	p, err := notifyPrefs(ctx, conn, in.LoginId)
+	if err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+func SetNotifyPrefs(info string) (string, error) {
+	p := defaultPrefs(0)
+	if err := json.Unmarshal([]byte(info), &p); err != nil {
+		return "", err
+	}
+	if p.LoginId == 0 {
+		return "", errors.New("login_id is required")
+	}
+	if !knownLocale(p.Locale) {
+		return "", errors.New("no templates for locale " + p.Locale)
+	}
+	if p.Muted == nil {
+		p.Muted = []string{}
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	_, err = conn.Exec(ctx, `INSERT INTO notify_prefs (login_id, locale, email, sms, in_app, muted) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (login_id) DO UPDATE SET locale = EXCLUDED.locale, email = EXCLUDED.email, sms = EXCLUDED.sms, in_app = EXCLUDED.in_app, muted = EXCLUDED.muted`,
+		p.LoginId, p.Locale, p.Email, p.Sms, p.InApp, p.Muted)
+	if err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+var notificationSorts = map[string]paging.Key{
+	"id": {Column: "id", Desc: true},
+}
+
+//the in-app inbox, newest first
+func GetNotifications(info string) (string, error) {
+	in := struct {
+		paging.Request
+		LoginId int32 `json:"login_id"`
+		Unread  bool  `json:"unread"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	found := struct {
+		paging.Page
+		Unread        int64           `json:"unread"`
+		Notifications []*Notification `json:"notifications"`
+	}{Notifications: []*Notification{}}
+
+	err = conn.QueryRow(ctx, `SELECT COUNT(*) FROM notifications WHERE login_id = $1 AND channel = $2 AND status = $3 AND read IS NULL`,
+		in.LoginId, ChannelInApp, NotifySent).Scan(&found.Unread)
+	if err != nil {
+		return "", err
+	}
+
+	var w where
+	w.add("login_id = " + w.arg(in.LoginId))
+	w.add("channel = " + w.arg(ChannelInApp))
+	w.add("status = " + w.arg(NotifySent))
+	if in.Unread {
+		w.add("read IS NULL")
+	}
+	sort := "id"
+	order, err := w.page(in.Request, notificationSorts, &sort, "id")
+	if err != nil {
+		return "", err
+	}
+
+	if err = pgxscan.Select(ctx, conn, &found.Notifications, `SELECT * FROM notifications`+w.sql()+order, w.args...); err != nil {
+		return "", err
+	}
+	found.Page = in.Finish(&found.Notifications, sort, func(i int) (string, int64) { return "", found.Notifications[i].Id })
+
+	jm, err := json.Marshal(found)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+//marks in-app notifications read, up to and including id, or all of them when id is 0
+func ReadNotifications(info string) (string, error) {
+	in := struct {
+		LoginId int32 `json:"login_id"`
+		Id      int64 `json:"id"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	tag, err := conn.Exec(ctx, `UPDATE notifications SET read = $1 WHERE login_id = $2 AND channel = $3 AND read IS NULL AND ($4::bigint = 0 OR id <= $4::bigint)`,
+		time.Now(), in.LoginId, ChannelInApp, in.Id)
+	if err != nil {
+		return "", err
+	}
+
+	return `{"read":` + strconv.FormatInt(tag.RowsAffected(), 10) + `}`, nil
+}
@@ -0,0 +1,45 @@
+package dbops
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedupKey(t *testing.T) {
+	cases := []struct {
+		e       Event
+		channel string
+		want    string
+	}{
+		{Event{Id: 7, Kind: EventNewOffer, LoginId: 3, OrderId: 9}, ChannelEmail, "event:7:email"},
+		{Event{Id: 7, Kind: EventNewOffer, LoginId: 3, OrderId: 9}, ChannelSms, "event:7:sms"},
+		{Event{Id: 8, Kind: EventMatchingOrder, LoginId: 3, OrderId: 9}, ChannelEmail, "matching_order:9:3:email"},
+		//republished, a new event for the same order and master
+		{Event{Id: 12, Kind: EventMatchingOrder, LoginId: 3, OrderId: 9}, ChannelEmail, "matching_order:9:3:email"},
+		{Event{Id: 13, Kind: EventMatchingOrder, LoginId: 4, OrderId: 9}, ChannelEmail, "matching_order:9:4:email"},
+	}
+	for _, c := range cases {
+		if got := dedupKey(&c.e, c.channel); got != c.want {
+			t.Errorf("dedupKey(%+v, %s) = %q, want %q", c.e, c.channel, got, c.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	cases := []struct {
+		attempts int32
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{5, 16 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, 6 * time.Hour},
+		{100, 6 * time.Hour},
+	}
+	for _, c := range cases {
+		if got := retryDelay(c.attempts); got != c.want {
+			t.Errorf("retryDelay(%d) = %v, want %v", c.attempts, got, c.want)
+		}
+	}
+}
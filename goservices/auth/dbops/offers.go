@@ -0,0 +1,209 @@
+package dbops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"go.mods/outbox"
+)
+
+//the customer picks an offer: it's accepted, the master gets the order and every other open offer is declined
+func AcceptOffer(info string) (string, error) {
+	in := struct {
+		Id      int32 `json:"id"`
+		LoginId int32 `json:"login_id"`
+	}{}
+	err := json.Unmarshal([]byte(info), &in)
+	if err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var offer Offer
+	if err = pgxscan.Get(ctx, tx, &offer, `SELECT * FROM offers WHERE id = $1`, in.Id); err != nil {
+		return "", err
+	}
+
+	//the order row lock serializes concurrent accepts on the same order
+	var order Order
+	if err = pgxscan.Get(ctx, tx, &order, `SELECT * FROM orders WHERE id = $1 FOR UPDATE`, offer.OrderId); err != nil {
+		return "", err
+	}
+	if order.LoginId != in.LoginId {
+		err = errors.New("only the customer can accept offers")
+		return "", err
+	}
+
+	//re-read under the lock, somebody may have got here first
+	if err = pgxscan.Get(ctx, tx, &offer, `SELECT * FROM offers WHERE id = $1 FOR UPDATE`, in.Id); err != nil {
+		return "", err
+	}
+	if offer.Accept != OfferPending {
+		err = errors.New("offer is no longer open")
+		return "", err
+	}
+	if !orderIsOpen(order.Status) {
+		err = errors.New("order is " + order.Status + ", offers are closed")
+		return "", err
+	}
+
+	if _, err = tx.Exec(ctx, `UPDATE offers SET accept = $1 WHERE id = $2`, OfferAccepted, offer.Id); err != nil {
+		return "", err
+	}
+	offer.Accept = OfferAccepted
+
+	//accepting it means the customer saw it, its charge stays paid
+	if _, err = tx.Exec(ctx, `UPDATE offer_charges SET viewed = $1 WHERE offer_id = $2 AND viewed IS NULL`, time.Now(), offer.Id); err != nil {
+		return "", err
+	}
+
+	var declined []*Offer
+	err = pgxscan.Select(ctx, tx, &declined, `UPDATE offers SET accept = $1 WHERE order_id = $2 AND id != $3 AND accept = $4 RETURNING *`,
+		OfferDeclined, order.Id, offer.Id, OfferPending)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err = tx.Exec(ctx, `UPDATE orders SET master_id = $1 WHERE id = $2`, offer.MasterId, order.Id); err != nil {
+		return "", err
+	}
+
+	order, err = transitionOrder(ctx, tx, order.Id, OrderAssigned, in.LoginId, "offer accepted")
+	if err != nil {
+		return "", err
+	}
+	order.MasterId = offer.MasterId
+
+	err = emitEvent(ctx, tx, Event{Kind: EventOfferAccepted, LoginId: offer.MasterId, OrderId: order.Id, OfferId: offer.Id, Payload: payload(offer)})
+	if err != nil {
+		return "", err
+	}
+	for _, v := range declined {
+		err = emitEvent(ctx, tx, Event{Kind: EventOfferDeclined, LoginId: v.MasterId, OrderId: order.Id, OfferId: v.Id, Payload: payload(v)})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	//consumers see every offer whose status changed
+	for _, v := range append([]*Offer{&offer}, declined...) {
+		if err = outbox.Write(ctx, tx, TopicOfferUpdated, outboxKey(v.Id), v); err != nil {
+			return "", err
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(struct {
+		Order    Order    `json:"order"`
+		Offer    Offer    `json:"offer"`
+		Declined []*Offer `json:"declined"`
+	}{order, offer, declined})
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+//a master takes back their own offer while the customer hasn't decided yet
+func WithdrawOffer(info string) (string, error) {
+	in := struct {
+		Id       int32 `json:"id"`
+		MasterId int32 `json:"master_id"`
+	}{}
+	err := json.Unmarshal([]byte(info), &in)
+	if err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var offer Offer
+	if err = pgxscan.Get(ctx, tx, &offer, `SELECT * FROM offers WHERE id = $1`, in.Id); err != nil {
+		return "", err
+	}
+
+	var order Order
+	if err = pgxscan.Get(ctx, tx, &order, `SELECT * FROM orders WHERE id = $1 FOR UPDATE`, offer.OrderId); err != nil {
+		return "", err
+	}
+	if err = pgxscan.Get(ctx, tx, &offer, `SELECT * FROM offers WHERE id = $1 FOR UPDATE`, in.Id); err != nil {
+		return "", err
+	}
+
+	if in.MasterId == 0 || offer.MasterId != in.MasterId {
+		err = errors.New("not your offer")
+		return "", err
+	}
+	if offer.Accept != OfferPending || !orderIsOpen(order.Status) {
+		err = errors.New("offer can't be withdrawn anymore")
+		return "", err
+	}
+
+	if _, err = tx.Exec(ctx, `UPDATE offers SET accept = $1 WHERE id = $2`, OfferWithdrawn, offer.Id); err != nil {
+		return "", err
+	}
+	offer.Accept = OfferWithdrawn
+	if err = outbox.Write(ctx, tx, TopicOfferUpdated, outboxKey(offer.Id), offer); err != nil {
+		return "", err
+	}
+
+	//no offers left to talk about
+	var pending int
+	if err = tx.QueryRow(ctx, `SELECT COUNT(*) FROM offers WHERE order_id = $1 AND accept = $2`, order.Id, OfferPending).Scan(&pending); err != nil {
+		return "", err
+	}
+	if pending == 0 && order.Status == OrderInNegotiation {
+		if _, err = transitionOrder(ctx, tx, order.Id, OrderPublished, in.MasterId, "all offers withdrawn"); err != nil {
+			return "", err
+		}
+	}
+
+	err = emitEvent(ctx, tx, Event{Kind: EventOfferWithdrawn, LoginId: order.LoginId, OrderId: order.Id, OfferId: offer.Id, Payload: payload(offer)})
+	if err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(offer)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
@@ -0,0 +1,146 @@
+package dbops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"go.mods/outbox"
+)
+
+//customers can change their orders until a master is assigned
+func orderIsEditable(status string) bool {
+	return status == OrderDraft || orderIsOpen(status)
+}
+
+//locks the order and checks it belongs to loginId and can still be changed
+func lockOwnOrder(ctx context.Context, tx pgx.Tx, id int32, loginId int32) (Order, error) {
+	var o Order
+	if err := pgxscan.Get(ctx, tx, &o, `SELECT * FROM orders WHERE id = $1 FOR UPDATE`, id); err != nil {
+		return o, err
+	}
+	if loginId == 0 || o.LoginId != loginId {
+		return o, errors.New("not your order")
+	}
+	if !orderIsEditable(o.Status) {
+		return o, errors.New("order is " + o.Status + " and can't be changed")
+	}
+	return o, nil
+}
+
+func UpdateOrder(info string) (string, error) {
+	var in Order
+	err := json.Unmarshal([]byte(info), &in)
+	if err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	in.Attributes, err = checkOrderAttributes(ctx, conn, in.ServiceId, in.Attributes)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	o, err := lockOwnOrder(ctx, tx, in.Id, in.LoginId)
+	if err != nil {
+		return "", err
+	}
+
+	//once masters are bidding the service is fixed, their offers are for it
+	if o.Status == OrderInNegotiation && in.ServiceId != o.ServiceId {
+		err = errors.New("service can't change once there are offers")
+		return "", err
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE orders SET service_id = $1, name = $2, title = $3, description = $4, region_id = $5, town_id = $6, budget = $7, time = $8, attributes = $9 WHERE id = $10`,
+		in.ServiceId, in.Name, in.Title, in.Description, in.RegionId, in.TownId, in.Budget, in.Time, in.Attributes, o.Id)
+	if err != nil {
+		return "", err
+	}
+
+	if err = screen(ctx, tx, ContentOrder, o.Id, in.Title, in.Description); err != nil {
+		return "", err
+	}
+
+	if err = pgxscan.Get(ctx, tx, &o, `SELECT * FROM orders WHERE id = $1`, o.Id); err != nil {
+		return "", err
+	}
+
+	if err = outbox.Write(ctx, tx, TopicOrderUpdated, outboxKey(o.Id), o); err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(o)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+//cancelling declines whatever offers are still waiting and pays back the ones the customer never saw
+func CancelOrder(info string) (string, error) {
+	in := struct {
+		Id      int32  `json:"id"`
+		LoginId int32  `json:"login_id"`
+		Reason  string `json:"reason"`
+	}{}
+	err := json.Unmarshal([]byte(info), &in)
+	if err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err = lockOwnOrder(ctx, tx, in.Id, in.LoginId); err != nil {
+		return "", err
+	}
+
+	o, err := transitionOrder(ctx, tx, in.Id, OrderCancelled, in.LoginId, in.Reason)
+	if err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(o)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
@@ -0,0 +1,316 @@
+package dbops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"go.mods/outbox"
+)
+
+//order states, orders.completed is kept in sync for older readers
+const (
+	OrderDraft         = "draft"
+	OrderPublished     = "published"
+	OrderInNegotiation = "in_negotiation"
+	OrderAssigned      = "assigned"
+	OrderInProgress    = "in_progress"
+	OrderCompleted     = "completed"
+	OrderCancelled     = "cancelled"
+	OrderDisputed      = "disputed"
+)
+
+//offers.accept values
+const (
+	OfferPending   = 0
+	OfferAccepted  = 1
+	OfferDeclined  = 2
+	OfferWithdrawn = 3
+)
+
+//every allowed move, anything else is refused
+var orderTransitions = map[string][]string{
+	OrderDraft:         {OrderPublished, OrderCancelled},
+	OrderPublished:     {OrderDraft, OrderInNegotiation, OrderAssigned, OrderCancelled},
+	OrderInNegotiation: {OrderPublished, OrderAssigned, OrderCancelled},
+	OrderAssigned:      {OrderInProgress, OrderCancelled, OrderDisputed},
+	OrderInProgress:    {OrderCompleted, OrderDisputed},
+	OrderCompleted:     {OrderDisputed},
+	OrderDisputed:      {OrderInProgress, OrderCompleted, OrderCancelled},
+	OrderCancelled:     {},
+}
+
+//who may ask for each move through order-transition, offers and cancel-order move orders on their own
+const (
+	actorCustomer  = "customer"
+	actorMaster    = "master"
+	actorModerator = "moderator"
+)
+
+//from -> to -> actors, a move nobody is listed for only happens through the other actions
+//once a master is assigned only a moderator cancels, and only a moderator settles a dispute
+var transitionActors = map[string]map[string][]string{
+	OrderDraft: {
+		OrderPublished: {actorCustomer},
+		OrderCancelled: {actorCustomer, actorModerator},
+	},
+	OrderPublished: {
+		OrderDraft:         {actorCustomer},
+		OrderInNegotiation: {},
+		OrderAssigned:      {actorCustomer},
+		OrderCancelled:     {actorCustomer, actorModerator},
+	},
+	OrderInNegotiation: {
+		OrderPublished: {},
+		OrderAssigned:  {actorCustomer},
+		OrderCancelled: {actorCustomer, actorModerator},
+	},
+	OrderAssigned: {
+		OrderInProgress: {actorMaster, actorModerator},
+		OrderCancelled:  {actorModerator},
+		OrderDisputed:   {actorCustomer, actorMaster},
+	},
+	OrderInProgress: {
+		OrderCompleted: {actorCustomer, actorModerator},
+		OrderDisputed:  {actorCustomer, actorMaster},
+	},
+	OrderCompleted: {
+		OrderDisputed: {actorCustomer, actorMaster},
+	},
+	OrderDisputed: {
+		OrderInProgress: {actorModerator},
+		OrderCompleted:  {actorModerator},
+		OrderCancelled:  {actorModerator},
+	},
+	OrderCancelled: {},
+}
+
+//states that still take offers
+func orderIsOpen(status string) bool {
+	return status == OrderPublished || status == OrderInNegotiation
+}
+
+type OrderTransition struct {
+	Id         int32     `json:"id"`
+	OrderId    int32     `json:"order_id"`
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	LoginId    int32     `json:"login_id"`
+	Reason     string    `json:"reason"`
+	Created    time.Time `json:"created"`
+}
+
+func canTransition(from string, to string) bool {
+	for _, v := range orderTransitions[from] {
+		if v == to {
+			return true
+		}
+	}
+	return false
+}
+
+//the customer, the assigned master or a moderator, whichever of them the transition allows
+func checkTransitionActor(ctx context.Context, conn *pgxpool.Pool, tx pgx.Tx, orderId int32, to string, loginId int32) error {
+	var o Order
+	if err := pgxscan.Get(ctx, tx, &o, `SELECT * FROM orders WHERE id = $1 FOR UPDATE`, orderId); err != nil {
+		return err
+	}
+
+	for _, actor := range transitionActors[o.Status][to] {
+		switch actor {
+		case actorCustomer:
+			if loginId != 0 && loginId == o.LoginId {
+				return nil
+			}
+		case actorMaster:
+			if loginId != 0 && loginId == o.MasterId {
+				return nil
+			}
+		case actorModerator:
+			if checkModerator(ctx, conn, loginId) == nil {
+				return nil
+			}
+		}
+	}
+
+	return errors.New("not allowed to move this order from " + o.Status + " to " + to)
+}
+
+//locks the order and moves it to the new state, the caller commits
+func transitionOrder(ctx context.Context, tx pgx.Tx, orderId int32, to string, loginId int32, reason string) (Order, error) {
+	var o Order
+	if err := pgxscan.Get(ctx, tx, &o, `SELECT * FROM orders WHERE id = $1 FOR UPDATE`, orderId); err != nil {
+		return o, err
+	}
+
+	if _, ok := orderTransitions[to]; !ok {
+		return o, errors.New("unknown order status " + to)
+	}
+	if !canTransition(o.Status, to) {
+		return o, errors.New("order can't go from " + o.Status + " to " + to)
+	}
+
+	//only accepting an offer assigns a master
+	if to == OrderAssigned {
+		var accepted int
+		if err := tx.QueryRow(ctx, `SELECT COUNT(*) FROM offers WHERE order_id = $1 AND accept = $2`, orderId, OfferAccepted).Scan(&accepted); err != nil {
+			return o, err
+		}
+		if accepted == 0 {
+			return o, errors.New("order can only be assigned through an accepted offer")
+		}
+	}
+
+	_, err := tx.Exec(ctx, `UPDATE orders SET status = $1, completed = $2 WHERE id = $3`, to, to == OrderCompleted, orderId)
+	if err != nil {
+		return o, err
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO order_transitions (order_id, from_status, to_status, login_id, reason, created) VALUES ($1, $2, $3, $4, $5, $6)`,
+		orderId, o.Status, to, loginId, reason, time.Now())
+	if err != nil {
+		return o, err
+	}
+
+	change := payload(struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}{o.Status, to})
+
+	from := o.Status
+	o.Status = to
+	o.Completed = to == OrderCompleted
+
+	for _, id := range []int32{o.LoginId, o.MasterId} {
+		if id == 0 {
+			continue
+		}
+		if err = emitEvent(ctx, tx, Event{Kind: EventOrderStatus, LoginId: id, OrderId: o.Id, Payload: change}); err != nil {
+			return o, err
+		}
+	}
+
+	//masters hear about an order once, not again each time it comes back from negotiation
+	if from == OrderDraft && to == OrderPublished {
+		if err = announceOrder(ctx, tx, o); err != nil {
+			return o, err
+		}
+	}
+
+	//whatever way an order gets cancelled, waiting offers are declined and the unseen ones paid back
+	if to == OrderCancelled {
+		if err = cancelOffers(ctx, tx, o.Id); err != nil {
+			return o, err
+		}
+	}
+
+	if err = outbox.Write(ctx, tx, TopicOrderStatus, outboxKey(o.Id), o); err != nil {
+		return o, err
+	}
+
+	return o, nil
+}
+
+func cancelOffers(ctx context.Context, tx pgx.Tx, orderId int32) error {
+	var declined []*Offer
+	err := pgxscan.Select(ctx, tx, &declined, `UPDATE offers SET accept = $1 WHERE order_id = $2 AND accept = $3 RETURNING *`,
+		OfferDeclined, orderId, OfferPending)
+	if err != nil {
+		return err
+	}
+	for _, v := range declined {
+		err = emitEvent(ctx, tx, Event{Kind: EventOfferDeclined, LoginId: v.MasterId, OrderId: orderId, OfferId: v.Id, Payload: payload(v)})
+		if err != nil {
+			return err
+		}
+		if err = outbox.Write(ctx, tx, TopicOfferUpdated, outboxKey(v.Id), v); err != nil {
+			return err
+		}
+	}
+
+	return refundUnseenOffers(ctx, tx, orderId)
+}
+
+func TransitionOrder(info string) (string, error) {
+	in := struct {
+		Id      int32  `json:"id"`
+		Status  string `json:"status"`
+		LoginId int32  `json:"login_id"`
+		Reason  string `json:"reason"`
+	}{}
+	err := json.Unmarshal([]byte(info), &in)
+	if err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	if err = checkTransitionActor(ctx, conn, tx, in.Id, in.Status, in.LoginId); err != nil {
+		return "", err
+	}
+
+	o, err := transitionOrder(ctx, tx, in.Id, in.Status, in.LoginId, in.Reason)
+	if err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(o)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+func GetOrderHistory(info string) (string, error) {
+	var o Order
+	err := json.Unmarshal([]byte(info), &o)
+	if err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	var items []*OrderTransition
+	err = pgxscan.Select(ctx, conn, &items, `SELECT * FROM order_transitions WHERE order_id = $1 ORDER BY id ASC`, o.Id)
+	if err != nil {
+		return "", err
+	}
+
+	if len(items) < 1 {
+		return "[]", nil
+	}
+
+	jm, err := json.Marshal(items)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
@@ -0,0 +1,117 @@
+package dbops
+
+import "testing"
+
+func TestCanTransition(t *testing.T) {
+	cases := []struct {
+		from, to string
+		want     bool
+	}{
+		{OrderDraft, OrderPublished, true},
+		{OrderDraft, OrderAssigned, false},
+		{OrderPublished, OrderDraft, true},
+		{OrderPublished, OrderInNegotiation, true},
+		{OrderInNegotiation, OrderPublished, true},
+		{OrderInNegotiation, OrderInProgress, false},
+		{OrderAssigned, OrderInProgress, true},
+		{OrderAssigned, OrderPublished, false},
+		{OrderInProgress, OrderCompleted, true},
+		{OrderInProgress, OrderCancelled, false},
+		{OrderCompleted, OrderDisputed, true},
+		{OrderCompleted, OrderInProgress, false},
+		{OrderDisputed, OrderCancelled, true},
+		{OrderCancelled, OrderPublished, false},
+		{OrderCancelled, OrderCancelled, false},
+		{"archived", OrderPublished, false},
+		{OrderDraft, "archived", false},
+	}
+	for _, c := range cases {
+		if got := canTransition(c.from, c.to); got != c.want {
+			t.Errorf("canTransition(%s, %s) = %v, want %v", c.from, c.to, got, c.want)
+		}
+	}
+}
+
+func TestOrderStates(t *testing.T) {
+	for from, tos := range orderTransitions {
+		for _, to := range tos {
+			if _, ok := orderTransitions[to]; !ok {
+				t.Errorf("%s goes to %s, which isn't a state", from, to)
+			}
+			if to == from {
+				t.Errorf("%s goes to itself", from)
+			}
+			if _, ok := transitionActors[from][to]; !ok {
+				t.Errorf("nobody is listed for %s to %s", from, to)
+			}
+		}
+	}
+	for from, tos := range transitionActors {
+		for to, actors := range tos {
+			if !canTransition(from, to) {
+				t.Errorf("actors listed for %s to %s, which isn't a move", from, to)
+			}
+			for _, a := range actors {
+				if a != actorCustomer && a != actorMaster && a != actorModerator {
+					t.Errorf("unknown actor %s for %s to %s", a, from, to)
+				}
+			}
+		}
+	}
+	if len(orderTransitions[OrderCancelled]) != 0 {
+		t.Error("cancelled is not final")
+	}
+}
+
+func actorMay(from, to, actor string) bool {
+	for _, a := range transitionActors[from][to] {
+		if a == actor {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTransitionActors(t *testing.T) {
+	cases := []struct {
+		from, to, actor string
+		want            bool
+	}{
+		{OrderDraft, OrderPublished, actorCustomer, true},
+		{OrderDraft, OrderPublished, actorMaster, false},
+		{OrderPublished, OrderInNegotiation, actorCustomer, false},
+		{OrderInNegotiation, OrderPublished, actorCustomer, false},
+		{OrderPublished, OrderCancelled, actorCustomer, true},
+		{OrderInNegotiation, OrderCancelled, actorCustomer, true},
+		//once a master is assigned the customer can't walk away on their own, cancel-order refuses it too
+		{OrderAssigned, OrderCancelled, actorCustomer, false},
+		{OrderAssigned, OrderCancelled, actorModerator, true},
+		{OrderAssigned, OrderInProgress, actorMaster, true},
+		{OrderAssigned, OrderInProgress, actorCustomer, false},
+		{OrderInProgress, OrderCompleted, actorCustomer, true},
+		{OrderInProgress, OrderCompleted, actorMaster, false},
+		{OrderInProgress, OrderDisputed, actorMaster, true},
+		{OrderCompleted, OrderDisputed, actorCustomer, true},
+		//neither side settles its own dispute
+		{OrderDisputed, OrderInProgress, actorMaster, false},
+		{OrderDisputed, OrderInProgress, actorModerator, true},
+		{OrderDisputed, OrderCompleted, actorCustomer, false},
+		{OrderDisputed, OrderCompleted, actorModerator, true},
+		{OrderDisputed, OrderCancelled, actorCustomer, false},
+		{OrderDisputed, OrderCancelled, actorMaster, false},
+		{OrderDisputed, OrderCancelled, actorModerator, true},
+	}
+	for _, c := range cases {
+		if got := actorMay(c.from, c.to, c.actor); got != c.want {
+			t.Errorf("%s moving %s to %s = %v, want %v", c.actor, c.from, c.to, got, c.want)
+		}
+	}
+}
+
+func TestOrderIsEditable(t *testing.T) {
+	for status, want := range map[string]bool{OrderDraft: true, OrderPublished: true, OrderInNegotiation: true, OrderAssigned: false, OrderCompleted: false, OrderCancelled: false} {
+		if orderIsEditable(status) != want {
+			t.Errorf("orderIsEditable(%s) != %v", status, want)
+		}
+	}
+}
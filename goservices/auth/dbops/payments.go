@@ -0,0 +1,652 @@
+package dbops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"go.mods/outbox"
+	"go.mods/paging"
+)
+
+//payment and refund statuses, the last three never change again
+const (
+	PaymentCreated   = "created"
+	PaymentPending   = "pending"
+	PaymentSucceeded = "succeeded"
+	PaymentCanceled  = "canceled"
+	PaymentFailed    = "failed"
+	//the provider reports another amount than we asked for, somebody has to look at it
+	PaymentMismatch = "mismatch"
+)
+
+func paymentIsFinal(status string) bool {
+	return status == PaymentSucceeded || status == PaymentCanceled || status == PaymentFailed || status == PaymentMismatch
+}
+
+const TopicPaymentUpdated = "payment.updated"
+
+//a top-up, created before the provider hears of it so a crash in between leaves a row to reconcile
+//the key is the caller's, the same key from the same login gets the same payment back
+type Payment struct {
+	Id              int64     `json:"id"`
+	LoginId         int32     `json:"login_id"`
+	Provider        string    `json:"provider"`
+	ExternalId      string    `json:"external_id"`
+	IdempotencyKey  string    `json:"idempotency_key"`
+	Amount          int32     `json:"amount"`
+	Status          string    `json:"status"`
+	ConfirmationUrl string    `json:"confirmation_url"`
+	Error           string    `json:"error"`
+	TransactionId   *int64    `json:"transaction_id"`
+	Created         time.Time `json:"created"`
+	Updated         time.Time `json:"updated"`
+}
+
+//money going back to the card, the balance is debited first and credited back if the provider refuses
+type PaymentRefund struct {
+	Id            int64     `json:"id"`
+	PaymentId     int64     `json:"payment_id"`
+	LoginId       int32     `json:"login_id"`
+	ExternalId    string    `json:"external_id"`
+	Amount        int32     `json:"amount"`
+	Reason        string    `json:"reason"`
+	Status        string    `json:"status"`
+	Error         string    `json:"error"`
+	TransactionId int64     `json:"transaction_id"`
+	ActorId       int32     `json:"actor_id"`
+	Created       time.Time `json:"created"`
+	Updated       time.Time `json:"updated"`
+}
+
+//what the provider says about a payment or a refund
+type ProviderState struct {
+	Refund          bool   `json:"refund"`
+	ExternalId      string `json:"id"`
+	Status          string `json:"status"`
+	Amount          int32  `json:"amount"`
+	ConfirmationUrl string `json:"confirmation_url"`
+}
+
+//a payment gateway, idempotency keys must make every call safe to repeat
+//Webhook checks the signature before anything in the body is believed
+type PaymentProvider interface {
+	Create(ctx context.Context, p *Payment, key string) (ProviderState, error)
+	Get(ctx context.Context, externalId string) (ProviderState, error)
+	Refund(ctx context.Context, r *PaymentRefund, externalPaymentId string, key string) (ProviderState, error)
+	Webhook(header http.Header, body []byte) (ProviderState, error)
+}
+
+var providers struct {
+	sync.Mutex
+	m map[string]PaymentProvider
+}
+
+//real gateways plug in here before StartPayments, PAYMENTS_PROVIDER picks the one new payments go to
+func RegisterProvider(name string, p PaymentProvider) {
+	providers.Lock()
+	defer providers.Unlock()
+	defaultProviders()
+	providers.m[name] = p
+}
+
+func defaultProviders() {
+	if providers.m != nil {
+		return
+	}
+	providers.m = map[string]PaymentProvider{}
+	//without its own key and secret anyone could sign fake webhooks, so it isn't a provider at all
+	if fakeConfigured() == nil {
+		providers.m[ProviderFake] = newFakeClient()
+	}
+}
+
+func providerFor(name string) (PaymentProvider, error) {
+	providers.Lock()
+	defer providers.Unlock()
+	defaultProviders()
+	p, ok := providers.m[name]
+	if !ok {
+		return nil, errors.New("no payment provider " + name)
+	}
+	return p, nil
+}
+
+//there's no default, top-ups are off until PAYMENTS_PROVIDER is set
+func defaultProvider() string {
+	return os.Getenv("PAYMENTS_PROVIDER")
+}
+
+//top-ups outside PAYMENTS_MIN_AMOUNT..PAYMENTS_MAX_AMOUNT are refused
+func paymentLimits() (int32, int32) {
+	min, max := int32(1), int32(1000000)
+	if n, err := strconv.Atoi(os.Getenv("PAYMENTS_MIN_AMOUNT")); err == nil && n > 0 {
+		min = int32(n)
+	}
+	if n, err := strconv.Atoi(os.Getenv("PAYMENTS_MAX_AMOUNT")); err == nil && n > 0 {
+		max = int32(n)
+	}
+	return min, max
+}
+
+//starts a top-up and returns where to send the user to pay
+func CreatePayment(info string) (string, error) {
+	in := struct {
+		LoginId        int32  `json:"login_id"`
+		Amount         int32  `json:"amount"`
+		IdempotencyKey string `json:"idempotency_key"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+	in.IdempotencyKey = strings.TrimSpace(in.IdempotencyKey)
+	if in.IdempotencyKey == "" {
+		return "", errors.New("idempotency_key is required")
+	}
+	if min, max := paymentLimits(); in.Amount < min || in.Amount > max {
+		return "", errors.New("amount must be between " + strconv.Itoa(int(min)) + " and " + strconv.Itoa(int(max)))
+	}
+	name := defaultProvider()
+	if name == "" {
+		return "", errors.New("no payment provider configured")
+	}
+	if _, err := providerFor(name); err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	var exists bool
+	if err = conn.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM logins WHERE id = $1)`, in.LoginId).Scan(&exists); err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", errors.New("login " + strconv.Itoa(int(in.LoginId)) + " not found")
+	}
+
+	//a repeated request gets the payment the first one made, reusing a key for another amount is a client bug
+	p := Payment{LoginId: in.LoginId, Provider: name, IdempotencyKey: in.IdempotencyKey, Amount: in.Amount, Status: PaymentCreated}
+	p.Created, p.Updated = time.Now(), time.Now()
+	err = conn.QueryRow(ctx, `INSERT INTO payments (login_id, provider, idempotency_key, amount, status, created, updated) VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (login_id, idempotency_key) DO NOTHING RETURNING id`,
+		p.LoginId, p.Provider, p.IdempotencyKey, p.Amount, p.Status, p.Created, p.Updated).Scan(&p.Id)
+	if err == pgx.ErrNoRows {
+		if err = pgxscan.Get(ctx, conn, &p, `SELECT * FROM payments WHERE login_id = $1 AND idempotency_key = $2`, in.LoginId, in.IdempotencyKey); err != nil {
+			return "", err
+		}
+		if p.Amount != in.Amount {
+			return "", errors.New("idempotency_key was used for another amount")
+		}
+		//the first attempt may have died before reaching the provider
+		if p.Status != PaymentCreated {
+			return marshalPayment(&p)
+		}
+	} else if err != nil {
+		return "", err
+	}
+
+	provider, err := providerFor(p.Provider)
+	if err != nil {
+		return "", err
+	}
+	s, err := provider.Create(ctx, &p, "payment:"+strconv.FormatInt(p.Id, 10))
+	if err != nil {
+		//left as created, the reconciler tries again with the same key
+		return "", errors.New("payment provider failed: " + err.Error())
+	}
+
+	if err = syncPayment(ctx, conn, p.Id, s); err != nil {
+		return "", err
+	}
+	if err = pgxscan.Get(ctx, conn, &p, `SELECT * FROM payments WHERE id = $1`, p.Id); err != nil {
+		return "", err
+	}
+
+	return marshalPayment(&p)
+}
+
+func marshalPayment(p *Payment) (string, error) {
+	jm, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	return string(jm), nil
+}
+
+//brings a payment in line with the provider, crediting the ledger once when it succeeds
+func syncPayment(ctx context.Context, conn *pgxpool.Pool, id int64, s ProviderState) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var p Payment
+	if err = pgxscan.Get(ctx, tx, &p, `SELECT * FROM payments WHERE id = $1 FOR UPDATE`, id); err != nil {
+		return err
+	}
+	if err = applyPayment(ctx, tx, &p, s); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func applyPayment(ctx context.Context, tx pgx.Tx, p *Payment, s ProviderState) error {
+	if paymentIsFinal(p.Status) {
+		if s.Status != "" && s.Status != p.Status {
+			log.Println("payment " + strconv.FormatInt(p.Id, 10) + " is " + p.Status + ", provider now says " + s.Status)
+		}
+		return nil
+	}
+
+	if p.ExternalId == "" {
+		p.ExternalId = s.ExternalId
+	}
+	if s.ConfirmationUrl != "" {
+		p.ConfirmationUrl = s.ConfirmationUrl
+	}
+
+	switch s.Status {
+	case PaymentSucceeded:
+		if s.Amount != p.Amount {
+			p.Status = PaymentMismatch
+			p.Error = "provider reports " + strconv.Itoa(int(s.Amount))
+			break
+		}
+		t, err := postLedger(ctx, tx, LedgerTransaction{LoginId: p.LoginId, Kind: LedgerTopUp, Amount: p.Amount,
+			Reason: "payment " + strconv.FormatInt(p.Id, 10) + " via " + p.Provider, Ref: "payment:" + strconv.FormatInt(p.Id, 10)})
+		if err != nil {
+			return err
+		}
+		p.Status, p.TransactionId = PaymentSucceeded, &t.Id
+	case PaymentCanceled, PaymentFailed:
+		p.Status = s.Status
+	case PaymentPending, "":
+		p.Status = PaymentPending
+	default:
+		return errors.New("unknown payment status " + s.Status)
+	}
+
+	p.Updated = time.Now()
+	_, err := tx.Exec(ctx, `UPDATE payments SET external_id = $1, status = $2, confirmation_url = $3, error = $4, transaction_id = $5, updated = $6 WHERE id = $7`,
+		p.ExternalId, p.Status, p.ConfirmationUrl, p.Error, p.TransactionId, p.Updated, p.Id)
+	if err != nil {
+		return err
+	}
+
+	return outbox.Write(ctx, tx, TopicPaymentUpdated, outboxKey(p.LoginId), p)
+}
+
+//a signed notification from the provider, anything we don't know of is an error so the provider retries
+func HandlePaymentWebhook(provider string, header http.Header, body []byte) error {
+	pp, err := providerFor(provider)
+	if err != nil {
+		return err
+	}
+	s, err := pp.Webhook(header, body)
+	if err != nil {
+		return err
+	}
+	if s.ExternalId == "" {
+		return errors.New("webhook without an id")
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if s.Refund {
+		var id int64
+		if err = conn.QueryRow(ctx, `SELECT r.id FROM payment_refunds r JOIN payments p ON p.id = r.payment_id WHERE p.provider = $1 AND r.external_id = $2`,
+			provider, s.ExternalId).Scan(&id); err != nil {
+			return err
+		}
+		return syncRefund(ctx, conn, id, s)
+	}
+
+	var id int64
+	if err = conn.QueryRow(ctx, `SELECT id FROM payments WHERE provider = $1 AND external_id = $2`, provider, s.ExternalId).Scan(&id); err != nil {
+		return err
+	}
+	return syncPayment(ctx, conn, id, s)
+}
+
+//sends money back to the card, admins only, the balance must still hold it
+func RefundPayment(info string) (string, error) {
+	in := struct {
+		AdminId   int32  `json:"admin_id"`
+		PaymentId int64  `json:"payment_id"`
+		Amount    int32  `json:"amount"`
+		Reason    string `json:"reason"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(in.Reason) == "" {
+		return "", errors.New("refunds need a reason")
+	}
+	if in.Amount <= 0 {
+		return "", errors.New("amount must be positive")
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if err = checkLedgerAdmin(ctx, conn, in.AdminId); err != nil {
+		return "", err
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var p Payment
+	if err = pgxscan.Get(ctx, tx, &p, `SELECT * FROM payments WHERE id = $1 FOR UPDATE`, in.PaymentId); err != nil {
+		return "", err
+	}
+	if p.Status != PaymentSucceeded {
+		err = errors.New("payment is " + p.Status + ", nothing to refund")
+		return "", err
+	}
+
+	var refunded int32
+	if err = tx.QueryRow(ctx, `SELECT COALESCE(SUM(amount), 0) FROM payment_refunds WHERE payment_id = $1 AND status != $2`, p.Id, PaymentFailed).Scan(&refunded); err != nil {
+		return "", err
+	}
+	if refunded+in.Amount > p.Amount {
+		err = errors.New("only " + strconv.Itoa(int(p.Amount-refunded)) + " is left to refund")
+		return "", err
+	}
+
+	r := PaymentRefund{PaymentId: p.Id, LoginId: p.LoginId, Amount: in.Amount, Reason: strings.TrimSpace(in.Reason), Status: PaymentPending, ActorId: in.AdminId}
+	r.Created, r.Updated = time.Now(), time.Now()
+	err = tx.QueryRow(ctx, `INSERT INTO payment_refunds (payment_id, login_id, amount, reason, status, actor_id, created, updated) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+		r.PaymentId, r.LoginId, r.Amount, r.Reason, r.Status, r.ActorId, r.Created, r.Updated).Scan(&r.Id)
+	if err != nil {
+		return "", err
+	}
+
+	t, err := postLedger(ctx, tx, LedgerTransaction{LoginId: p.LoginId, Kind: LedgerPaymentRefund, Amount: -r.Amount,
+		Reason: r.Reason, Ref: "refund:" + strconv.FormatInt(r.Id, 10), ActorId: in.AdminId})
+	if err != nil {
+		return "", err
+	}
+	r.TransactionId = t.Id
+	if _, err = tx.Exec(ctx, `UPDATE payment_refunds SET transaction_id = $1 WHERE id = $2`, r.TransactionId, r.Id); err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
+	//the balance is already debited, if the provider can't be reached the reconciler asks again
+	if err = sendRefund(ctx, conn, &r, &p); err != nil {
+		log.Println("refund "+strconv.FormatInt(r.Id, 10)+" not sent yet: ", err)
+	}
+	if err = pgxscan.Get(ctx, conn, &r, `SELECT * FROM payment_refunds WHERE id = $1`, r.Id); err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+func sendRefund(ctx context.Context, conn *pgxpool.Pool, r *PaymentRefund, p *Payment) error {
+	provider, err := providerFor(p.Provider)
+	if err != nil {
+		return err
+	}
+	s, err := provider.Refund(ctx, r, p.ExternalId, "refund:"+strconv.FormatInt(r.Id, 10))
+	if err != nil {
+		return err
+	}
+	return syncRefund(ctx, conn, r.Id, s)
+}
+
+//a refund the provider turned down gives the money back to the balance
+func syncRefund(ctx context.Context, conn *pgxpool.Pool, id int64, s ProviderState) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var r PaymentRefund
+	if err = pgxscan.Get(ctx, tx, &r, `SELECT * FROM payment_refunds WHERE id = $1 FOR UPDATE`, id); err != nil {
+		return err
+	}
+	if paymentIsFinal(r.Status) {
+		return nil
+	}
+	if r.ExternalId == "" {
+		r.ExternalId = s.ExternalId
+	}
+
+	switch s.Status {
+	case PaymentSucceeded:
+		r.Status = PaymentSucceeded
+	case PaymentCanceled, PaymentFailed:
+		r.Status = PaymentFailed
+		_, err = postLedger(ctx, tx, LedgerTransaction{LoginId: r.LoginId, Kind: LedgerPaymentRefund, Amount: r.Amount,
+			Reason: "refund " + strconv.FormatInt(r.Id, 10) + " refused by the provider", Ref: "refund:" + strconv.FormatInt(r.Id, 10) + ":reversed"})
+		if err != nil {
+			return err
+		}
+	case PaymentPending, "":
+	default:
+		return errors.New("unknown refund status " + s.Status)
+	}
+
+	r.Updated = time.Now()
+	if _, err = tx.Exec(ctx, `UPDATE payment_refunds SET external_id = $1, status = $2, updated = $3 WHERE id = $4`, r.ExternalId, r.Status, r.Updated, r.Id); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+type Reconciliation struct {
+	Checked  int      `json:"checked"`
+	Changed  int      `json:"changed"`
+	Refunds  int      `json:"refunds"`
+	Failures []string `json:"failures"`
+}
+
+//asks the provider about every payment and refund still open after PAYMENTS_RECONCILE_AFTER_SECONDS
+//covers lost webhooks, crashes between our row and the provider call and refunds that never went out
+func reconcilePayments(ctx context.Context, conn *pgxpool.Pool) (Reconciliation, error) {
+	rec := Reconciliation{Failures: []string{}}
+	before := time.Now().Add(-time.Duration(envFloat("PAYMENTS_RECONCILE_AFTER_SECONDS", 60) * float64(time.Second)))
+
+	var ps []*Payment
+	err := pgxscan.Select(ctx, conn, &ps, `SELECT * FROM payments WHERE status IN ($1, $2) AND updated < $3 ORDER BY id LIMIT 500`,
+		PaymentCreated, PaymentPending, before)
+	if err != nil {
+		return rec, err
+	}
+	for _, p := range ps {
+		rec.Checked++
+		provider, err := providerFor(p.Provider)
+		if err != nil {
+			rec.Failures = append(rec.Failures, err.Error())
+			continue
+		}
+
+		var s ProviderState
+		if p.ExternalId == "" {
+			s, err = provider.Create(ctx, p, "payment:"+strconv.FormatInt(p.Id, 10))
+		} else {
+			s, err = provider.Get(ctx, p.ExternalId)
+		}
+		if err != nil {
+			rec.Failures = append(rec.Failures, "payment "+strconv.FormatInt(p.Id, 10)+": "+err.Error())
+			continue
+		}
+		if err = syncPayment(ctx, conn, p.Id, s); err != nil {
+			rec.Failures = append(rec.Failures, "payment "+strconv.FormatInt(p.Id, 10)+": "+err.Error())
+			continue
+		}
+		if s.Status != p.Status {
+			rec.Changed++
+		}
+	}
+
+	var rs []*PaymentRefund
+	err = pgxscan.Select(ctx, conn, &rs, `SELECT * FROM payment_refunds WHERE status = $1 AND updated < $2 ORDER BY id LIMIT 500`, PaymentPending, before)
+	if err != nil {
+		return rec, err
+	}
+	for _, r := range rs {
+		rec.Refunds++
+		var p Payment
+		if err = pgxscan.Get(ctx, conn, &p, `SELECT * FROM payments WHERE id = $1`, r.PaymentId); err == nil {
+			err = sendRefund(ctx, conn, r, &p)
+		}
+		if err != nil {
+			rec.Failures = append(rec.Failures, "refund "+strconv.FormatInt(r.Id, 10)+": "+err.Error())
+		}
+	}
+
+	return rec, nil
+}
+
+//reconciles every PAYMENTS_RECONCILE_MINUTES, 0 disables it
+func StartReconciler() {
+	minutes := envFloat("PAYMENTS_RECONCILE_MINUTES", 5)
+	if minutes == 0 {
+		return
+	}
+
+	go func() {
+		ctx := context.Background()
+		for {
+			time.Sleep(time.Duration(minutes * float64(time.Minute)))
+			conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+			if err != nil {
+				log.Println("reconciler can't connect: ", err)
+				continue
+			}
+			rec, err := reconcilePayments(ctx, conn)
+			if err != nil {
+				log.Println("reconciling payments failed: ", err)
+			}
+			for _, f := range rec.Failures {
+				log.Println("reconciling payments: ", f)
+			}
+			conn.Close()
+		}
+	}()
+}
+
+//the same pass on demand, admins only
+func ReconcilePayments(info string) (string, error) {
+	in := struct {
+		AdminId int32 `json:"admin_id"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if err = checkLedgerAdmin(ctx, conn, in.AdminId); err != nil {
+		return "", err
+	}
+
+	rec, err := reconcilePayments(ctx, conn)
+	if err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+var paymentSorts = map[string]paging.Key{
+	"id": {Column: "id", Desc: true},
+}
+
+func GetPayments(info string) (string, error) {
+	in := struct {
+		paging.Request
+		LoginId int32    `json:"login_id"`
+		Status  []string `json:"status"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+
+	var w where
+	w.add(`login_id = ` + w.arg(in.LoginId))
+	if len(in.Status) > 0 {
+		w.add(`status = ANY(` + w.arg(in.Status) + `)`)
+	}
+	sort := "id"
+	order, err := w.page(in.Request, paymentSorts, &sort, "id")
+	if err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	found := struct {
+		paging.Page
+		Payments []*Payment `json:"payments"`
+	}{Payments: []*Payment{}}
+	if err = pgxscan.Select(ctx, conn, &found.Payments, `SELECT * FROM payments`+w.sql()+order, w.args...); err != nil {
+		return "", err
+	}
+	found.Page = in.Finish(&found.Payments, sort, func(i int) (string, int64) { return "", found.Payments[i].Id })
+
+	jm, err := json.Marshal(found)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
@@ -0,0 +1,94 @@
+package dbops
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mods/paging"
+)
+
+//AND-ed conditions with numbered placeholders, values never end up in the sql itself
+type where struct {
+	conds []string
+	args  []interface{}
+}
+
+func (w *where) arg(v interface{}) string {
+	w.args = append(w.args, v)
+	return "$" + strconv.Itoa(len(w.args))
+}
+
+func (w *where) add(cond string) {
+	w.conds = append(w.conds, cond)
+}
+
+//column = ANY(ids), skipped when there are none
+func (w *where) in(column string, ids []int) {
+	if len(ids) > 0 {
+		w.add(column + " = ANY(" + w.arg(ids) + ")")
+	}
+}
+
+func (w *where) sql() string {
+	if len(w.conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(w.conds, " AND ")
+}
+
+//narrows the query to the requested page, returns its ORDER BY and LIMIT
+//unknown sort names fall back to def
+func (w *where) page(p paging.Request, sorts map[string]paging.Key, sort *string, def string) (string, error) {
+	k, ok := sorts[*sort]
+	if !ok {
+		*sort = def
+		k = sorts[def]
+	}
+
+	cond, order, err := p.Plan(*sort, k, w.arg)
+	if err != nil {
+		return "", err
+	}
+	if cond != "" {
+		w.add(cond)
+	}
+	return order, nil
+}
+
+//lists from before paging only page when asked to with a limit or a cursor, like cats read_all
+func paged(p paging.Request) bool {
+	return p.Limit > 0 || p.Cursor != ""
+}
+
+//page when asked to, otherwise the whole list in the same order a page would have
+func (w *where) pageIfAsked(p paging.Request, sorts map[string]paging.Key, sort *string, def string) (string, bool, error) {
+	if paged(p) {
+		order, err := w.page(p, sorts, sort, def)
+		return order, true, err
+	}
+
+	k, ok := sorts[*sort]
+	if !ok {
+		*sort = def
+		k = sorts[def]
+	}
+	dir := " ASC"
+	if k.Desc {
+		dir = " DESC"
+	}
+	order := " ORDER BY "
+	if k.Column != "id" {
+		order += k.Column + dir + ", "
+	}
+	return order + "id" + dir, false, nil
+}
+
+//cursor values, times keep microseconds so they compare equal to what postgres stores
+func timeKey(t time.Time) string {
+	return t.Format(time.RFC3339Nano)
+}
+
+func intKey(i int64) string {
+	return strconv.FormatInt(i, 10)
+}
@@ -0,0 +1,63 @@
+package dbops
+
+import (
+	"testing"
+
+	"go.mods/paging"
+)
+
+var testSorts = map[string]paging.Key{
+	"id":    {Column: "id", Desc: true},
+	"price": {Column: "price", Cast: "integer"},
+}
+
+func TestWhere(t *testing.T) {
+	var w where
+	if w.sql() != "" {
+		t.Errorf("empty where: %q", w.sql())
+	}
+	w.add("town_id = " + w.arg(3))
+	w.in("service_id", nil)
+	w.in("service_id", []int{1, 2})
+	if got := w.sql(); got != " WHERE town_id = $1 AND service_id = ANY($2)" || len(w.args) != 2 {
+		t.Errorf("got %q %v", got, w.args)
+	}
+}
+
+func TestPageIfAsked(t *testing.T) {
+	cases := []struct {
+		name  string
+		req   paging.Request
+		sort  string
+		order string
+		paged bool
+		conds int
+	}{
+		{"whole list", paging.Request{}, "id", " ORDER BY id DESC", false, 0},
+		{"whole list by price", paging.Request{}, "price", " ORDER BY price ASC, id ASC", false, 0},
+		{"unknown sort", paging.Request{}, "rating", " ORDER BY id DESC", false, 0},
+		{"a limit asks for a page", paging.Request{Limit: 5}, "price", " ORDER BY price ASC, id ASC LIMIT 6", true, 0},
+		{"a cursor asks for a page", paging.Request{Cursor: paging.Encode(paging.Cursor{Sort: "id", Id: 9})}, "id", " ORDER BY id DESC LIMIT 21", true, 1},
+	}
+	for _, c := range cases {
+		var w where
+		sort := c.sort
+		order, isPaged, err := w.pageIfAsked(c.req, testSorts, &sort, "id")
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if order != c.order || isPaged != c.paged || len(w.conds) != c.conds {
+			t.Errorf("%s: got %q %v %v", c.name, order, isPaged, w.conds)
+		}
+		if _, ok := testSorts[sort]; !ok {
+			t.Errorf("%s: sort left at %q", c.name, sort)
+		}
+	}
+
+	var w where
+	sort := "price"
+	if _, _, err := w.pageIfAsked(paging.Request{Cursor: paging.Encode(paging.Cursor{Sort: "id", Id: 9})}, testSorts, &sort, "id"); err == nil {
+		t.Error("a cursor of another sort was accepted")
+	}
+}
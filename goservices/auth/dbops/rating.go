@@ -0,0 +1,156 @@
+package dbops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+//knobs of the ranking score, each one comes from RATING_* in the env
+type ratingModel struct {
+	PriorWeight    float64 `json:"prior_weight"`
+	PriorMean      float64 `json:"prior_mean"`
+	HalfLifeDays   float64 `json:"half_life_days"`
+	CompletedBonus float64 `json:"completed_bonus"`
+	CompletedCap   float64 `json:"completed_cap"`
+}
+
+func envFloat(key string, def float64) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil && v >= 0 {
+		return v
+	}
+	return def
+}
+
+func newRatingModel() ratingModel {
+	m := ratingModel{
+		//as if every master started with this many average reviews
+		PriorWeight: envFloat("RATING_PRIOR_WEIGHT", 5),
+		//the average used before there are any reviews at all
+		PriorMean: envFloat("RATING_PRIOR_MEAN", 3.5),
+		//a review this old counts half
+		HalfLifeDays: envFloat("RATING_HALFLIFE_DAYS", 365),
+		//added at CompletedCap completed orders, less below it on a log curve
+		CompletedBonus: envFloat("RATING_COMPLETED_BONUS", 0.25),
+		CompletedCap:   envFloat("RATING_COMPLETED_CAP", 50),
+	}
+	if m.HalfLifeDays == 0 {
+		m.HalfLifeDays = 365
+	}
+	if m.CompletedCap < 1 {
+		m.CompletedCap = 1
+	}
+	return m
+}
+
+//score = (prior_weight * prior_mean + sum(w * v)) / (prior_weight + sum(w)) + completed bonus, at most 5
+//v is the mean of the criteria a review scored, w halves every half_life_days
+//prior_mean is the mean over all visible reviews, RATING_PRIOR_MEAN only stands in when there are none
+var scoreUpdate = `WITH r AS (
+		SELECT master_id,
+			(politeness + punctuality + speed + balance + overall)::float8
+				/ NULLIF((politeness > 0)::int + (punctuality > 0)::int + (speed > 0)::int + (balance > 0)::int + (overall > 0)::int, 0) AS v,
+			power(0.5, GREATEST(EXTRACT(EPOCH FROM ($1::timestamptz - created))::float8, 0) / 86400 / $2::float8) AS w
+		FROM comments WHERE ` + visibleSql(ContentReview, "comments.id") + `
+	),
+	prior AS (SELECT COALESCE(AVG(v), $3::float8) AS m FROM r),
+	agg AS (SELECT master_id, SUM(w * v) AS sv, SUM(w) AS sw FROM r WHERE v IS NOT NULL GROUP BY master_id),
+	done AS (SELECT master_id, COUNT(*) AS n FROM orders WHERE status = 'completed' AND master_id != 0 GROUP BY master_id)
+	INSERT INTO master_ratings (login_id, score, completed, scored, updated)
+	SELECT l.id,
+		COALESCE(LEAST(5, (p.m * $4::float8 + COALESCE(a.sv, 0)) / NULLIF($4::float8 + COALESCE(a.sw, 0), 0)
+			+ $5::float8 * LEAST(1, ln(1 + COALESCE(d.n, 0)) / ln(1 + $6::float8))), 0),
+		COALESCE(d.n, 0), $1, $1
+	FROM logins l CROSS JOIN prior p
+	LEFT JOIN agg a ON a.master_id = l.id
+	LEFT JOIN done d ON d.master_id = l.id
+	WHERE l.level = 2 AND ($7::int = 0 OR l.id = $7::int)
+	ORDER BY l.id
+	ON CONFLICT (login_id) DO UPDATE SET score = EXCLUDED.score, completed = EXCLUDED.completed, scored = EXCLUDED.scored`
+
+//rescores one master, or all of them when masterId is 0, rows go in login id order so concurrent rescores lock them the same way
+func rescore(ctx context.Context, tx pgx.Tx, masterId int32) (int64, error) {
+	m := newRatingModel()
+	ct, err := tx.Exec(ctx, scoreUpdate, time.Now(), m.HalfLifeDays, m.PriorMean, m.PriorWeight, m.CompletedBonus, m.CompletedCap, masterId)
+	if err != nil {
+		return 0, err
+	}
+	return ct.RowsAffected(), nil
+}
+
+//one full rescore at a time across all auth instances
+const rescoreLock = 4204201
+
+var errRescoreBusy = errors.New("ratings are being recomputed by another instance")
+
+func recomputeScores(ctx context.Context) (int64, error) {
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	//another instance is at it already, its result is as good as ours
+	var locked bool
+	if err = tx.QueryRow(ctx, `SELECT pg_try_advisory_xact_lock($1)`, rescoreLock).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, errRescoreBusy
+	}
+
+	n, err := rescore(ctx, tx, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, tx.Commit(ctx)
+}
+
+//rescores everybody now, the periodic job does the same
+func RecomputeRatings(info string) (string, error) {
+	n, err := recomputeScores(context.Background())
+	if err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(struct {
+		Masters int64       `json:"masters"`
+		Model   ratingModel `json:"model"`
+	}{n, newRatingModel()})
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+//rescores all masters every RATING_RECOMPUTE_MINUTES so recency decay keeps moving without new reviews, 0 turns it off
+func StartRatingJob() {
+	minutes := envFloat("RATING_RECOMPUTE_MINUTES", 60)
+	if minutes == 0 {
+		return
+	}
+
+	go func() {
+		for {
+			if _, err := recomputeScores(context.Background()); err != nil && err != errRescoreBusy {
+				log.Println("rating recompute failed: ", err)
+			}
+			time.Sleep(time.Duration(minutes * float64(time.Minute)))
+		}
+	}()
+}
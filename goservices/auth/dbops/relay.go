@@ -0,0 +1,291 @@
+package dbops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"go.mods/outbox"
+	"go.mods/paging"
+)
+
+//consumers of the outbox, all of them work inside the relay's transaction so they see each message once in effect
+var relay = outbox.NewRelay()
+
+//relays every OUTBOX_POLL_MS, a message failing OUTBOX_MAX_ATTEMPTS times in a row goes to outbox_dead
+func StartRelay() {
+	if ms, err := strconv.Atoi(os.Getenv("OUTBOX_POLL_MS")); err == nil && ms > 0 {
+		relay.Poll = time.Duration(ms) * time.Millisecond
+	}
+	if n, err := strconv.Atoi(os.Getenv("OUTBOX_MAX_ATTEMPTS")); err == nil && n > 0 {
+		relay.MaxAttempts = int32(n)
+	}
+
+	relay.Register("notifications", []string{topicEvent}, notifyConsumer)
+	relay.Register("audit", nil, auditConsumer)
+	relay.Register("search", []string{"order", "login", "cat"}, searchConsumer)
+	relay.Register("billing", []string{TopicLedgerPosted}, billingConsumer)
+	relay.Start(os.Getenv("DATABASE_URL"))
+}
+
+func notifyConsumer(ctx context.Context, tx pgx.Tx, m outbox.Message) error {
+	var e Event
+	if err := json.Unmarshal(m.Payload, &e); err != nil {
+		return err
+	}
+	_, err := queueEvent(ctx, tx, &e)
+	return err
+}
+
+//the audit log keeps every message, a redelivered one is already there
+func auditConsumer(ctx context.Context, tx pgx.Tx, m outbox.Message) error {
+	_, err := tx.Exec(ctx, `INSERT INTO audit_log (message_id, topic, key, payload, created) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (message_id) DO NOTHING`,
+		m.Id, m.Topic, m.Key, m.Payload, m.Created)
+	return err
+}
+
+//the index is rebuilt from the rows as they are now, so an old or repeated message can't leave it stale
+func searchConsumer(ctx context.Context, tx pgx.Tx, m outbox.Message) error {
+	kind := m.Topic[:strings.Index(m.Topic+".", ".")]
+
+	//an import touches any number of categories
+	if m.Topic == "cat.imported" {
+		return indexAllCats(ctx, tx)
+	}
+
+	id, err := strconv.Atoi(m.Key)
+	if err != nil {
+		return errors.New("bad key " + m.Key + " on " + m.Topic)
+	}
+
+	switch kind {
+	case "order":
+		return indexDocument(ctx, tx, SearchOrder, id, `SELECT title, description AS body, region_id FROM orders WHERE id = $1 AND status = ANY($2)`,
+			[]string{OrderPublished, OrderInNegotiation})
+	case "login":
+		return indexDocument(ctx, tx, SearchMaster, id, `SELECT concat_ws(' ', first_name, last_name) AS title, about AS body, region_id FROM logins WHERE id = $1 AND level = 2`)
+	case "cat":
+		return indexDocument(ctx, tx, SearchCat, id, searchCat+` WHERE id = $1`)
+	}
+	return nil
+}
+
+//kinds in the search index
+const (
+	SearchOrder  = "order"
+	SearchMaster = "master"
+	SearchCat    = "cat"
+)
+
+const searchCat = `SELECT concat_ws(' ', name, title, h1) AS title, concat_ws(' ', description, keywords) AS body, 0 AS region_id FROM cats`
+
+//the index and Search must use the same expression
+const searchVector = `to_tsvector('russian', title || ' ' || body)`
+
+type searchSource struct {
+	Title    string
+	Body     string
+	RegionId int32
+}
+
+//upserts the document from source, or drops it when source finds nothing any more
+func indexDocument(ctx context.Context, tx pgx.Tx, kind string, id int, source string, args ...interface{}) error {
+	var src []*searchSource
+	if err := pgxscan.Select(ctx, tx, &src, source, append([]interface{}{id}, args...)...); err != nil {
+		return err
+	}
+
+	if len(src) == 0 {
+		_, err := tx.Exec(ctx, `DELETE FROM search_documents WHERE kind = $1 AND item_id = $2`, kind, id)
+		return err
+	}
+
+	_, err := tx.Exec(ctx, `INSERT INTO search_documents (kind, item_id, title, body, region_id, updated) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (kind, item_id) DO UPDATE SET title = EXCLUDED.title, body = EXCLUDED.body, region_id = EXCLUDED.region_id, updated = EXCLUDED.updated`,
+		kind, id, src[0].Title, src[0].Body, src[0].RegionId, time.Now())
+	return err
+}
+
+func indexAllCats(ctx context.Context, tx pgx.Tx) error {
+	if _, err := tx.Exec(ctx, `DELETE FROM search_documents WHERE kind = $1`, SearchCat); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, `INSERT INTO search_documents (kind, item_id, title, body, region_id, updated)
+		SELECT $1, id, s.title, s.body, 0, $2 FROM (`+strings.Replace(searchCat, "SELECT ", "SELECT id, ", 1)+`) s`, SearchCat, time.Now())
+	return err
+}
+
+type SearchHit struct {
+	Kind     string  `json:"kind"`
+	ItemId   int32   `json:"item_id"`
+	Title    string  `json:"title"`
+	RegionId int32   `json:"region_id"`
+	Rank     float64 `json:"rank"`
+}
+
+//full text search over open orders, masters and categories, best match first
+func Search(info string) (string, error) {
+	in := struct {
+		Query    string   `json:"query"`
+		Kinds    []string `json:"kinds"`
+		RegionId int32    `json:"region_id"`
+		Limit    int      `json:"limit"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(in.Query) == "" {
+		return "", errors.New("query is empty")
+	}
+	if in.Limit < 1 || in.Limit > paging.MaxLimit {
+		in.Limit = paging.DefaultLimit
+	}
+
+	var w where
+	q := w.arg(in.Query)
+	w.add(searchVector + ` @@ plainto_tsquery('russian', ` + q + `)`)
+	if len(in.Kinds) > 0 {
+		w.add(`kind = ANY(` + w.arg(in.Kinds) + `)`)
+	}
+	if in.RegionId != 0 {
+		w.add(`region_id IN (0, ` + w.arg(in.RegionId) + `)`)
+	}
+	//hidden items stay indexed, a moderator may bring them back
+	w.add(`(d.kind != 'order' OR ` + visibleSql(ContentOrder, "d.item_id") + `)`)
+	w.add(`(d.kind != 'master' OR ` + visibleSql(ContentProfile, "d.item_id") + `)`)
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	found := struct {
+		Hits []*SearchHit `json:"hits"`
+	}{[]*SearchHit{}}
+	err = pgxscan.Select(ctx, conn, &found.Hits, `SELECT kind, item_id, title, region_id, ts_rank(`+searchVector+`, plainto_tsquery('russian', `+q+`))::float8 AS rank
+		FROM search_documents d`+w.sql()+` ORDER BY rank DESC, kind, item_id LIMIT `+strconv.Itoa(in.Limit), w.args...)
+	if err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(found)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+type AuditEntry struct {
+	Id        int64           `json:"id"`
+	MessageId int64           `json:"message_id"`
+	Topic     string          `json:"topic"`
+	Key       string          `json:"key"`
+	Payload   json.RawMessage `json:"payload"`
+	Created   time.Time       `json:"created"`
+}
+
+var auditSorts = map[string]paging.Key{
+	"id": {Column: "id", Desc: true},
+}
+
+//moderators only, topic "order" covers order.created, order.updated and so on
+func GetAuditLog(info string) (string, error) {
+	in := struct {
+		paging.Request
+		ModeratorId int32  `json:"moderator_id"`
+		Topic       string `json:"topic"`
+		Key         string `json:"key"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if err = checkModerator(ctx, conn, in.ModeratorId); err != nil {
+		return "", err
+	}
+
+	var w where
+	if in.Topic != "" {
+		w.add(`(topic = ` + w.arg(in.Topic) + ` OR topic LIKE ` + w.arg(in.Topic+".%") + `)`)
+	}
+	if in.Key != "" {
+		w.add(`key = ` + w.arg(in.Key))
+	}
+	sort := "id"
+	order, err := w.page(in.Request, auditSorts, &sort, "id")
+	if err != nil {
+		return "", err
+	}
+
+	found := struct {
+		paging.Page
+		Entries []*AuditEntry `json:"entries"`
+	}{Entries: []*AuditEntry{}}
+	if err = pgxscan.Select(ctx, conn, &found.Entries, `SELECT * FROM audit_log`+w.sql()+order, w.args...); err != nil {
+		return "", err
+	}
+	found.Page = in.Finish(&found.Entries, sort, func(i int) (string, int64) { return "", found.Entries[i].Id })
+
+	jm, err := json.Marshal(found)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+type OutboxConsumer struct {
+	Consumer string    `json:"consumer"`
+	LastId   int64     `json:"last_id"`
+	Attempts int32     `json:"attempts"`
+	Error    string    `json:"error"`
+	Updated  time.Time `json:"updated"`
+	Lag      int64     `json:"lag"`
+	Dead     int64     `json:"dead"`
+}
+
+//how far behind each consumer is and what it gave up on
+func GetOutboxStatus(info string) (string, error) {
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	found := struct {
+		Consumers []*OutboxConsumer `json:"consumers"`
+	}{[]*OutboxConsumer{}}
+	err = pgxscan.Select(ctx, conn, &found.Consumers, `SELECT o.*,
+			(SELECT COUNT(*) FROM outbox WHERE id > o.last_id) AS lag,
+			(SELECT COUNT(*) FROM outbox_dead d WHERE d.consumer = o.consumer) AS dead
+		FROM outbox_offsets o ORDER BY consumer`)
+	if err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(found)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
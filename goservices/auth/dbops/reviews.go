@@ -0,0 +1,357 @@
+package dbops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+//what a master's reviews add up to, a criterion nobody scored has count 0
+type MasterRating struct {
+	LoginId          int32     `json:"login_id"`
+	Reviews          int32     `json:"reviews"`
+	Politeness       float64   `json:"politeness"`
+	PolitenessCount  int32     `json:"politeness_count"`
+	Punctuality      float64   `json:"punctuality"`
+	PunctualityCount int32     `json:"punctuality_count"`
+	Speed            float64   `json:"speed"`
+	SpeedCount       int32     `json:"speed_count"`
+	Balance          float64   `json:"balance"`
+	BalanceCount     int32     `json:"balance_count"`
+	Overall          float64   `json:"overall"`
+	OverallCount     int32     `json:"overall_count"`
+	Updated          time.Time `json:"updated"`
+	//the ranking score, see rating.go
+	Score     float64    `json:"score"`
+	Completed int32      `json:"completed"`
+	Scored    *time.Time `json:"scored"`
+}
+
+//scores run from 1 to 5, 0 means the criterion was left out
+const maxScore = 5
+
+func checkScores(c *Comment) error {
+	scores := []*int16{&c.Politeness, &c.Punctuality, &c.Speed, &c.Balance, &c.Overall}
+	for _, s := range scores {
+		if *s < 0 || *s > maxScore {
+			return errors.New("scores go from 1 to 5")
+		}
+	}
+
+	//no overall given, take it from the other criteria
+	if c.Overall == 0 {
+		sum, n := 0, 0
+		for _, s := range scores[:4] {
+			if *s > 0 {
+				sum += int(*s)
+				n++
+			}
+		}
+		if n == 0 {
+			return errors.New("a review needs at least one score")
+		}
+		c.Overall = int16(math.Round(float64(sum) / float64(n)))
+	}
+
+	return nil
+}
+
+//averages only count visible reviews that scored the criterion
+var ratingAggregate = `INSERT INTO master_ratings AS r (login_id, reviews,
+		politeness, politeness_count, punctuality, punctuality_count, speed, speed_count,
+		balance, balance_count, overall, overall_count, updated)
+	SELECT $1, COUNT(*),
+		COALESCE(AVG(politeness) FILTER (WHERE politeness > 0), 0), COUNT(*) FILTER (WHERE politeness > 0),
+		COALESCE(AVG(punctuality) FILTER (WHERE punctuality > 0), 0), COUNT(*) FILTER (WHERE punctuality > 0),
+		COALESCE(AVG(speed) FILTER (WHERE speed > 0), 0), COUNT(*) FILTER (WHERE speed > 0),
+		COALESCE(AVG(balance) FILTER (WHERE balance > 0), 0), COUNT(*) FILTER (WHERE balance > 0),
+		COALESCE(AVG(overall) FILTER (WHERE overall > 0), 0), COUNT(*) FILTER (WHERE overall > 0),
+		$2
+	FROM comments WHERE master_id = $1 AND ` + visibleSql(ContentReview, "comments.id") + `
+	ON CONFLICT (login_id) DO UPDATE SET reviews = EXCLUDED.reviews,
+		politeness = EXCLUDED.politeness, politeness_count = EXCLUDED.politeness_count,
+		punctuality = EXCLUDED.punctuality, punctuality_count = EXCLUDED.punctuality_count,
+		speed = EXCLUDED.speed, speed_count = EXCLUDED.speed_count,
+		balance = EXCLUDED.balance, balance_count = EXCLUDED.balance_count,
+		overall = EXCLUDED.overall, overall_count = EXCLUDED.overall_count,
+		updated = EXCLUDED.updated`
+
+//rebuilds master_ratings and logins.rating from the master's reviews inside the caller's transaction
+//the logins row lock keeps two reviews of the same master from recomputing at once
+func recomputeRating(ctx context.Context, tx pgx.Tx, masterId int32) error {
+	if _, err := tx.Exec(ctx, `SELECT id FROM logins WHERE id = $1 FOR UPDATE`, masterId); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, ratingAggregate, masterId, time.Now()); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec(ctx, `UPDATE logins SET rating = (SELECT ROUND(overall) FROM master_ratings WHERE login_id = $1) WHERE id = $1`, masterId)
+	if err != nil {
+		return err
+	}
+
+	_, err = rescore(ctx, tx, masterId)
+	return err
+}
+
+//the customer of a completed order reviews its master, once
+func AddReview(info string) (string, error) {
+	var c Comment
+	if err := json.Unmarshal([]byte(info), &c); err != nil {
+		return "", err
+	}
+	c.Text = strings.TrimSpace(c.Text)
+	if err := checkScores(&c); err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	//the order lock makes the once-per-order check race free
+	var o Order
+	if err = pgxscan.Get(ctx, tx, &o, `SELECT * FROM orders WHERE id = $1 FOR UPDATE`, c.OrderId); err != nil {
+		return "", err
+	}
+	if o.LoginId != c.ClientId {
+		err = errors.New("only the customer can review an order")
+		return "", err
+	}
+	if o.Status != OrderCompleted {
+		err = errors.New("order is " + o.Status + ", only completed orders can be reviewed")
+		return "", err
+	}
+	if o.MasterId == 0 {
+		err = errors.New("order has no master to review")
+		return "", err
+	}
+
+	var n int
+	if err = tx.QueryRow(ctx, `SELECT COUNT(*) FROM comments WHERE order_id = $1`, o.Id).Scan(&n); err != nil {
+		return "", err
+	}
+	if n > 0 {
+		err = errors.New("order is already reviewed")
+		return "", err
+	}
+
+	c.MasterId = o.MasterId
+	c.Created = time.Now()
+	if err = tx.QueryRow(ctx, `SELECT first_name FROM logins WHERE id = $1`, c.ClientId).Scan(&c.ClientName); err != nil {
+		return "", err
+	}
+
+	row := tx.QueryRow(ctx, `INSERT INTO comments (master_id, client_id, order_id, client_name, politeness, punctuality, speed, balance, overall, text, created) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`,
+		c.MasterId, c.ClientId, c.OrderId, c.ClientName, c.Politeness, c.Punctuality, c.Speed, c.Balance, c.Overall, c.Text, c.Created)
+	if err = row.Scan(&c.Id); err != nil {
+		return "", err
+	}
+
+	if err = screen(ctx, tx, ContentReview, c.Id, c.Text); err != nil {
+		return "", err
+	}
+
+	if err = recomputeRating(ctx, tx, c.MasterId); err != nil {
+		return "", err
+	}
+
+	if err = emitEvent(ctx, tx, Event{Kind: EventNewReview, LoginId: c.MasterId, OrderId: c.OrderId, Payload: payload(c)}); err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+//the author changes scores and text, the reply stays
+func EditReview(info string) (string, error) {
+	var in Comment
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+	in.Text = strings.TrimSpace(in.Text)
+	if err := checkScores(&in); err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var c Comment
+	if err = pgxscan.Get(ctx, tx, &c, `SELECT * FROM comments WHERE id = $1 FOR UPDATE`, in.Id); err != nil {
+		return "", err
+	}
+	if c.ClientId != in.ClientId {
+		err = errors.New("only the author can edit a review")
+		return "", err
+	}
+
+	now := time.Now()
+	c.Politeness, c.Punctuality, c.Speed, c.Balance, c.Overall, c.Text, c.Edited = in.Politeness, in.Punctuality, in.Speed, in.Balance, in.Overall, in.Text, &now
+	_, err = tx.Exec(ctx, `UPDATE comments SET politeness = $1, punctuality = $2, speed = $3, balance = $4, overall = $5, text = $6, edited = $7 WHERE id = $8`,
+		c.Politeness, c.Punctuality, c.Speed, c.Balance, c.Overall, c.Text, c.Edited, c.Id)
+	if err != nil {
+		return "", err
+	}
+
+	if err = screen(ctx, tx, ContentReview, c.Id, c.Text); err != nil {
+		return "", err
+	}
+
+	if err = recomputeRating(ctx, tx, c.MasterId); err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+//the reviewed master answers publicly, answering again replaces the reply
+func ReplyToReview(info string) (string, error) {
+	in := struct {
+		Id       int32  `json:"id"`
+		MasterId int32  `json:"master_id"`
+		Reply    string `json:"reply"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+	in.Reply = strings.TrimSpace(in.Reply)
+	if in.Reply == "" {
+		return "", errors.New("reply is empty")
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var c Comment
+	if err = pgxscan.Get(ctx, tx, &c, `SELECT * FROM comments WHERE id = $1 FOR UPDATE`, in.Id); err != nil {
+		return "", err
+	}
+	if c.MasterId != in.MasterId {
+		err = errors.New("only the reviewed master can reply")
+		return "", err
+	}
+
+	now := time.Now()
+	c.Reply, c.Replied = in.Reply, &now
+	if _, err = tx.Exec(ctx, `UPDATE comments SET reply = $1, replied = $2 WHERE id = $3`, c.Reply, c.Replied, c.Id); err != nil {
+		return "", err
+	}
+
+	if err = screen(ctx, tx, ContentReply, c.Id, c.Reply); err != nil {
+		return "", err
+	}
+
+	//a held reply reaches the customer only through the review page once it's approved
+	var visible bool
+	if err = tx.QueryRow(ctx, `SELECT `+visibleSql(ContentReply, "$1::int"), c.Id).Scan(&visible); err != nil {
+		return "", err
+	}
+	if visible {
+		if err = emitEvent(ctx, tx, Event{Kind: EventReviewReply, LoginId: c.ClientId, OrderId: c.OrderId, Payload: payload(c)}); err != nil {
+			return "", err
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
+	jm, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
+
+func GetMasterRating(info string) (string, error) {
+	in := struct {
+		LoginId int32 `json:"login_id"`
+	}{}
+	if err := json.Unmarshal([]byte(info), &in); err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	var rs []*MasterRating
+	if err = pgxscan.Select(ctx, conn, &rs, `SELECT * FROM master_ratings WHERE login_id = $1`, in.LoginId); err != nil {
+		return "", err
+	}
+
+	//masters nobody reviewed yet
+	r := &MasterRating{LoginId: in.LoginId}
+	if len(rs) > 0 {
+		r = rs[0]
+	}
+
+	jm, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jm), nil
+}
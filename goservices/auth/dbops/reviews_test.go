@@ -0,0 +1,31 @@
+package dbops
+
+import "testing"
+
+func TestCheckScores(t *testing.T) {
+	cases := []struct {
+		name    string
+		in      Comment
+		overall int16
+		ok      bool
+	}{
+		{"all given", Comment{Politeness: 5, Punctuality: 4, Speed: 3, Balance: 2, Overall: 1}, 1, true},
+		{"overall only", Comment{Overall: 4}, 4, true},
+		{"overall from the rest", Comment{Politeness: 5, Punctuality: 4}, 5, true},
+		{"rounded half up", Comment{Politeness: 4, Punctuality: 3}, 4, true},
+		{"skipped criteria don't count", Comment{Politeness: 2, Speed: 0, Balance: 3}, 3, true},
+		{"nothing scored", Comment{}, 0, false},
+		{"above 5", Comment{Speed: 6, Overall: 5}, 5, false},
+		{"negative", Comment{Balance: -1, Overall: 5}, 5, false},
+	}
+	for _, c := range cases {
+		err := checkScores(&c.in)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if c.in.Overall != c.overall {
+			t.Errorf("%s: overall %d, want %d", c.name, c.in.Overall, c.overall)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package dbops
+
+import (
+	"context"
+	"os"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"go.mods/outbox"
+)
+
+//full text search over orders, the index and GetOrders must use the same expression
+const orderSearchVector = `to_tsvector('russian', title || ' ' || description)`
+
+//changes on top of the initial dump, every statement must be safe to run again on each start
+var migrations = []string{
+	`ALTER TABLE orders ADD COLUMN IF NOT EXISTS attributes jsonb DEFAULT '{}'::jsonb NOT NULL`,
+	`DO $$ BEGIN
+		IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'orders' AND column_name = 'status') THEN
+			ALTER TABLE orders ADD COLUMN status text DEFAULT 'published' NOT NULL;
+			UPDATE orders SET status = 'completed' WHERE completed;
+		END IF;
+	END $$`,
+	`CREATE TABLE IF NOT EXISTS order_transitions (
+		id serial PRIMARY KEY,
+		order_id integer NOT NULL,
+		from_status text NOT NULL,
+		to_status text NOT NULL,
+		login_id integer DEFAULT 0 NOT NULL,
+		reason text DEFAULT ''::text NOT NULL,
+		created timestamp with time zone NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS order_transitions_order_id_idx ON order_transitions (order_id)`,
+	`ALTER TABLE orders ADD COLUMN IF NOT EXISTS master_id integer DEFAULT 0 NOT NULL`,
+	`CREATE TABLE IF NOT EXISTS events (
+		id bigserial PRIMARY KEY,
+		kind text NOT NULL,
+		login_id integer DEFAULT 0 NOT NULL,
+		order_id integer DEFAULT 0 NOT NULL,
+		offer_id integer DEFAULT 0 NOT NULL,
+		payload jsonb DEFAULT '{}'::jsonb NOT NULL,
+		created timestamp with time zone NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS events_login_id_idx ON events (login_id, id)`,
+	`CREATE INDEX IF NOT EXISTS orders_search_idx ON orders USING gin (` + orderSearchVector + `)`,
+	`ALTER TABLE comments ADD COLUMN IF NOT EXISTS edited timestamp with time zone`,
+	`ALTER TABLE comments ADD COLUMN IF NOT EXISTS reply text DEFAULT ''::text NOT NULL`,
+	`ALTER TABLE comments ADD COLUMN IF NOT EXISTS replied timestamp with time zone`,
+	`CREATE INDEX IF NOT EXISTS comments_master_id_idx ON comments (master_id)`,
+	`CREATE INDEX IF NOT EXISTS comments_order_id_idx ON comments (order_id)`,
+	`CREATE TABLE IF NOT EXISTS master_ratings (
+		login_id integer PRIMARY KEY,
+		reviews integer DEFAULT 0 NOT NULL,
+		politeness numeric(3,2) DEFAULT 0 NOT NULL,
+		politeness_count integer DEFAULT 0 NOT NULL,
+		punctuality numeric(3,2) DEFAULT 0 NOT NULL,
+		punctuality_count integer DEFAULT 0 NOT NULL,
+		speed numeric(3,2) DEFAULT 0 NOT NULL,
+		speed_count integer DEFAULT 0 NOT NULL,
+		balance numeric(3,2) DEFAULT 0 NOT NULL,
+		balance_count integer DEFAULT 0 NOT NULL,
+		overall numeric(3,2) DEFAULT 0 NOT NULL,
+		overall_count integer DEFAULT 0 NOT NULL,
+		updated timestamp with time zone NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS moderation (
+		id serial PRIMARY KEY,
+		kind text NOT NULL,
+		item_id integer NOT NULL,
+		status text NOT NULL,
+		held boolean DEFAULT false NOT NULL,
+		reason text DEFAULT ''::text NOT NULL,
+		updated timestamp with time zone NOT NULL,
+		UNIQUE (kind, item_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS moderation_status_idx ON moderation (status, id)`,
+	`CREATE TABLE IF NOT EXISTS content_reports (
+		id serial PRIMARY KEY,
+		kind text NOT NULL,
+		item_id integer NOT NULL,
+		reporter_id integer NOT NULL,
+		reason text NOT NULL,
+		resolved boolean DEFAULT false NOT NULL,
+		created timestamp with time zone NOT NULL
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS content_reports_open_idx ON content_reports (kind, item_id, reporter_id) WHERE NOT resolved`,
+	`CREATE TABLE IF NOT EXISTS moderation_actions (
+		id serial PRIMARY KEY,
+		kind text NOT NULL,
+		item_id integer NOT NULL,
+		moderator_id integer DEFAULT 0 NOT NULL,
+		from_status text NOT NULL,
+		to_status text NOT NULL,
+		reason text NOT NULL,
+		created timestamp with time zone NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS moderation_actions_item_idx ON moderation_actions (kind, item_id)`,
+	`ALTER TABLE master_ratings ADD COLUMN IF NOT EXISTS score numeric(6,4) DEFAULT 0 NOT NULL`,
+	`ALTER TABLE master_ratings ADD COLUMN IF NOT EXISTS completed integer DEFAULT 0 NOT NULL`,
+	`ALTER TABLE master_ratings ADD COLUMN IF NOT EXISTS scored timestamp with time zone`,
+	`CREATE INDEX IF NOT EXISTS master_ratings_score_idx ON master_ratings (score DESC, login_id DESC)`,
+	`CREATE TABLE IF NOT EXISTS threads (
+		id serial PRIMARY KEY,
+		order_id integer NOT NULL,
+		offer_id integer NOT NULL UNIQUE,
+		customer_id integer NOT NULL,
+		master_id integer NOT NULL,
+		created timestamp with time zone NOT NULL,
+		last_message timestamp with time zone NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS threads_customer_id_idx ON threads (customer_id, last_message)`,
+	`CREATE INDEX IF NOT EXISTS threads_master_id_idx ON threads (master_id, last_message)`,
+	`CREATE TABLE IF NOT EXISTS messages (
+		id serial PRIMARY KEY,
+		thread_id integer NOT NULL,
+		sender_id integer NOT NULL,
+		text text DEFAULT ''::text NOT NULL,
+		attachments jsonb DEFAULT '[]'::jsonb NOT NULL,
+		created timestamp with time zone NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS messages_thread_id_idx ON messages (thread_id, id)`,
+	`CREATE TABLE IF NOT EXISTS thread_reads (
+		thread_id integer NOT NULL,
+		login_id integer NOT NULL,
+		last_read_id integer DEFAULT 0 NOT NULL,
+		read_at timestamp with time zone NOT NULL,
+		PRIMARY KEY (thread_id, login_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS notify_prefs (
+		login_id integer PRIMARY KEY,
+		locale text NOT NULL,
+		email boolean DEFAULT true NOT NULL,
+		sms boolean DEFAULT false NOT NULL,
+		in_app boolean DEFAULT true NOT NULL,
+		muted text[] DEFAULT '{}'::text[] NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS notifications (
+		id bigserial PRIMARY KEY,
+		login_id integer NOT NULL,
+		event_id bigint DEFAULT 0 NOT NULL,
+		kind text NOT NULL,
+		channel text NOT NULL,
+		address text DEFAULT ''::text NOT NULL,
+		locale text NOT NULL,
+		subject text DEFAULT ''::text NOT NULL,
+		body text DEFAULT ''::text NOT NULL,
+		dedup text NOT NULL UNIQUE,
+		status text NOT NULL,
+		attempts integer DEFAULT 0 NOT NULL,
+		next_attempt timestamp with time zone NOT NULL,
+		error text DEFAULT ''::text NOT NULL,
+		created timestamp with time zone NOT NULL,
+		sent timestamp with time zone,
+		read timestamp with time zone
+	)`,
+	`CREATE INDEX IF NOT EXISTS notifications_due_idx ON notifications (next_attempt) WHERE status = 'pending'`,
+	`CREATE INDEX IF NOT EXISTS notifications_inbox_idx ON notifications (login_id, id) WHERE channel = 'inapp'`,
+	//notifications are queued by the outbox relay now
+	`DROP TABLE IF EXISTS notify_cursor`,
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id bigserial PRIMARY KEY,
+		message_id bigint NOT NULL UNIQUE,
+		topic text NOT NULL,
+		key text DEFAULT ''::text NOT NULL,
+		payload jsonb DEFAULT '{}'::jsonb NOT NULL,
+		created timestamp with time zone NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_key_idx ON audit_log (key, id)`,
+	`CREATE TABLE IF NOT EXISTS search_documents (
+		kind text NOT NULL,
+		item_id integer NOT NULL,
+		title text DEFAULT ''::text NOT NULL,
+		body text DEFAULT ''::text NOT NULL,
+		region_id integer DEFAULT 0 NOT NULL,
+		updated timestamp with time zone NOT NULL,
+		PRIMARY KEY (kind, item_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS search_documents_idx ON search_documents USING gin (` + searchVector + `)`,
+	`CREATE TABLE IF NOT EXISTS ledger_transactions (
+		id bigserial PRIMARY KEY,
+		login_id integer NOT NULL,
+		kind text NOT NULL,
+		amount integer NOT NULL,
+		reason text DEFAULT ''::text NOT NULL,
+		ref text DEFAULT ''::text NOT NULL,
+		actor_id integer DEFAULT 0 NOT NULL,
+		created timestamp with time zone NOT NULL
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS ledger_transactions_ref_idx ON ledger_transactions (kind, ref) WHERE ref != ''`,
+	`CREATE INDEX IF NOT EXISTS ledger_transactions_login_idx ON ledger_transactions (login_id, id)`,
+	`CREATE TABLE IF NOT EXISTS ledger_entries (
+		id bigserial PRIMARY KEY,
+		transaction_id bigint NOT NULL,
+		kind text NOT NULL,
+		account text NOT NULL,
+		login_id integer DEFAULT 0 NOT NULL,
+		amount integer NOT NULL,
+		balance_after integer,
+		CHECK (account != 'user' OR balance_after >= 0 OR kind = 'opening')
+	)`,
+	`CREATE INDEX IF NOT EXISTS ledger_entries_login_idx ON ledger_entries (login_id, transaction_id) WHERE account = 'user'`,
+	//the ledger is only ever appended to, a mistake is corrected with another transaction
+	`CREATE OR REPLACE FUNCTION ledger_append_only() RETURNS trigger AS $$
+	BEGIN
+		RAISE EXCEPTION 'the ledger is append-only';
+	END
+	$$ LANGUAGE plpgsql`,
+	`DO $$
+	DECLARE t text;
+	BEGIN
+		FOREACH t IN ARRAY ARRAY['ledger_transactions', 'ledger_entries'] LOOP
+			IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = t || '_append_only') THEN
+				EXECUTE format('CREATE TRIGGER %I BEFORE UPDATE OR DELETE ON %I FOR EACH ROW EXECUTE PROCEDURE ledger_append_only()', t || '_append_only', t);
+				EXECUTE format('CREATE TRIGGER %I BEFORE TRUNCATE ON %I FOR EACH STATEMENT EXECUTE PROCEDURE ledger_append_only()', t || '_no_truncate', t);
+			END IF;
+		END LOOP;
+	END
+	$$`,
+	//balances from before the ledger open it, so the ledger adds up to logins.balance from the start
+	`WITH opened AS (
+		INSERT INTO ledger_transactions (login_id, kind, amount, reason, created)
+		SELECT id, 'opening', balance, 'balance before the ledger', now() FROM logins l
+		WHERE balance != 0 AND NOT EXISTS (SELECT 1 FROM ledger_entries e WHERE e.account = 'user' AND e.login_id = l.id)
+		RETURNING id, login_id, amount
+	)
+	INSERT INTO ledger_entries (transaction_id, kind, account, login_id, amount, balance_after)
+	SELECT id, 'opening', 'user', login_id, amount, amount FROM opened
+	UNION ALL
+	SELECT id, 'opening', 'adjustments', 0, -amount, NULL FROM opened`,
+	`CREATE TABLE IF NOT EXISTS lead_prices (
+		id serial PRIMARY KEY,
+		action text NOT NULL,
+		service_id integer DEFAULT 0 NOT NULL,
+		region_id smallint DEFAULT 0 NOT NULL,
+		price integer NOT NULL CHECK (price >= 0),
+		updated timestamp with time zone NOT NULL,
+		UNIQUE (action, service_id, region_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS offer_charges (
+		offer_id integer PRIMARY KEY,
+		order_id integer NOT NULL,
+		master_id integer NOT NULL,
+		amount integer NOT NULL,
+		transaction_id bigint NOT NULL,
+		viewed timestamp with time zone,
+		refund_id bigint,
+		created timestamp with time zone NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS offer_charges_order_idx ON offer_charges (order_id)`,
+	`CREATE TABLE IF NOT EXISTS contact_unlocks (
+		order_id integer NOT NULL,
+		master_id integer NOT NULL,
+		amount integer DEFAULT 0 NOT NULL,
+		transaction_id bigint DEFAULT 0 NOT NULL,
+		created timestamp with time zone NOT NULL,
+		PRIMARY KEY (order_id, master_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS payments (
+		id bigserial PRIMARY KEY,
+		login_id integer NOT NULL,
+		provider text NOT NULL,
+		external_id text DEFAULT ''::text NOT NULL,
+		idempotency_key text NOT NULL,
+		amount integer NOT NULL CHECK (amount > 0),
+		status text NOT NULL,
+		confirmation_url text DEFAULT ''::text NOT NULL,
+		error text DEFAULT ''::text NOT NULL,
+		transaction_id bigint,
+		created timestamp with time zone NOT NULL,
+		updated timestamp with time zone NOT NULL,
+		UNIQUE (login_id, idempotency_key)
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS payments_external_idx ON payments (provider, external_id) WHERE external_id != ''`,
+	`CREATE INDEX IF NOT EXISTS payments_open_idx ON payments (updated) WHERE status IN ('created', 'pending')`,
+	`CREATE TABLE IF NOT EXISTS payment_refunds (
+		id bigserial PRIMARY KEY,
+		payment_id bigint NOT NULL,
+		login_id integer NOT NULL,
+		external_id text DEFAULT ''::text NOT NULL,
+		amount integer NOT NULL CHECK (amount > 0),
+		reason text NOT NULL,
+		status text NOT NULL,
+		error text DEFAULT ''::text NOT NULL,
+		transaction_id bigint DEFAULT 0 NOT NULL,
+		actor_id integer DEFAULT 0 NOT NULL,
+		created timestamp with time zone NOT NULL,
+		updated timestamp with time zone NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS payment_refunds_payment_idx ON payment_refunds (payment_id)`,
+	`CREATE TABLE IF NOT EXISTS billing_requisites (
+		login_id integer PRIMARY KEY,
+		name text NOT NULL,
+		inn text NOT NULL,
+		kpp text DEFAULT ''::text NOT NULL,
+		ogrn text DEFAULT ''::text NOT NULL,
+		address text NOT NULL,
+		bank text DEFAULT ''::text NOT NULL,
+		bik text DEFAULT ''::text NOT NULL,
+		account text DEFAULT ''::text NOT NULL,
+		corr_account text DEFAULT ''::text NOT NULL,
+		updated timestamp with time zone NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS billing_counters (
+		kind text NOT NULL,
+		year integer NOT NULL,
+		last integer NOT NULL,
+		PRIMARY KEY (kind, year)
+	)`,
+	`CREATE TABLE IF NOT EXISTS billing_documents (
+		id bigserial PRIMARY KEY,
+		kind text NOT NULL,
+		number text NOT NULL UNIQUE,
+		login_id integer NOT NULL,
+		title text NOT NULL,
+		amount integer NOT NULL,
+		vat_rate smallint DEFAULT 0 NOT NULL,
+		status text NOT NULL,
+		transaction_id bigint DEFAULT 0 NOT NULL,
+		invoice_id bigint DEFAULT 0 NOT NULL,
+		buyer jsonb NOT NULL,
+		seller jsonb NOT NULL,
+		pdf text NOT NULL,
+		json text NOT NULL,
+		created timestamp with time zone NOT NULL,
+		paid timestamp with time zone
+	)`,
+	`CREATE INDEX IF NOT EXISTS billing_documents_login_idx ON billing_documents (login_id, id)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS billing_documents_receipt_idx ON billing_documents (transaction_id) WHERE kind = 'receipt'`,
+	`ALTER TABLE events ADD COLUMN IF NOT EXISTS txid bigint DEFAULT txid_current() NOT NULL`,
+	`CREATE INDEX IF NOT EXISTS events_login_txid_idx ON events (login_id, txid, id)`,
+	`CREATE INDEX IF NOT EXISTS notifications_claimed_idx ON notifications (next_attempt) WHERE status = 'sending'`,
+	`ALTER TABLE billing_documents ADD COLUMN IF NOT EXISTS direction text DEFAULT 'credit' NOT NULL`,
+	//receipts for charges were stored with a negative amount
+	`UPDATE billing_documents SET amount = -amount, direction = 'debit' WHERE amount < 0`,
+}
+
+func Migrate() error {
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	//the outbox is shared with cats, whichever starts first makes it
+	for _, m := range append(append([]string{}, outbox.Migrations...), migrations...) {
+		if _, err = conn.Exec(ctx, m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package dbops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//notification channels
+const (
+	ChannelEmail = "email"
+	ChannelSms   = "sms"
+	ChannelInApp = "inapp"
+)
+
+//delivers one notification, an error puts it back for a retry
+type Sender interface {
+	Send(ctx context.Context, n *Notification) error
+}
+
+var senders struct {
+	sync.Mutex
+	m map[string]Sender
+}
+
+//replaces the sender of a channel, SMS gateways and the like plug in here before StartNotifier
+func RegisterSender(channel string, s Sender) {
+	senders.Lock()
+	defer senders.Unlock()
+	defaultSenders()
+	senders.m[channel] = s
+}
+
+//email goes over SMTP when SMTP_ADDR is set, everything else lands in the file sink
+func defaultSenders() {
+	if senders.m != nil {
+		return
+	}
+	sink := fileSender{dir: os.Getenv("NOTIFY_SINK_DIR")}
+	if sink.dir == "" {
+		sink.dir = os.Getenv("UPLOADS_DIR") + "notifications/"
+	}
+
+	senders.m = map[string]Sender{ChannelEmail: sink, ChannelSms: sink, ChannelInApp: inAppSender{}}
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		senders.m[ChannelEmail] = smtpSender{addr: addr, from: os.Getenv("SMTP_FROM"), user: os.Getenv("SMTP_USER"), password: os.Getenv("SMTP_PASSWORD")}
+	}
+}
+
+func senderFor(channel string) (Sender, error) {
+	senders.Lock()
+	defer senders.Unlock()
+	defaultSenders()
+	s, ok := senders.m[channel]
+	if !ok {
+		return nil, errors.New("no sender for channel " + channel)
+	}
+	return s, nil
+}
+
+//in-app notifications are the rows themselves, read through get-notifications
+type inAppSender struct{}
+
+func (inAppSender) Send(ctx context.Context, n *Notification) error {
+	return nil
+}
+
+//appends a json line per notification to {dir}/{channel}.log, for local runs and tests
+type fileSender struct {
+	dir string
+}
+
+var sinkMu sync.Mutex
+
+func (s fileSender) Send(ctx context.Context, n *Notification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	sinkMu.Lock()
+	defer sinkMu.Unlock()
+
+	if err = os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, n.Channel+".log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+//plain text mail, no auth when SMTP_USER is empty, which is what local mail catchers expect
+type smtpSender struct {
+	addr     string
+	from     string
+	user     string
+	password string
+}
+
+func (s smtpSender) Send(ctx context.Context, n *Notification) error {
+	if strings.ContainsAny(n.Address, "\r\n") {
+		return errors.New("bad address")
+	}
+
+	var auth smtp.Auth
+	if s.user != "" {
+		host := s.addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", s.user, s.password, host)
+	}
+
+	msg := "From: " + s.from + "\r\n" +
+		"To: " + n.Address + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", n.Subject) + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: 8bit\r\n\r\n" +
+		strings.ReplaceAll(n.Body, "\n", "\r\n") + "\r\n"
+
+	return smtp.SendMail(s.addr, auth, s.from, []string{n.Address}, []byte(msg))
+}
@@ -0,0 +1,185 @@
+package dbops
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+//subject and body of one kind in one locale, sms and in-app use the body alone
+type notifyTemplate struct {
+	Subject string
+	Body    string
+}
+
+//what a template sees, Payload is the event payload as sent to subscribers
+type notifyData struct {
+	Name    string
+	Order   Order
+	Payload map[string]interface{}
+}
+
+//kinds without a template here don't notify at all
+var builtinTemplates = map[string]map[string]notifyTemplate{
+	"ru": {
+		EventMatchingOrder: {
+			"Новый заказ: {{.Order.Title}}",
+			"Здравствуйте, {{.Name}}! Появился заказ по вашей специализации: «{{.Order.Title}}»{{if .Order.Budget}}, бюджет {{.Order.Budget}}{{end}}.",
+		},
+		EventNewOffer: {
+			"Новое предложение по заказу «{{.Order.Title}}»",
+			"Здравствуйте, {{.Name}}! Мастер откликнулся на ваш заказ «{{.Order.Title}}»{{with .Payload.price}} и предлагает цену {{.}}{{end}}.",
+		},
+		EventOfferAccepted: {
+			"Ваше предложение принято",
+			"Здравствуйте, {{.Name}}! Заказчик принял ваше предложение по заказу «{{.Order.Title}}».",
+		},
+		EventOfferDeclined: {
+			"Ваше предложение отклонено",
+			"Здравствуйте, {{.Name}}! Заказчик выбрал другого мастера для заказа «{{.Order.Title}}».",
+		},
+		EventOrderStatus: {
+			"Статус заказа «{{.Order.Title}}» изменён",
+			"Здравствуйте, {{.Name}}! Заказ «{{.Order.Title}}» теперь в статусе {{.Payload.to}}.",
+		},
+		EventNewMessage: {
+			"Новое сообщение по заказу «{{.Order.Title}}»",
+			"{{.Payload.text}}",
+		},
+		EventNewReview: {
+			"Новый отзыв",
+			"Здравствуйте, {{.Name}}! О вас оставили отзыв с оценкой {{.Payload.overall}}: {{.Payload.text}}",
+		},
+		EventReviewReply: {
+			"Мастер ответил на ваш отзыв",
+			"{{.Payload.reply}}",
+		},
+	},
+	"en": {
+		EventMatchingOrder: {
+			"New order: {{.Order.Title}}",
+			"Hello {{.Name}}! There is a new order in your line of work: \"{{.Order.Title}}\"{{if .Order.Budget}}, budget {{.Order.Budget}}{{end}}.",
+		},
+		EventNewOffer: {
+			"New offer on \"{{.Order.Title}}\"",
+			"Hello {{.Name}}! A master answered your order \"{{.Order.Title}}\"{{with .Payload.price}} with a price of {{.}}{{end}}.",
+		},
+		EventOfferAccepted: {
+			"Your offer was accepted",
+			"Hello {{.Name}}! The customer accepted your offer on \"{{.Order.Title}}\".",
+		},
+		EventOfferDeclined: {
+			"Your offer was declined",
+			"Hello {{.Name}}! The customer chose another master for \"{{.Order.Title}}\".",
+		},
+		EventOrderStatus: {
+			"Order \"{{.Order.Title}}\" changed status",
+			"Hello {{.Name}}! Order \"{{.Order.Title}}\" is now {{.Payload.to}}.",
+		},
+		EventNewMessage: {
+			"New message about \"{{.Order.Title}}\"",
+			"{{.Payload.text}}",
+		},
+		EventNewReview: {
+			"New review",
+			"Hello {{.Name}}! You got a review rated {{.Payload.overall}}: {{.Payload.text}}",
+		},
+		EventReviewReply: {
+			"The master replied to your review",
+			"{{.Payload.reply}}",
+		},
+	},
+}
+
+//NOTIFY_TEMPLATES_DIR holds {kind}.{locale}.tmpl files, subject on the first line and body after it
+//they replace built in templates or add locales, read once
+var notifyTemplates struct {
+	sync.Once
+	t map[string]map[string]notifyTemplate
+}
+
+func loadTemplates() map[string]map[string]notifyTemplate {
+	notifyTemplates.Do(func() {
+		notifyTemplates.t = map[string]map[string]notifyTemplate{}
+		for locale, kinds := range builtinTemplates {
+			notifyTemplates.t[locale] = map[string]notifyTemplate{}
+			for kind, t := range kinds {
+				notifyTemplates.t[locale][kind] = t
+			}
+		}
+
+		dir := os.Getenv("NOTIFY_TEMPLATES_DIR")
+		if dir == "" {
+			return
+		}
+		files, _ := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+		for _, f := range files {
+			parts := strings.Split(strings.TrimSuffix(filepath.Base(f), ".tmpl"), ".")
+			if len(parts) != 2 {
+				continue
+			}
+			b, err := os.ReadFile(f)
+			if err != nil {
+				continue
+			}
+			lines := strings.SplitN(string(b), "\n", 2)
+			t := notifyTemplate{Subject: strings.TrimSpace(lines[0])}
+			if len(lines) > 1 {
+				t.Body = strings.TrimSpace(lines[1])
+			}
+			if notifyTemplates.t[parts[1]] == nil {
+				notifyTemplates.t[parts[1]] = map[string]notifyTemplate{}
+			}
+			notifyTemplates.t[parts[1]][parts[0]] = t
+		}
+	})
+	return notifyTemplates.t
+}
+
+//the locale users get before they pick one, NOTIFY_DEFAULT_LOCALE
+func defaultLocale() string {
+	if l := os.Getenv("NOTIFY_DEFAULT_LOCALE"); l != "" {
+		return l
+	}
+	return "ru"
+}
+
+func knownLocale(locale string) bool {
+	_, ok := loadTemplates()[locale]
+	return ok
+}
+
+//fills the kind's template, a locale without it falls back to the default one
+//ok is false when the kind doesn't notify
+func renderNotification(kind string, locale string, data notifyData) (subject string, body string, ok bool, err error) {
+	all := loadTemplates()
+	t, ok := all[locale][kind]
+	if !ok {
+		t, ok = all[defaultLocale()][kind]
+	}
+	if !ok {
+		return "", "", false, nil
+	}
+
+	if subject, err = execTemplate(t.Subject, data); err != nil {
+		return "", "", true, err
+	}
+	body, err = execTemplate(t.Body, data)
+	return subject, body, true, err
+}
+
+func execTemplate(text string, data notifyData) (string, error) {
+	t, err := template.New("").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	if err = t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(b.String(), "<no value>", ""), nil
+}
@@ -3,6 +3,7 @@ module main
 go 1.17
 
 replace (
+	go.mods/attrs => ../shared/attrs
 	go.mods/dbops => ./dbops
 	go.mods/grpcc => ../shared/grpcc
 	go.mods/hashing => ./hashing
@@ -32,6 +33,10 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/objx v0.2.0 // indirect
 	github.com/stretchr/testify v1.7.0 // indirect
+	go.mods/attrs v0.0.0-00010101000000-000000000000 // indirect
+	go.mods/outbox v0.0.0-00010101000000-000000000000 // indirect
+	go.mods/paging v0.0.0-00010101000000-000000000000 // indirect
+	go.mods/pdf v0.0.0-00010101000000-000000000000 // indirect
 	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5 // indirect
 	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110 // indirect
 	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
@@ -40,3 +45,9 @@ require (
 	google.golang.org/protobuf v1.27.1 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
+
+replace go.mods/paging => ../shared/paging
+
+replace go.mods/outbox => ../shared/outbox
+
+replace go.mods/pdf => ../shared/pdf
@@ -532,6 +532,60 @@ func (*server) PassData(ctx context.Context, req *grpcc.DataRequest) (*grpcc.Dat
 		return &res, nil
 	}
 
+	if op == "update-order" {
+		str, err := dbops.UpdateOrder(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "cancel-order" {
+		str, err := dbops.CancelOrder(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "order-transition" {
+		str, err := dbops.TransitionOrder(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "order-history" {
+		str, err := dbops.GetOrderHistory(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "match-masters" {
+		str, err := dbops.MatchMasters(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "order-feed" {
+		str, err := dbops.GetOrderFeed(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
 	//offers
 	if op == "add-offer" {
 		str, err := dbops.AddOffer(instructions)
@@ -551,6 +605,24 @@ func (*server) PassData(ctx context.Context, req *grpcc.DataRequest) (*grpcc.Dat
 		return &res, nil
 	}
 
+	if op == "accept-offer" {
+		str, err := dbops.AcceptOffer(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "withdraw-offer" {
+		str, err := dbops.WithdrawOffer(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
 	if op == "update-offer" {
 		err := dbops.UpdateOffer(instructions)
 		if err != nil {
@@ -560,10 +632,372 @@ func (*server) PassData(ctx context.Context, req *grpcc.DataRequest) (*grpcc.Dat
 		return &res, nil
 	}
 
+	//reviews
+	if op == "add-review" {
+		str, err := dbops.AddReview(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "edit-review" {
+		str, err := dbops.EditReview(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "reply-to-review" {
+		str, err := dbops.ReplyToReview(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "get-master-rating" {
+		str, err := dbops.GetMasterRating(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "recompute-ratings" {
+		str, err := dbops.RecomputeRatings(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	//messages
+	if op == "send-message" {
+		str, err := dbops.SendMessage(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "get-messages" {
+		str, err := dbops.GetMessages(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "mark-read" {
+		str, err := dbops.MarkRead(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "get-threads" {
+		str, err := dbops.GetThreads(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "unread-count" {
+		str, err := dbops.UnreadCount(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	//notifications
+	if op == "get-notify-prefs" {
+		str, err := dbops.GetNotifyPrefs(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "set-notify-prefs" {
+		str, err := dbops.SetNotifyPrefs(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "get-notifications" {
+		str, err := dbops.GetNotifications(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "read-notifications" {
+		str, err := dbops.ReadNotifications(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	//outbox consumers
+	if op == "search" {
+		str, err := dbops.Search(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "audit-log" {
+		str, err := dbops.GetAuditLog(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "outbox-status" {
+		str, err := dbops.GetOutboxStatus(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	//balance
+	if op == "get-balance" {
+		str, err := dbops.GetBalance(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "balance-statement" {
+		str, err := dbops.GetStatement(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "adjust-balance" {
+		str, err := dbops.AdjustBalance(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	//leads
+	if op == "quote-lead" {
+		str, err := dbops.QuoteLead(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "unlock-contacts" {
+		str, err := dbops.UnlockContacts(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "set-lead-price" {
+		str, err := dbops.SetLeadPrice(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "get-lead-prices" {
+		str, err := dbops.GetLeadPrices(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	//payments
+	if op == "create-payment" {
+		str, err := dbops.CreatePayment(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "get-payments" {
+		str, err := dbops.GetPayments(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "refund-payment" {
+		str, err := dbops.RefundPayment(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "reconcile-payments" {
+		str, err := dbops.ReconcilePayments(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	//billing
+	if op == "set-requisites" {
+		str, err := dbops.SetRequisites(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "get-requisites" {
+		str, err := dbops.GetRequisites(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "issue-invoice" {
+		str, err := dbops.IssueInvoice(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "pay-invoice" {
+		str, err := dbops.PayInvoice(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "billing-documents" {
+		str, err := dbops.GetDocuments(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "billing-document" {
+		str, err := dbops.GetDocument(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	//moderation
+	if op == "report-content" {
+		str, err := dbops.ReportContent(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "moderate" {
+		str, err := dbops.Moderate(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "moderation-queue" {
+		str, err := dbops.GetModerationQueue(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "moderation-history" {
+		str, err := dbops.GetModerationHistory(instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
 	return &res, errors.New("noop")
 }
 
 func main() {
+	if err := dbops.Migrate(); err != nil {
+		log.Fatal(service+" migrations failed: ", err)
+	}
+	dbops.StartRatingJob()
+	dbops.StartEventListener()
+	dbops.StartRelay()
+	dbops.StartNotifier()
+	dbops.StartFakeProvider()
+	dbops.StartReconciler()
+	serveWebhooks()
+
 	ok, err := credentials.NewServerTLSFromFile(os.Getenv("SERVICEKEY_PEM"), os.Getenv("SERVICEKEY_KEY"))
 	if err != nil {
 		log.Fatalf("Failed to setup TLS:%v", err)
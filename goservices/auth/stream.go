@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"go.mods/dbops"
+	"go.mods/grpcc"
+)
+
+//implement Subscribe interface from grpcc
+//replays what came after last_event_id, then follows new events until the client goes away
+//a client reconnecting with the last id it got loses nothing
+func (*server) Subscribe(req *grpcc.SubscribeRequest, stream grpcc.CommunicationService_SubscribeServer) error {
+	if req.GetLoginId() == 0 {
+		return errors.New("login_id is required")
+	}
+
+	ctx := stream.Context()
+	es, err := dbops.OpenEventStream(ctx, req.GetLoginId(), req.GetLastEventId(), req.GetKinds())
+	if err != nil {
+		return err
+	}
+	defer es.Close()
+
+	for {
+		events, err := es.Next(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range events {
+			err = stream.Send(&grpcc.Event{
+				Id:      e.Id,
+				Kind:    e.Kind,
+				LoginId: e.LoginId,
+				OrderId: e.OrderId,
+				OfferId: e.OfferId,
+				Payload: string(e.Payload),
+				Created: e.Created.Format(time.RFC3339Nano),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
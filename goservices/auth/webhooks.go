@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.mods/dbops"
+)
+
+//payment providers can't speak grpc, they post to /payments/webhook/{provider} on PAYMENTS_WEBHOOK_ADDR
+func serveWebhooks() {
+	addr := os.Getenv("PAYMENTS_WEBHOOK_ADDR")
+	if addr == "" {
+		addr = ":50013"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/payments/webhook/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "bad body", http.StatusBadRequest)
+			return
+		}
+
+		//anything but 200 makes the provider send it again
+		provider := strings.TrimPrefix(r.URL.Path, "/payments/webhook/")
+		if err = dbops.HandlePaymentWebhook(provider, r.Header, body); err != nil {
+			log.Println(provider+" webhook rejected: ", err)
+			http.Error(w, "rejected", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+
+	go func() {
+		log.Println("payment webhooks listening on " + addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatal(service+" webhooks failed: ", err)
+		}
+	}()
+}
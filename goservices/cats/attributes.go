@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"go.mods/attrs"
+)
+
+//order form definition of a category, subcategories without their own inherit the closest one
+type catAttributes struct {
+	CatId  int32           `json:"cat_id"`
+	Schema json.RawMessage `json:"schema"`
+}
+
+func setAttributes(ctx context.Context, conn *pgxpool.Pool, instructions string) error {
+	var a catAttributes
+	if err := json.Unmarshal([]byte(instructions), &a); err != nil {
+		return err
+	}
+
+	if _, err := attrs.Parse(a.Schema); err != nil {
+		return err
+	}
+
+	ct, err := conn.Exec(ctx, `INSERT INTO cats_attributes (cat_id, schema) SELECT id, $2 FROM cats WHERE id = $1
+		ON CONFLICT (cat_id) DO UPDATE SET schema = $2`, a.CatId, a.Schema)
+	if err != nil {
+		return err
+	}
+
+	if ct.RowsAffected() == 0 {
+		return errors.New("no such cat")
+	}
+
+	return nil
+}
+
+//the schema that applies to the cat, own or inherited, null if none
+func readAttributes(ctx context.Context, conn *pgxpool.Pool, instructions string) (string, error) {
+	var a catAttributes
+	if err := json.Unmarshal([]byte(instructions), &a); err != nil {
+		return "", err
+	}
+
+	err := conn.QueryRow(ctx, attrs.LookupSql, a.CatId).Scan(&a.CatId, &a.Schema)
+	if err == pgx.ErrNoRows {
+		return "null", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(a)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func deleteAttributes(ctx context.Context, conn *pgxpool.Pool, instructions string) error {
+	var a catAttributes
+	if err := json.Unmarshal([]byte(instructions), &a); err != nil {
+		return err
+	}
+
+	ct, err := conn.Exec(ctx, `DELETE FROM cats_attributes WHERE cat_id = $1`, a.CatId)
+	if err != nil {
+		return err
+	}
+
+	if ct.RowsAffected() == 0 {
+		return errors.New("no attributes defined for this cat")
+	}
+
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+//postgres channel used to tell other cats instances to drop their cache
+const cacheChannel = "cats_cache"
+
+type cacheEntry struct {
+	data    string
+	expires time.Time
+}
+
+//read-through cache of marshalled read and read_all results, categories change a few times a month
+type catCache struct {
+	mu       sync.RWMutex
+	entries  map[string]cacheEntry
+	ttl      time.Duration
+	notify   bool
+	instance string
+	//bumped on every clear, a read that started before one must not be cached
+	gen uint64
+
+	hits          uint64
+	misses        uint64
+	invalidations uint64
+}
+
+func newCatCache() *catCache {
+	ttl := 300
+	if v, err := strconv.Atoi(os.Getenv("CATS_CACHE_TTL")); err == nil && v >= 0 {
+		ttl = v
+	}
+	host, _ := os.Hostname()
+
+	return &catCache{
+		entries:  map[string]cacheEntry{},
+		ttl:      time.Duration(ttl) * time.Second,
+		notify:   os.Getenv("CATS_CACHE_NOTIFY") == "yes",
+		instance: host + ":" + strconv.Itoa(os.Getpid()),
+	}
+}
+
+var cache = newCatCache()
+
+//keys for a read by id or slug and for read_all, per resolved locale chain
+//only chains made of CATS_LOCALES get a key so that made-up locales can't grow the cache, "" is never cached
+func cacheKey(op string, c cat, locale string) string {
+	chain := localeChain(locale)
+	known := map[string]bool{}
+	for _, l := range configuredLocales() {
+		known[l] = true
+	}
+	for _, l := range chain {
+		if !known[l] {
+			return ""
+		}
+	}
+
+	suffix := "|" + strings.Join(chain, ",")
+	if op == "read_all" {
+		return "all" + suffix
+	}
+	if c.Id != 0 {
+		return "id:" + strconv.Itoa(int(c.Id)) + suffix
+	}
+	return "slug:" + c.Slug + suffix
+}
+
+func (cc *catCache) get(key string) (string, bool) {
+	if cc.ttl == 0 || key == "" {
+		return "", false
+	}
+
+	cc.mu.RLock()
+	e, ok := cc.entries[key]
+	cc.mu.RUnlock()
+
+	if !ok || time.Now().After(e.expires) {
+		atomic.AddUint64(&cc.misses, 1)
+		return "", false
+	}
+
+	atomic.AddUint64(&cc.hits, 1)
+	return e.data, true
+}
+
+//taken before the database read, put skips the result if the cache was cleared in between
+func (cc *catCache) generation() uint64 {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	return cc.gen
+}
+
+func (cc *catCache) put(key string, data string, gen uint64) {
+	if cc.ttl == 0 || key == "" {
+		return
+	}
+
+	cc.mu.Lock()
+	if cc.gen == gen {
+		cc.entries[key] = cacheEntry{data: data, expires: time.Now().Add(cc.ttl)}
+	}
+	cc.mu.Unlock()
+}
+
+func (cc *catCache) clear() {
+	cc.mu.Lock()
+	cc.entries = map[string]cacheEntry{}
+	cc.gen++
+	cc.mu.Unlock()
+	atomic.AddUint64(&cc.invalidations, 1)
+}
+
+//drops everything locally and, if enabled, on every other instance
+func (cc *catCache) invalidate(ctx context.Context, conn *pgxpool.Pool) {
+	cc.clear()
+
+	if !cc.notify {
+		return
+	}
+	if _, err := conn.Exec(ctx, `SELECT pg_notify($1, $2)`, cacheChannel, cc.instance); err != nil {
+		log.Println(service+" cache notify failed:", err)
+	}
+}
+
+func (cc *catCache) stats() (string, error) {
+	cc.mu.RLock()
+	size := len(cc.entries)
+	cc.mu.RUnlock()
+
+	b, err := json.Marshal(struct {
+		Hits          uint64 `json:"hits"`
+		Misses        uint64 `json:"misses"`
+		Invalidations uint64 `json:"invalidations"`
+		Entries       int    `json:"entries"`
+		TtlSeconds    int    `json:"ttl_seconds"`
+		Notify        bool   `json:"notify"`
+	}{
+		atomic.LoadUint64(&cc.hits),
+		atomic.LoadUint64(&cc.misses),
+		atomic.LoadUint64(&cc.invalidations),
+		size,
+		int(cc.ttl / time.Second),
+		cc.notify,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+//keeps a dedicated connection listening for invalidations from other instances
+func (cc *catCache) listen() {
+	for {
+		if err := cc.listenOnce(); err != nil {
+			log.Println(service+" cache listener:", err)
+		}
+		//whatever we missed while disconnected is stale now
+		cc.clear()
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func (cc *catCache) listenOnce() error {
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	if _, err = conn.Exec(ctx, `LISTEN `+cacheChannel); err != nil {
+		return err
+	}
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		if n.Payload != cc.instance {
+			cc.clear()
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"go.mods/outbox"
+)
+
+//one category in the import/export format, the slug path ("parent/child") is the key
+type catalogueRow struct {
+	Path        string `json:"path"`
+	Name        string `json:"name"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Keywords    string `json:"keywords"`
+	Author      string `json:"author"`
+	H1          string `json:"h1"`
+	Text        string `json:"text"`
+	Image       string `json:"image"`
+	SortOrder   int32  `json:"sort_order"`
+	Extra       string `json:"extra"`
+	line        int
+}
+
+var catalogueColumns = []string{"path", "name", "title", "description", "keywords", "author", "h1", "text", "image", "sort_order", "extra"}
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+func (r catalogueRow) record() []string {
+	return []string{r.Path, r.Name, r.Title, r.Description, r.Keywords, r.Author, r.H1, r.Text, r.Image, strconv.Itoa(int(r.SortOrder)), r.Extra}
+}
+
+//compares everything except the path, sort_order 0 means keep whatever is there
+func (r catalogueRow) diff(c *cat) map[string][2]string {
+	d := map[string][2]string{}
+	pairs := [][3]string{
+		{"name", c.Name, r.Name},
+		{"title", c.Title, r.Title},
+		{"description", c.Description, r.Description},
+		{"keywords", c.Keywords, r.Keywords},
+		{"author", c.Author, r.Author},
+		{"h1", c.H1, r.H1},
+		{"text", c.Text, r.Text},
+		{"image", c.Image, r.Image},
+		{"extra", c.Extra, r.Extra},
+	}
+	if r.SortOrder != 0 {
+		pairs = append(pairs, [3]string{"sort_order", strconv.Itoa(int(c.SortOrder)), strconv.Itoa(int(r.SortOrder))})
+	}
+	for _, p := range pairs {
+		if p[1] != p[2] {
+			d[p[0]] = [2]string{p[1], p[2]}
+		}
+	}
+	return d
+}
+
+//every cat keyed by its slug path
+func catPaths(cats []*cat) map[string]*cat {
+	byId := map[int32]*cat{}
+	for _, v := range cats {
+		byId[v.Id] = v
+	}
+
+	paths := map[string]*cat{}
+	for _, v := range cats {
+		parts := []string{v.Slug}
+		seen := map[int32]bool{v.Id: true}
+		for p := byId[v.ParentId]; p != nil && !seen[p.Id]; p = byId[p.ParentId] {
+			seen[p.Id] = true
+			parts = append([]string{p.Slug}, parts...)
+		}
+		paths[strings.Join(parts, "/")] = v
+	}
+	return paths
+}
+
+func catalogueExport(ctx context.Context, conn *pgxpool.Pool, instructions string) (string, error) {
+	in := struct {
+		Format string `json:"format"`
+	}{}
+	if err := json.Unmarshal([]byte(instructions), &in); err != nil {
+		return "", err
+	}
+
+	var cats []*cat
+	if err := pgxscan.Select(ctx, conn, &cats, `SELECT * FROM cats ORDER BY sort_order ASC`); err != nil {
+		return "", err
+	}
+
+	var rows []catalogueRow
+	for path, v := range catPaths(cats) {
+		rows = append(rows, catalogueRow{Path: path, Name: v.Name, Title: v.Title, Description: v.Description, Keywords: v.Keywords,
+			Author: v.Author, H1: v.H1, Text: v.Text, Image: v.Image, SortOrder: v.SortOrder, Extra: v.Extra})
+	}
+	//parents always come before their children
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Path < rows[j].Path })
+
+	if in.Format == "csv" {
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		if err := w.Write(catalogueColumns); err != nil {
+			return "", err
+		}
+		for _, r := range rows {
+			if err := w.Write(r.record()); err != nil {
+				return "", err
+			}
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return "", err
+		}
+
+		//csv goes back as a json string
+		b, err := json.Marshal(buf.String())
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+
+	if rows == nil {
+		rows = []catalogueRow{}
+	}
+	b, err := json.Marshal(rows)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func parseCatalogueCsv(data string) ([]catalogueRow, []catalogueError) {
+	r := csv.NewReader(strings.NewReader(data))
+	header, err := r.Read()
+	if err != nil {
+		return nil, []catalogueError{{Row: 0, Error: "bad header: " + err.Error()}}
+	}
+
+	col := map[string]int{}
+	for i, h := range header {
+		col[strings.TrimSpace(h)] = i
+	}
+	if _, ok := col["path"]; !ok {
+		return nil, []catalogueError{{Row: 0, Error: "path column is required"}}
+	}
+	get := func(rec []string, name string) string {
+		if i, ok := col[name]; ok && i < len(rec) {
+			return rec[i]
+		}
+		return ""
+	}
+
+	var rows []catalogueRow
+	var errs []catalogueError
+	for n := 1; ; n++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errs = append(errs, catalogueError{Row: n, Error: err.Error()})
+			continue
+		}
+
+		row := catalogueRow{
+			Path:        get(rec, "path"),
+			Name:        get(rec, "name"),
+			Title:       get(rec, "title"),
+			Description: get(rec, "description"),
+			Keywords:    get(rec, "keywords"),
+			Author:      get(rec, "author"),
+			H1:          get(rec, "h1"),
+			Text:        get(rec, "text"),
+			Image:       get(rec, "image"),
+			Extra:       get(rec, "extra"),
+			line:        n,
+		}
+		if so := strings.TrimSpace(get(rec, "sort_order")); so != "" {
+			i, err := strconv.Atoi(so)
+			if err != nil {
+				errs = append(errs, catalogueError{Row: n, Path: row.Path, Error: "sort_order is not a number"})
+				continue
+			}
+			row.SortOrder = int32(i)
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, errs
+}
+
+type catalogueError struct {
+	Row   int    `json:"row"`
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+type catalogueChange struct {
+	Row    int                  `json:"row"`
+	Path   string               `json:"path"`
+	Action string               `json:"action"`
+	Fields map[string][2]string `json:"fields,omitempty"`
+}
+
+type catalogueReport struct {
+	DryRun    bool              `json:"dry_run"`
+	Applied   bool              `json:"applied"`
+	Created   int               `json:"created"`
+	Updated   int               `json:"updated"`
+	Unchanged int               `json:"unchanged"`
+	Changes   []catalogueChange `json:"changes"`
+	Errors    []catalogueError  `json:"errors"`
+}
+
+//upserts rows by slug path, nothing is written if any row is invalid or dry_run is set
+func catalogueImport(ctx context.Context, conn *pgxpool.Pool, instructions string) (string, error) {
+	in := struct {
+		Format string          `json:"format"`
+		Data   json.RawMessage `json:"data"`
+		DryRun bool            `json:"dry_run"`
+	}{}
+	if err := json.Unmarshal([]byte(instructions), &in); err != nil {
+		return "", err
+	}
+
+	report := catalogueReport{DryRun: in.DryRun, Changes: []catalogueChange{}, Errors: []catalogueError{}}
+
+	var rows []catalogueRow
+	if in.Format == "csv" {
+		var data string
+		if err := json.Unmarshal(in.Data, &data); err != nil {
+			return "", errors.New("csv data must be a string")
+		}
+		var errs []catalogueError
+		rows, errs = parseCatalogueCsv(data)
+		report.Errors = append(report.Errors, errs...)
+	} else if err := json.Unmarshal(in.Data, &rows); err != nil {
+		return "", err
+	}
+
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.Serializable})
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var cats []*cat
+	if err = pgxscan.Select(ctx, tx, &cats, `SELECT * FROM cats`); err != nil {
+		return "", err
+	}
+	existing := catPaths(cats)
+	slugs := map[string]string{}
+	for path, v := range existing {
+		slugs[v.Slug] = path
+	}
+
+	//validate everything first, rows are numbered from 1 as in the file
+	type planned struct {
+		n   int
+		row catalogueRow
+	}
+	var plan []planned
+	inFile := map[string]int{}
+	for i, r := range rows {
+		n := i + 1
+		if r.line != 0 {
+			n = r.line
+		}
+		r.Path = strings.Trim(strings.TrimSpace(r.Path), "/")
+		fail := func(msg string) {
+			report.Errors = append(report.Errors, catalogueError{Row: n, Path: r.Path, Error: msg})
+		}
+
+		parts := strings.Split(r.Path, "/")
+		valid := r.Path != ""
+		for _, p := range parts {
+			if !slugPattern.MatchString(p) {
+				valid = false
+			}
+		}
+		if !valid {
+			fail("path must be slugs of a-z, 0-9, - and _ separated by /")
+			continue
+		}
+		if strings.TrimSpace(r.Name) == "" {
+			fail("name is required")
+			continue
+		}
+		if prev, ok := inFile[r.Path]; ok {
+			fail("duplicate of row " + strconv.Itoa(prev))
+			continue
+		}
+		slug := parts[len(parts)-1]
+		if other, ok := slugs[slug]; ok && other != r.Path {
+			fail("slug " + slug + " is already used by " + other)
+			continue
+		}
+		//slugs are unique across the tree, a later row of the file can't take this one either
+		slugs[slug] = r.Path
+		inFile[r.Path] = n
+		plan = append(plan, planned{n, r})
+	}
+
+	for _, p := range plan {
+		i := strings.LastIndex(p.row.Path, "/")
+		if i < 0 {
+			continue
+		}
+		parent := p.row.Path[:i]
+		if _, ok := existing[parent]; !ok {
+			if _, ok = inFile[parent]; !ok {
+				report.Errors = append(report.Errors, catalogueError{Row: p.n, Path: p.row.Path, Error: "parent " + parent + " does not exist"})
+			}
+		}
+	}
+
+	//parents before children
+	sort.SliceStable(plan, func(i, j int) bool {
+		return strings.Count(plan[i].row.Path, "/") < strings.Count(plan[j].row.Path, "/")
+	})
+
+	for _, p := range plan {
+		r := p.row
+		if c, ok := existing[r.Path]; ok {
+			d := r.diff(c)
+			if len(d) == 0 {
+				report.Unchanged++
+				continue
+			}
+			report.Updated++
+			report.Changes = append(report.Changes, catalogueChange{Row: p.n, Path: r.Path, Action: "update", Fields: d})
+
+			if in.DryRun || len(report.Errors) > 0 {
+				continue
+			}
+			if r.SortOrder == 0 {
+				r.SortOrder = c.SortOrder
+			}
+			_, err = tx.Exec(ctx, `UPDATE cats SET name = $1, title = $2, description = $3, keywords = $4, author = $5, h1 = $6, text = $7, image = $8, sort_order = $9, extra = $10, version = version + 1 WHERE id = $11`,
+				r.Name, r.Title, r.Description, r.Keywords, r.Author, r.H1, r.Text, r.Image, r.SortOrder, r.Extra, c.Id)
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		report.Created++
+		report.Changes = append(report.Changes, catalogueChange{Row: p.n, Path: r.Path, Action: "create"})
+
+		if in.DryRun || len(report.Errors) > 0 {
+			continue
+		}
+		var parentId int32
+		slug := r.Path
+		if i := strings.LastIndex(r.Path, "/"); i >= 0 {
+			parentId = existing[r.Path[:i]].Id
+			slug = r.Path[i+1:]
+		}
+		c := &cat{ParentId: parentId, Name: r.Name, Slug: slug, Title: r.Title, Description: r.Description, Keywords: r.Keywords,
+			Author: r.Author, H1: r.H1, Text: r.Text, Image: r.Image, SortOrder: r.SortOrder, CreatedAt: time.Now(), Extra: r.Extra}
+		err = tx.QueryRow(ctx, `INSERT INTO cats (parent_id, name, slug, title, description, keywords, author, h1, text, image, sort_order, created_at, extra)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) RETURNING id`,
+			c.ParentId, c.Name, c.Slug, c.Title, c.Description, c.Keywords, c.Author, c.H1, c.Text, c.Image, c.SortOrder, c.CreatedAt, c.Extra).Scan(&c.Id)
+		if err != nil {
+			return "", err
+		}
+		if c.SortOrder == 0 {
+			c.SortOrder = c.Id
+			if _, err = tx.Exec(ctx, `UPDATE cats SET sort_order = $1 WHERE id = $1`, c.Id); err != nil {
+				return "", err
+			}
+		}
+		existing[r.Path] = c
+	}
+
+	if !in.DryRun && len(report.Errors) == 0 {
+		if report.Created+report.Updated > 0 {
+			counts := struct {
+				Created int `json:"created"`
+				Updated int `json:"updated"`
+			}{report.Created, report.Updated}
+			if err = outbox.Write(ctx, tx, topicCatImported, "", counts); err != nil {
+				return "", err
+			}
+		}
+		if err = tx.Commit(ctx); err != nil {
+			return "", err
+		}
+		report.Applied = true
+	}
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
@@ -1,12 +1,16 @@
-module main
+module go.mods/cats
 
 go 1.17
 
-replace go.mods/grpcc => ../shared/grpcc
+replace (
+	go.mods/attrs => ../shared/attrs
+	go.mods/grpcc => ../shared/grpcc
+)
 
 require (
 	github.com/georgysavva/scany v0.2.9
 	github.com/jackc/pgx/v4 v4.13.0
+	go.mods/attrs v0.0.0-00010101000000-000000000000
 	go.mods/grpcc v0.0.0-00010101000000-000000000000
 	google.golang.org/grpc v1.40.0
 )
@@ -26,7 +30,9 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/objx v0.2.0 // indirect
 	github.com/stretchr/testify v1.7.0 // indirect
-	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97 // indirect
+	go.mods/outbox v0.0.0-00010101000000-000000000000
+	go.mods/paging v0.0.0-00010101000000-000000000000
+	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5 // indirect
 	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110 // indirect
 	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
 	golang.org/x/text v0.3.6 // indirect
@@ -34,3 +40,7 @@ require (
 	google.golang.org/protobuf v1.27.1 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
+
+replace go.mods/paging => ../shared/paging
+
+replace go.mods/outbox => ../shared/outbox
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+//translated content of a category, empty fields fall through to the next locale in the chain
+type translation struct {
+	Id          int32  `json:"id"`
+	CatId       int32  `json:"cat_id"`
+	Locale      string `json:"locale"`
+	Name        string `json:"name"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Keywords    string `json:"keywords"`
+	H1          string `json:"h1"`
+	Text        string `json:"text"`
+}
+
+var localePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z]{2})?$`)
+
+//the language the cats rows themselves are written in
+func defaultLocale() string {
+	return envOr("CATS_DEFAULT_LOCALE", "ru")
+}
+
+func configuredLocales() []string {
+	var locales []string
+	for _, l := range strings.Split(os.Getenv("CATS_LOCALES"), ",") {
+		l = strings.TrimSpace(l)
+		if l != "" && l != defaultLocale() {
+			locales = append(locales, l)
+		}
+	}
+	return locales
+}
+
+//kk-KZ -> kk -> CATS_FALLBACK_LOCALES..., stops at the default locale since that's the base row
+func localeChain(locale string) []string {
+	var chain []string
+	add := func(l string) bool {
+		if l == "" || l == defaultLocale() {
+			return false
+		}
+		for _, v := range chain {
+			if v == l {
+				return true
+			}
+		}
+		chain = append(chain, l)
+		return true
+	}
+
+	if !add(locale) {
+		return nil
+	}
+	if i := strings.Index(locale, "-"); i > 0 && !add(locale[:i]) {
+		return chain
+	}
+	for _, l := range strings.Split(os.Getenv("CATS_FALLBACK_LOCALES"), ",") {
+		if !add(strings.TrimSpace(l)) {
+			break
+		}
+	}
+	return chain
+}
+
+func pick(base string, ts []*translation, field func(*translation) string) string {
+	for _, t := range ts {
+		if v := field(t); v != "" {
+			return v
+		}
+	}
+	return base
+}
+
+//translations of the given cats, ordered like the chain
+func loadTranslations(ctx context.Context, conn *pgxpool.Pool, chain []string, ids []int32) (map[int32][]*translation, error) {
+	var rows []*translation
+	err := pgxscan.Select(ctx, conn, &rows, `SELECT * FROM cats_i18n WHERE locale = ANY($1) AND ($2::int[] IS NULL OR cat_id = ANY($2))`, chain, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	rank := map[string]int{}
+	for i, l := range chain {
+		rank[l] = i
+	}
+	byCat := map[int32][]*translation{}
+	for _, t := range rows {
+		byCat[t.CatId] = append(byCat[t.CatId], t)
+	}
+	for _, ts := range byCat {
+		sort.SliceStable(ts, func(i, j int) bool { return rank[ts[i].Locale] < rank[ts[j].Locale] })
+	}
+	return byCat, nil
+}
+
+func localizeCat(ctx context.Context, conn *pgxpool.Pool, c *cat, locale string) error {
+	chain := localeChain(locale)
+	if len(chain) == 0 {
+		return nil
+	}
+
+	byCat, err := loadTranslations(ctx, conn, chain, []int32{c.Id})
+	if err != nil {
+		return err
+	}
+
+	ts := byCat[c.Id]
+	c.Name = pick(c.Name, ts, func(t *translation) string { return t.Name })
+	c.Title = pick(c.Title, ts, func(t *translation) string { return t.Title })
+	c.Description = pick(c.Description, ts, func(t *translation) string { return t.Description })
+	c.Keywords = pick(c.Keywords, ts, func(t *translation) string { return t.Keywords })
+	c.H1 = pick(c.H1, ts, func(t *translation) string { return t.H1 })
+	c.Text = pick(c.Text, ts, func(t *translation) string { return t.Text })
+	return nil
+}
+
+func localizeSummaries(ctx context.Context, conn *pgxpool.Pool, cats []*catSummary, locale string) error {
+	chain := localeChain(locale)
+	if len(chain) == 0 {
+		return nil
+	}
+
+	byCat, err := loadTranslations(ctx, conn, chain, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range cats {
+		c.Name = pick(c.Name, byCat[c.Id], func(t *translation) string { return t.Name })
+	}
+	return nil
+}
+
+//admin side
+func saveTranslation(ctx context.Context, conn *pgxpool.Pool, instructions string) (string, error) {
+	var t translation
+	if err := json.Unmarshal([]byte(instructions), &t); err != nil {
+		return "", err
+	}
+
+	if !localePattern.MatchString(t.Locale) || t.Locale == defaultLocale() {
+		return "", errors.New("locale must look like en or kk-KZ and differ from " + defaultLocale())
+	}
+
+	err := conn.QueryRow(ctx, `INSERT INTO cats_i18n (cat_id, locale, name, title, description, keywords, h1, text) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (cat_id, locale) DO UPDATE SET name = $3, title = $4, description = $5, keywords = $6, h1 = $7, text = $8 RETURNING id`,
+		t.CatId, t.Locale, t.Name, t.Title, t.Description, t.Keywords, t.H1, t.Text).Scan(&t.Id)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func deleteTranslation(ctx context.Context, conn *pgxpool.Pool, instructions string) error {
+	var t translation
+	if err := json.Unmarshal([]byte(instructions), &t); err != nil {
+		return err
+	}
+
+	ct, err := conn.Exec(ctx, `DELETE FROM cats_i18n WHERE cat_id = $1 AND locale = $2`, t.CatId, t.Locale)
+	if err != nil {
+		return err
+	}
+
+	if ct.RowsAffected() == 0 {
+		return errors.New("no translation found")
+	}
+
+	return nil
+}
+
+func readTranslations(ctx context.Context, conn *pgxpool.Pool, instructions string) (string, error) {
+	var t translation
+	if err := json.Unmarshal([]byte(instructions), &t); err != nil {
+		return "", err
+	}
+
+	var ts []*translation
+	if err := pgxscan.Select(ctx, conn, &ts, `SELECT * FROM cats_i18n WHERE cat_id = $1 ORDER BY locale`, t.CatId); err != nil {
+		return "", err
+	}
+
+	if ts == nil {
+		return "[]", nil
+	}
+
+	b, err := json.Marshal(ts)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+type missingTranslation struct {
+	Id      int32    `json:"id"`
+	Slug    string   `json:"slug"`
+	Missing []string `json:"missing"`
+}
+
+//per locale, the cats whose filled in base fields have no translation
+func missingTranslations(ctx context.Context, conn *pgxpool.Pool, instructions string) (string, error) {
+	var t translation
+	if err := json.Unmarshal([]byte(instructions), &t); err != nil {
+		return "", err
+	}
+
+	locales := configuredLocales()
+	if t.Locale != "" {
+		locales = []string{t.Locale}
+	}
+	if len(locales) == 0 {
+		return "", errors.New("no locale given and CATS_LOCALES is empty")
+	}
+
+	var cats []*cat
+	if err := pgxscan.Select(ctx, conn, &cats, `SELECT * FROM cats ORDER BY sort_order ASC`); err != nil {
+		return "", err
+	}
+
+	report := map[string][]missingTranslation{}
+	for _, l := range locales {
+		byCat, err := loadTranslations(ctx, conn, []string{l}, nil)
+		if err != nil {
+			return "", err
+		}
+
+		report[l] = []missingTranslation{}
+		for _, c := range cats {
+			tr := &translation{}
+			if ts := byCat[c.Id]; len(ts) > 0 {
+				tr = ts[0]
+			}
+
+			var missing []string
+			for _, f := range [][3]string{
+				{"name", c.Name, tr.Name},
+				{"title", c.Title, tr.Title},
+				{"description", c.Description, tr.Description},
+				{"keywords", c.Keywords, tr.Keywords},
+				{"h1", c.H1, tr.H1},
+				{"text", c.Text, tr.Text},
+			} {
+				if f[1] != "" && f[2] == "" {
+					missing = append(missing, f[0])
+				}
+			}
+			if len(missing) > 0 {
+				report[l] = append(report[l], missingTranslation{c.Id, c.Slug, missing})
+			}
+		}
+	}
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
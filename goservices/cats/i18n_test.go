@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLocaleChain(t *testing.T) {
+	t.Setenv("CATS_DEFAULT_LOCALE", "ru")
+	cases := []struct {
+		fallback string
+		locale   string
+		want     []string
+	}{
+		{"en", "", nil},
+		{"en", "ru", nil},
+		{"en", "en", []string{"en"}},
+		{"en", "kk", []string{"kk", "en"}},
+		{"en", "kk-KZ", []string{"kk-KZ", "kk", "en"}},
+		{"en", "en-GB", []string{"en-GB", "en"}},
+		//the default locale ends the chain, the base row comes after it anyway
+		{"en", "ru-KZ", []string{"ru-KZ"}},
+		{"kk, ru, en", "uz", []string{"uz", "kk"}},
+		{"", "kk-KZ", []string{"kk-KZ", "kk"}},
+		{"en,,de", "kk", []string{"kk", "en"}},
+	}
+	for _, c := range cases {
+		t.Setenv("CATS_FALLBACK_LOCALES", c.fallback)
+		if got := localeChain(c.locale); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("localeChain(%q) with fallback %q = %q, want %q", c.locale, c.fallback, got, c.want)
+		}
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	t.Setenv("CATS_DEFAULT_LOCALE", "ru")
+	t.Setenv("CATS_LOCALES", "ru,kk,en")
+	t.Setenv("CATS_FALLBACK_LOCALES", "en")
+	cases := []struct {
+		op     string
+		c      cat
+		locale string
+		want   string
+	}{
+		{"read_all", cat{}, "", "all|"},
+		{"read", cat{Id: 5}, "ru", "id:5|"},
+		{"read", cat{Id: 5, Slug: "plumbing"}, "kk", "id:5|kk,en"},
+		{"read", cat{Slug: "plumbing"}, "en", "slug:plumbing|en"},
+		//a locale without its own rows would fill the cache with copies of the fallback
+		{"read", cat{Id: 5}, "kk-KZ", ""},
+		{"read", cat{Id: 5}, "de", ""},
+	}
+	for _, c := range cases {
+		if got := cacheKey(c.op, c.c, c.locale); got != c.want {
+			t.Errorf("cacheKey(%s, %+v, %q) = %q, want %q", c.op, c.c, c.locale, got, c.want)
+		}
+	}
+}
+
+func TestLocalePattern(t *testing.T) {
+	for l, want := range map[string]bool{"en": true, "kk-KZ": true, "fil": true, "EN": false, "en-gb": false, "en_GB": false, "e": false, "en-GB;drop": false} {
+		if localePattern.MatchString(l) != want {
+			t.Errorf("localePattern on %q != %v", l, want)
+		}
+	}
+}
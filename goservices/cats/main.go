@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net"
 	"os"
@@ -15,6 +16,7 @@ import (
 	"google.golang.org/grpc/credentials"
 
 	"go.mods/grpcc"
+	"go.mods/outbox"
 )
 
 type cat struct {
@@ -32,6 +34,7 @@ type cat struct {
 	SortOrder   int32     `json:"sort_order"`
 	CreatedAt   time.Time `json:"created_at"`
 	Extra       string    `json:"extra"`
+	Version     int32     `json:"version"`
 }
 
 type catSummary struct {
@@ -53,11 +56,26 @@ type cell struct {
 
 var service = "cats"
 
+//outbox topics, written in the transaction of the change, auth relays them to its consumers
+const (
+	topicCatCreated  = "cat.created"
+	topicCatUpdated  = "cat.updated"
+	topicCatDeleted  = "cat.deleted"
+	topicCatImported = "cat.imported"
+)
+
+func catKey(id int32) string {
+	return strconv.Itoa(int(id))
+}
+
 func result(status string, data string) string {
 	return `{"name":"` + service + `","status":` + status + `,"data":` + data + `}`
 }
 
-type server struct{}
+//streaming comes from auth, cats only answers PassData
+type server struct {
+	grpcc.UnimplementedCommunicationServiceServer
+}
 
 func (*server) PassData(ctx context.Context, req *grpcc.DataRequest) (*grpcc.DataResponse, error) {
 
@@ -65,14 +83,44 @@ func (*server) PassData(ctx context.Context, req *grpcc.DataRequest) (*grpcc.Dat
 	res.Result = result("false", `"noop or error"`)
 
 	instructions := req.GetData().GetInstructions()
+	op := req.GetData().GetAction()
 
+	//patch checks its own field types to report them properly
 	var c cat
-	if err := json.Unmarshal([]byte(instructions), &c); err != nil {
+	if err := json.Unmarshal([]byte(instructions), &c); err != nil && op != "patch" {
 		res.Result = result("false", service+" couldn't unmarshal instructions "+err.Error())
 		return &res, err
 	}
 
-	op := req.GetData().GetAction()
+	//read and read_all take an optional locale, see localeChain
+	loc := struct {
+		Locale string `json:"locale"`
+	}{}
+	_ = json.Unmarshal([]byte(instructions), &loc)
+	if loc.Locale != "" && !localePattern.MatchString(loc.Locale) {
+		res.Result = result("false", `"bad locale"`)
+		return &res, errors.New("bad locale " + strconv.Quote(loc.Locale))
+	}
+
+	//cached reads don't need the database, pages of read_all are never cached
+	page, paged := pageRequest(instructions)
+	gen := cache.generation()
+	key := cacheKey(op, c, loc.Locale)
+	if op == "read" || (op == "read_all" && !paged) {
+		if str, ok := cache.get(key); ok {
+			res.Result = result("true", str)
+			return &res, nil
+		}
+	}
+
+	if op == "cache-stats" {
+		str, err := cache.stats()
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
 
 	ctx = context.Background()
 	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
@@ -84,7 +132,13 @@ func (*server) PassData(ctx context.Context, req *grpcc.DataRequest) (*grpcc.Dat
 	summary := "id, parent_id, name, slug, sort_order, image, created_at, extra"
 
 	if op == "create" {
-		row := conn.QueryRow(ctx, "INSERT INTO cats (parent_id, name, slug, title, description, keywords, author, h1, text, image, sort_order, created_at, extra)"+
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return &res, err
+		}
+		defer tx.Rollback(ctx)
+
+		row := tx.QueryRow(ctx, "INSERT INTO cats (parent_id, name, slug, title, description, keywords, author, h1, text, image, sort_order, created_at, extra)"+
 			"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) RETURNING id",
 			c.ParentId, c.Name, c.Slug, c.Title, c.Description, c.Keywords, c.Author, c.H1, c.Text, c.Image, c.SortOrder, c.CreatedAt, c.Extra)
 
@@ -97,18 +151,28 @@ func (*server) PassData(ctx context.Context, req *grpcc.DataRequest) (*grpcc.Dat
 
 		//check for duplicate slugs
 		var dup cat
-		_ = pgxscan.Get(ctx, conn, &dup, `SELECT * FROM cats WHERE slug=$1`, c.Slug)
+		_ = pgxscan.Get(ctx, tx, &dup, `SELECT * FROM cats WHERE slug=$1`, c.Slug)
 		if dup.Id > 0 {
 			c.Slug += "-" + strconv.Itoa(int(c.Id))
-			if _, err = conn.Exec(ctx, `UPDATE cats SET sort_order = $1, slug = $2 WHERE id = $1`, id, c.Slug); err != nil {
+			if _, err = tx.Exec(ctx, `UPDATE cats SET sort_order = $1, slug = $2 WHERE id = $1`, id, c.Slug); err != nil {
 				c.SortOrder = 0
 			}
 		} else {
-			if _, err = conn.Exec(ctx, `UPDATE cats SET sort_order = $1 WHERE id = $1`, id); err != nil {
+			if _, err = tx.Exec(ctx, `UPDATE cats SET sort_order = $1 WHERE id = $1`, id); err != nil {
 				c.SortOrder = 0
 			}
 		}
 
+		if err = outbox.Write(ctx, tx, topicCatCreated, catKey(c.Id), c); err != nil {
+			return &res, err
+		}
+
+		if err = tx.Commit(ctx); err != nil {
+			return &res, err
+		}
+
+		cache.invalidate(ctx, conn)
+
 		b, err := json.Marshal(c)
 		if err != nil {
 			res.Result = result("false", `"insert success, marshal fail"`)
@@ -132,10 +196,41 @@ func (*server) PassData(ctx context.Context, req *grpcc.DataRequest) (*grpcc.Dat
 		if len(cats) > 0 {
 			res.Result = result("false", `"delete children"`)
 		} else {
-			_, err = conn.Exec(ctx, "DELETE FROM cats WHERE id=$1", c.Id)
+			tx, err := conn.Begin(ctx)
 			if err != nil {
 				return &res, err
 			}
+			defer tx.Rollback(ctx)
+
+			_, err = tx.Exec(ctx, "DELETE FROM cats WHERE id=$1", c.Id)
+			if err != nil {
+				return &res, err
+			}
+
+			_, err = tx.Exec(ctx, "DELETE FROM cats_media WHERE album_id=$1", c.Id)
+			if err != nil {
+				return &res, err
+			}
+
+			_, err = tx.Exec(ctx, "DELETE FROM cats_i18n WHERE cat_id=$1", c.Id)
+			if err != nil {
+				return &res, err
+			}
+
+			_, err = tx.Exec(ctx, "DELETE FROM cats_attributes WHERE cat_id=$1", c.Id)
+			if err != nil {
+				return &res, err
+			}
+
+			if err = outbox.Write(ctx, tx, topicCatDeleted, catKey(c.Id), c); err != nil {
+				return &res, err
+			}
+
+			if err = tx.Commit(ctx); err != nil {
+				return &res, err
+			}
+
+			cache.invalidate(ctx, conn)
 
 			if err = os.RemoveAll(os.Getenv("UPLOADS_DIR") + "cats/" + strconv.Itoa(int(c.Id))); err != nil {
 				return &res, err
@@ -158,16 +253,29 @@ func (*server) PassData(ctx context.Context, req *grpcc.DataRequest) (*grpcc.Dat
 			}
 		}
 
+		if err := localizeCat(ctx, conn, &c, loc.Locale); err != nil {
+			return &res, err
+		}
+
 		b, err := json.Marshal(c)
 		if err != nil {
 			res.Result = result("false", `"read success, marshal fail"`)
 			return &res, nil
 		}
 
+		cache.put(key, string(b), gen)
 		res.Result = result("true", string(b))
 	}
 
-	if op == "read_all" {
+	if op == "read_all" && paged {
+		str, err := readAllPage(ctx, conn, page, loc.Locale)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+	}
+
+	if op == "read_all" && !paged {
 		var cats []*catSummary
 		if err = pgxscan.Select(ctx, conn, &cats, `SELECT `+summary+` FROM cats ORDER BY sort_order ASC`); err != nil {
 			return &res, err
@@ -178,11 +286,16 @@ func (*server) PassData(ctx context.Context, req *grpcc.DataRequest) (*grpcc.Dat
 			return &res, nil
 		}
 
+		if err = localizeSummaries(ctx, conn, cats, loc.Locale); err != nil {
+			return &res, err
+		}
+
 		b, err := json.Marshal(cats)
 		if err != nil {
 			return &res, err
 		}
 
+		cache.put(key, string(b), gen)
 		res.Result = result("true", string(b))
 	}
 
@@ -228,24 +341,12 @@ func (*server) PassData(ctx context.Context, req *grpcc.DataRequest) (*grpcc.Dat
 			return &res, err
 		}
 
-		//check for duplicate slugs
-		var dup cat
-		_ = pgxscan.Get(ctx, conn, &dup, `SELECT * FROM cats WHERE slug=$1`, c.Slug)
-		if dup.Id > 0 {
-			c.Slug += "-" + strconv.Itoa(int(c.Id))
-		}
-
-		ct, err := conn.Exec(ctx, `UPDATE cats SET parent_id = $1, name = $2, slug = $3, title = $4, description = $5, keywords = $6, author = $7, h1 = $8, text = $9, image = $10, sort_order = $11, created_at = $12, extra = $13 WHERE id = $14`,
-			c.ParentId, c.Name, c.Slug, c.Title, c.Description, c.Keywords, c.Author, c.H1, c.Text, c.Image, c.SortOrder, c.CreatedAt, c.Extra, c.Id)
-		if err != nil {
+		//created_at never changes, version has to match the one the editor loaded
+		if err := updateCat(ctx, conn, c); err != nil {
 			return &res, err
 		}
 
-		if ct.RowsAffected() == 0 {
-			res.Result = result("false", `"no rows updated"`)
-			return &res, nil
-		}
-
+		cache.invalidate(ctx, conn)
 		res.Result = result("true", `"updated successfully"`)
 		return &res, nil
 	}
@@ -256,25 +357,235 @@ func (*server) PassData(ctx context.Context, req *grpcc.DataRequest) (*grpcc.Dat
 			return &res, err
 		}
 
-		ct, err := conn.Exec(ctx, `Update cats SET `+c.Column+` = $1 WHERE id = $2`, c.Value, c.Id)
+		n, err := updateCell(ctx, conn, c)
 		if err != nil {
 			log.Println(err)
 			return &res, err
 		}
 
-		if ct.RowsAffected() == 0 {
+		if n == 0 {
 			res.Result = result("false", `"no rows found"`)
 			return &res, nil
 		}
 
+		cache.invalidate(ctx, conn)
 		res.Result = result("true", `"updated successfully"`)
 		return &res, nil
 	}
 
+	if op == "patch" {
+		str, err := patchCat(ctx, conn, instructions)
+		if err != nil {
+			return &res, err
+		}
+		cache.invalidate(ctx, conn)
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	//gallery
+	if op == "media-list" {
+		str, err := mediaList(ctx, conn, instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "media-add" {
+		str, err := mediaAdd(ctx, conn, instructions)
+		if err != nil {
+			return &res, err
+		}
+		cache.invalidate(ctx, conn)
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "media-caption" {
+		if err := mediaCaption(ctx, conn, instructions); err != nil {
+			return &res, err
+		}
+		res.Result = result("true", `"updated successfully"`)
+		return &res, nil
+	}
+
+	if op == "media-sort" {
+		if err := mediaSort(ctx, conn, instructions); err != nil {
+			return &res, err
+		}
+		res.Result = result("true", `"sorted successfully"`)
+		return &res, nil
+	}
+
+	if op == "media-delete" {
+		if err := mediaDelete(ctx, conn, instructions); err != nil {
+			return &res, err
+		}
+		cache.invalidate(ctx, conn)
+		res.Result = result("true", `"media deleted:`+strconv.Itoa(int(c.Id))+`"`)
+		return &res, nil
+	}
+
+	if op == "media-cover" {
+		if err := mediaCover(ctx, conn, instructions); err != nil {
+			return &res, err
+		}
+		cache.invalidate(ctx, conn)
+		res.Result = result("true", `"cover updated"`)
+		return &res, nil
+	}
+
+	if op == "media-sync" {
+		str, err := mediaSync(ctx, conn, instructions)
+		if err != nil {
+			return &res, err
+		}
+		cache.invalidate(ctx, conn)
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	//translations
+	if op == "translate" {
+		str, err := saveTranslation(ctx, conn, instructions)
+		if err != nil {
+			return &res, err
+		}
+		cache.invalidate(ctx, conn)
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "delete-translation" {
+		if err := deleteTranslation(ctx, conn, instructions); err != nil {
+			return &res, err
+		}
+		cache.invalidate(ctx, conn)
+		res.Result = result("true", `"translation deleted"`)
+		return &res, nil
+	}
+
+	if op == "read-translations" {
+		str, err := readTranslations(ctx, conn, instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "missing-translations" {
+		str, err := missingTranslations(ctx, conn, instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	//order form attributes
+	if op == "set-attributes" {
+		if err := setAttributes(ctx, conn, instructions); err != nil {
+			return &res, err
+		}
+		res.Result = result("true", `"attributes saved"`)
+		return &res, nil
+	}
+
+	if op == "read-attributes" {
+		str, err := readAttributes(ctx, conn, instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "delete-attributes" {
+		if err := deleteAttributes(ctx, conn, instructions); err != nil {
+			return &res, err
+		}
+		res.Result = result("true", `"attributes deleted"`)
+		return &res, nil
+	}
+
+	//catalogue import/export
+	if op == "export" {
+		str, err := catalogueExport(ctx, conn, instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "import" {
+		str, err := catalogueImport(ctx, conn, instructions)
+		if err != nil {
+			return &res, err
+		}
+		cache.invalidate(ctx, conn)
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	//seo
+	if op == "sitemap" {
+		str, err := sitemap(ctx, conn)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
+	if op == "json-ld" {
+		str, err := jsonLd(ctx, conn, instructions)
+		if err != nil {
+			return &res, err
+		}
+		res.Result = result("true", str)
+		return &res, nil
+	}
+
 	return &res, nil
 }
 
+//one-off commands, e.g. go run . sitemap
+func runCommand(name string) {
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	var str string
+	switch name {
+	case "sitemap":
+		str, err = sitemap(ctx, conn)
+	default:
+		err = errors.New("unknown command " + name)
+	}
+	if err != nil {
+		log.Fatal(service+" "+name+": ", err)
+	}
+
+	log.Println(str)
+}
+
 func main() {
+	if err := migrate(); err != nil {
+		log.Fatal(service+" migrations failed: ", err)
+	}
+
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1])
+		return
+	}
+
 	ok, err := credentials.NewServerTLSFromFile(os.Getenv("SERVICEKEY_PEM"), os.Getenv("SERVICEKEY_KEY"))
 	if err != nil {
 		log.Fatalf("Failed to setup TLS:%v", err)
@@ -285,6 +596,10 @@ func main() {
 		log.Fatal(service + "service failed to listen ", err)
 	}
 
+	if cache.notify {
+		go cache.listen()
+	}
+
 	log.Println("Hi, I'm a " + service + " grpc comm. service listening...")
 
 	s := grpc.NewServer(grpc.Creds(ok))
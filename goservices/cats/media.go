@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type media struct {
+	Id        int32  `json:"id"`
+	AlbumId   int32  `json:"album_id"`
+	Name      string `json:"name"`
+	Alt       string `json:"alt"`
+	Title     string `json:"title"`
+	Text      string `json:"text"`
+	Link      string `json:"link"`
+	Width     int32  `json:"width"`
+	Height    int32  `json:"height"`
+	SortOrder int32  `json:"sort_order"`
+}
+
+//gallery files live in UPLOADS_DIR/cats/{album_id}/ with thumbnails in mini/
+func albumDir(albumId int32) string {
+	return os.Getenv("UPLOADS_DIR") + "cats/" + strconv.Itoa(int(albumId)) + "/"
+}
+
+func validMediaName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name
+}
+
+func imageSize(path string) (int32, int32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	conf, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return int32(conf.Width), int32(conf.Height), nil
+}
+
+func removeMediaFiles(m media) error {
+	dir := albumDir(m.AlbumId)
+	for _, p := range []string{dir + m.Name, dir + "mini/" + m.Name} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+//if the removed image was the category cover, the first remaining image takes its place
+func resetCover(ctx context.Context, tx pgx.Tx, albumId int32, removed string) error {
+	var first []*media
+	if err := pgxscan.Select(ctx, tx, &first, `SELECT * FROM cats_media WHERE album_id = $1 ORDER BY sort_order ASC LIMIT 1`, albumId); err != nil {
+		return err
+	}
+
+	cover := ""
+	if len(first) > 0 {
+		cover = first[0].Name
+	}
+
+	_, err := tx.Exec(ctx, `UPDATE cats SET image = $1 WHERE id = $2 AND image = $3`, cover, albumId, removed)
+	return err
+}
+
+//drops the row and moves the cover along in one go, the caller removes the files
+func deleteMedia(ctx context.Context, conn *pgxpool.Pool, m media) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err = tx.Exec(ctx, `DELETE FROM cats_media WHERE id = $1`, m.Id); err != nil {
+		return err
+	}
+	if err = resetCover(ctx, tx, m.AlbumId, m.Name); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func mediaList(ctx context.Context, conn *pgxpool.Pool, instructions string) (string, error) {
+	var m media
+	if err := json.Unmarshal([]byte(instructions), &m); err != nil {
+		return "", err
+	}
+
+	if p, paged := pageRequest(instructions); paged {
+		return mediaPage(ctx, conn, m.AlbumId, p)
+	}
+
+	var items []*media
+	if err := pgxscan.Select(ctx, conn, &items, `SELECT * FROM cats_media WHERE album_id = $1 ORDER BY sort_order ASC`, m.AlbumId); err != nil {
+		return "", err
+	}
+
+	if len(items) < 1 {
+		return "[]", nil
+	}
+
+	b, err := json.Marshal(items)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+var errMediaExists = errors.New("already in the gallery")
+
+//measures the uploaded file and records it at the end of the gallery, a cover for an album without one
+//a name the album already has comes back as errMediaExists, the unique index settles concurrent adds
+func addMedia(ctx context.Context, conn *pgxpool.Pool, m *media) error {
+	w, h, err := imageSize(albumDir(m.AlbumId) + m.Name)
+	if err != nil {
+		return err
+	}
+	m.Width, m.Height = w, h
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	row := tx.QueryRow(ctx, `INSERT INTO cats_media (album_id, name, alt, title, text, link, width, height, sort_order) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, 0)
+		ON CONFLICT (album_id, name) DO NOTHING RETURNING id`,
+		m.AlbumId, m.Name, m.Alt, m.Title, m.Text, m.Link, m.Width, m.Height)
+	if err = row.Scan(&m.Id); err == pgx.ErrNoRows {
+		return errMediaExists
+	}
+	if err != nil {
+		return err
+	}
+
+	//new images go to the end of the gallery, same as new cats
+	m.SortOrder = m.Id
+	if _, err = tx.Exec(ctx, `UPDATE cats_media SET sort_order = $1 WHERE id = $1`, m.Id); err != nil {
+		return err
+	}
+
+	//first image of a category without a cover becomes the cover
+	if _, err = tx.Exec(ctx, `UPDATE cats SET image = $1 WHERE id = $2 AND image = ''`, m.Name, m.AlbumId); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+//the file itself is uploaded beforehand, here it gets measured and recorded
+func mediaAdd(ctx context.Context, conn *pgxpool.Pool, instructions string) (string, error) {
+	var m media
+	if err := json.Unmarshal([]byte(instructions), &m); err != nil {
+		return "", err
+	}
+
+	if m.AlbumId == 0 || !validMediaName(m.Name) {
+		return "", errors.New("album_id and a plain file name are required")
+	}
+
+	err := addMedia(ctx, conn, &m)
+	if err == errMediaExists {
+		return "", errors.New(m.Name + " is " + err.Error())
+	}
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func mediaCaption(ctx context.Context, conn *pgxpool.Pool, instructions string) error {
+	var m media
+	if err := json.Unmarshal([]byte(instructions), &m); err != nil {
+		return err
+	}
+
+	ct, err := conn.Exec(ctx, `UPDATE cats_media SET alt = $1, title = $2, text = $3, link = $4 WHERE id = $5`, m.Alt, m.Title, m.Text, m.Link, m.Id)
+	if err != nil {
+		return err
+	}
+
+	if ct.RowsAffected() == 0 {
+		return errors.New("no rows updated")
+	}
+
+	return nil
+}
+
+//ids come in the new display order, every image of the album exactly once
+func mediaSort(ctx context.Context, conn *pgxpool.Pool, instructions string) error {
+	order := struct {
+		AlbumId int32   `json:"album_id"`
+		Ids     []int32 `json:"ids"`
+	}{}
+	if err := json.Unmarshal([]byte(instructions), &order); err != nil {
+		return err
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	//a partial list would leave the rest wherever they were
+	var total int
+	if err = tx.QueryRow(ctx, `SELECT COUNT(*) FROM cats_media WHERE album_id = $1`, order.AlbumId).Scan(&total); err != nil {
+		return err
+	}
+	seen := map[int32]bool{}
+	for _, id := range order.Ids {
+		if seen[id] {
+			return errors.New("media " + strconv.Itoa(int(id)) + " is listed twice")
+		}
+		seen[id] = true
+	}
+	if len(order.Ids) != total {
+		return errors.New("album " + strconv.Itoa(int(order.AlbumId)) + " has " + strconv.Itoa(total) + " images, got " + strconv.Itoa(len(order.Ids)))
+	}
+
+	for i, id := range order.Ids {
+		ct, err := tx.Exec(ctx, `UPDATE cats_media SET sort_order = $1 WHERE id = $2 AND album_id = $3`, i+1, id, order.AlbumId)
+		if err != nil {
+			return err
+		}
+		if ct.RowsAffected() == 0 {
+			return errors.New("media " + strconv.Itoa(int(id)) + " not found in album " + strconv.Itoa(int(order.AlbumId)))
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+func mediaDelete(ctx context.Context, conn *pgxpool.Pool, instructions string) error {
+	var m media
+	if err := json.Unmarshal([]byte(instructions), &m); err != nil {
+		return err
+	}
+
+	if err := pgxscan.Get(ctx, conn, &m, `SELECT * FROM cats_media WHERE id = $1`, m.Id); err != nil {
+		return err
+	}
+
+	if err := deleteMedia(ctx, conn, m); err != nil {
+		return err
+	}
+
+	//the row is gone either way, a file left behind is only logged, media-sync would record it again
+	if err := removeMediaFiles(m); err != nil {
+		log.Println(service+" media "+strconv.Itoa(int(m.Id))+" files not removed: ", err)
+	}
+
+	return nil
+}
+
+func mediaCover(ctx context.Context, conn *pgxpool.Pool, instructions string) error {
+	var m media
+	if err := json.Unmarshal([]byte(instructions), &m); err != nil {
+		return err
+	}
+
+	if err := pgxscan.Get(ctx, conn, &m, `SELECT * FROM cats_media WHERE id = $1`, m.Id); err != nil {
+		return err
+	}
+
+	ct, err := conn.Exec(ctx, `UPDATE cats SET image = $1 WHERE id = $2`, m.Name, m.AlbumId)
+	if err != nil {
+		return err
+	}
+
+	if ct.RowsAffected() == 0 {
+		return errors.New("no rows updated")
+	}
+
+	return nil
+}
+
+//drops rows whose files are gone, records files that have no rows and refreshes dimensions
+func mediaSync(ctx context.Context, conn *pgxpool.Pool, instructions string) (string, error) {
+	var m media
+	if err := json.Unmarshal([]byte(instructions), &m); err != nil {
+		return "", err
+	}
+
+	var items []*media
+	if err := pgxscan.Select(ctx, conn, &items, `SELECT * FROM cats_media WHERE album_id = $1`, m.AlbumId); err != nil {
+		return "", err
+	}
+
+	report := struct {
+		Added   []string `json:"added"`
+		Removed []string `json:"removed"`
+		Resized []string `json:"resized"`
+	}{[]string{}, []string{}, []string{}}
+
+	dir := albumDir(m.AlbumId)
+	known := map[string]bool{}
+	for _, v := range items {
+		known[v.Name] = true
+
+		w, h, err := imageSize(dir + v.Name)
+		if os.IsNotExist(err) {
+			if err = deleteMedia(ctx, conn, *v); err != nil {
+				return "", err
+			}
+			report.Removed = append(report.Removed, v.Name)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if w != v.Width || h != v.Height {
+			if _, err = conn.Exec(ctx, `UPDATE cats_media SET width = $1, height = $2 WHERE id = $3`, w, h, v.Id); err != nil {
+				return "", err
+			}
+			report.Resized = append(report.Resized, v.Name)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	for _, e := range entries {
+		if e.IsDir() || known[e.Name()] {
+			continue
+		}
+
+		added := media{AlbumId: m.AlbumId, Name: e.Name()}
+		err = addMedia(ctx, conn, &added)
+		//added meanwhile, or not an image at all, either way nothing to record
+		if err == errMediaExists || err == image.ErrFormat {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		report.Added = append(report.Added, e.Name())
+	}
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"go.mods/paging"
+)
+
+//lists come back whole unless a limit or cursor is asked for, menus still need the full tree
+func pageRequest(instructions string) (paging.Request, bool) {
+	var p paging.Request
+	_ = json.Unmarshal([]byte(instructions), &p)
+	return p, p.Limit > 0 || p.Cursor != ""
+}
+
+//same order as the full lists, sort_order with id to break ties
+var sortOrderKey = paging.Key{Column: "sort_order", Cast: "int"}
+
+//collects query arguments the way paging.Plan expects
+type args []interface{}
+
+func (a *args) add(v interface{}) string {
+	*a = append(*a, v)
+	return "$" + strconv.Itoa(len(*a))
+}
+
+func readAllPage(ctx context.Context, conn *pgxpool.Pool, p paging.Request, locale string) (string, error) {
+	var a args
+	cond, order, err := p.Plan("sort_order", sortOrderKey, a.add)
+	if err != nil {
+		return "", err
+	}
+	if cond != "" {
+		cond = " WHERE " + cond
+	}
+
+	found := struct {
+		paging.Page
+		Cats []*catSummary `json:"cats"`
+	}{Cats: []*catSummary{}}
+	if err = pgxscan.Select(ctx, conn, &found.Cats, `SELECT id, parent_id, name, slug, sort_order, image, created_at, extra FROM cats`+cond+order, a...); err != nil {
+		return "", err
+	}
+
+	found.Page = p.Finish(&found.Cats, "sort_order", func(i int) (string, int64) {
+		return strconv.Itoa(int(found.Cats[i].SortOrder)), int64(found.Cats[i].Id)
+	})
+
+	if err = localizeSummaries(ctx, conn, found.Cats, locale); err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(found)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func mediaPage(ctx context.Context, conn *pgxpool.Pool, albumId int32, p paging.Request) (string, error) {
+	a := args{albumId}
+	cond, order, err := p.Plan("sort_order", sortOrderKey, a.add)
+	if err != nil {
+		return "", err
+	}
+	if cond != "" {
+		cond = " AND " + cond
+	}
+
+	found := struct {
+		paging.Page
+		Media []*media `json:"media"`
+	}{Media: []*media{}}
+	if err = pgxscan.Select(ctx, conn, &found.Media, `SELECT * FROM cats_media WHERE album_id = $1`+cond+order, a...); err != nil {
+		return "", err
+	}
+
+	found.Page = p.Finish(&found.Media, "sort_order", func(i int) (string, int64) {
+		return strconv.Itoa(int(found.Media[i].SortOrder)), int64(found.Media[i].Id)
+	})
+
+	b, err := json.Marshal(found)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
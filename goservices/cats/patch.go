@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"go.mods/outbox"
+)
+
+//what a column accepts when written through patch or update-cell
+type fieldRule struct {
+	number bool
+	max    int
+	notNil bool
+}
+
+var patchable = map[string]fieldRule{
+	"parent_id":   {number: true},
+	"name":        {max: 255, notNil: true},
+	"slug":        {max: 255, notNil: true},
+	"title":       {max: 255},
+	"description": {max: 1000},
+	"keywords":    {max: 1000},
+	"author":      {max: 255},
+	"h1":          {max: 255},
+	"text":        {max: 100000},
+	"image":       {max: 255},
+	"sort_order":  {number: true},
+	"extra":       {max: 10000},
+}
+
+var immutable = map[string]bool{"id": true, "created_at": true, "version": true}
+
+type fieldError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+type validationError []fieldError
+
+func (v validationError) Error() string {
+	b, _ := json.Marshal(v)
+	return "invalid fields: " + string(b)
+}
+
+//checks a single value against its rule and returns it ready for the query
+func checkField(field string, raw json.RawMessage) (interface{}, string) {
+	if immutable[field] {
+		return nil, "immutable"
+	}
+	rule, ok := patchable[field]
+	if !ok {
+		return nil, "unknown field"
+	}
+
+	if rule.number {
+		var n int32
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return nil, "must be a 32 bit integer"
+		}
+		if n < 0 {
+			return nil, "must not be negative"
+		}
+		return n, ""
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, "must be a string"
+	}
+	if rule.notNil && strings.TrimSpace(s) == "" {
+		return nil, "must not be empty"
+	}
+	if utf8.RuneCountInString(s) > rule.max {
+		return nil, "longer than " + strconv.Itoa(rule.max) + " characters"
+	}
+	if field == "slug" && !slugPattern.MatchString(s) {
+		return nil, "only a-z, 0-9, - and _ allowed"
+	}
+	if field == "image" && s != "" && !validMediaName(s) {
+		return nil, "must be a plain file name"
+	}
+	return s, ""
+}
+
+//rules that need the database: unique slugs and a parent that exists and isn't a descendant
+func checkRelations(ctx context.Context, conn *pgxpool.Pool, id int32, values map[string]interface{}) validationError {
+	var errs validationError
+
+	if slug, ok := values["slug"].(string); ok {
+		var dup []*catSummary
+		_ = pgxscan.Select(ctx, conn, &dup, `SELECT id, parent_id FROM cats WHERE slug = $1 AND id != $2`, slug, id)
+		if len(dup) > 0 {
+			errs = append(errs, fieldError{"slug", "already taken"})
+		}
+	}
+
+	if parent, ok := values["parent_id"].(int32); ok && parent != 0 {
+		for p := parent; p != 0; {
+			if p == id {
+				errs = append(errs, fieldError{"parent_id", "would create a cycle"})
+				break
+			}
+			var next catSummary
+			if err := pgxscan.Get(ctx, conn, &next, `SELECT id, parent_id FROM cats WHERE id = $1`, p); err != nil {
+				errs = append(errs, fieldError{"parent_id", "parent " + strconv.Itoa(int(p)) + " not found"})
+				break
+			}
+			p = next.ParentId
+		}
+	}
+
+	return errs
+}
+
+//the outbox message goes out with the write, the caller commits
+func writeFields(ctx context.Context, tx pgx.Tx, id int32, version int32, values map[string]interface{}) (int64, error) {
+	var sets []string
+	var args []interface{}
+	for _, f := range sortedKeys(values) {
+		args = append(args, values[f])
+		sets = append(sets, f+" = $"+strconv.Itoa(len(args)))
+	}
+
+	args = append(args, id)
+	sql := `UPDATE cats SET ` + strings.Join(sets, ", ") + `, version = version + 1 WHERE id = $` + strconv.Itoa(len(args))
+	if version != 0 {
+		args = append(args, version)
+		sql += ` AND version = $` + strconv.Itoa(len(args))
+	}
+
+	ct, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return 0, err
+	}
+	if ct.RowsAffected() == 0 {
+		return 0, nil
+	}
+
+	change := struct {
+		Id     int32                  `json:"id"`
+		Fields map[string]interface{} `json:"fields"`
+	}{id, values}
+	return ct.RowsAffected(), outbox.Write(ctx, tx, topicCatUpdated, catKey(id), change)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	var keys []string
+	for k := range patchable {
+		if _, ok := m[k]; ok {
+			keys = append(keys, k)
+		}
+	}
+	//map order is random, keep the statement stable
+	sort.Strings(keys)
+	return keys
+}
+
+//writes only the fields named in mask, version must match the one the editor loaded
+func patchCat(ctx context.Context, conn *pgxpool.Pool, instructions string) (string, error) {
+	var in map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(instructions), &in); err != nil {
+		return "", err
+	}
+
+	var id, version int32
+	var mask []string
+	if err := json.Unmarshal(in["id"], &id); err != nil || id == 0 {
+		return "", errors.New("id is required")
+	}
+	if err := json.Unmarshal(in["version"], &version); err != nil || version == 0 {
+		return "", errors.New("version is required")
+	}
+	if err := json.Unmarshal(in["mask"], &mask); err != nil || len(mask) == 0 {
+		return "", errors.New("mask must list the fields to update")
+	}
+
+	var errs validationError
+	values := map[string]interface{}{}
+	for _, f := range mask {
+		raw, ok := in[f]
+		if !ok {
+			errs = append(errs, fieldError{f, "in mask but no value given"})
+			continue
+		}
+		v, msg := checkField(f, raw)
+		if msg != "" {
+			errs = append(errs, fieldError{f, msg})
+			continue
+		}
+		values[f] = v
+	}
+	if len(errs) == 0 {
+		errs = checkRelations(ctx, conn, id, values)
+	}
+	if len(errs) > 0 {
+		return "", errs
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	n, err := writeFields(ctx, tx, id, version, values)
+	if err != nil {
+		return "", err
+	}
+
+	var c cat
+	if err = pgxscan.Get(ctx, tx, &c, `SELECT * FROM cats WHERE id = $1`, id); err != nil {
+		return "", err
+	}
+	if n == 0 {
+		return "", errors.New("version conflict: category " + strconv.Itoa(int(id)) + " is at version " + strconv.Itoa(int(c.Version)) + ", reload and try again")
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+//update replaces every editable column, it goes through the same rules as patch and needs the version too
+func updateCat(ctx context.Context, conn *pgxpool.Pool, c cat) error {
+	if c.Id == 0 {
+		return errors.New("id is required")
+	}
+	if c.Version == 0 {
+		return errors.New("version is required")
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	var in map[string]json.RawMessage
+	if err = json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+
+	var errs validationError
+	values := map[string]interface{}{}
+	for f := range patchable {
+		v, msg := checkField(f, in[f])
+		if msg != "" {
+			errs = append(errs, fieldError{f, msg})
+			continue
+		}
+		values[f] = v
+	}
+	if len(errs) == 0 {
+		errs = checkRelations(ctx, conn, c.Id, values)
+	}
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+		return errs
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	n, err := writeFields(ctx, tx, c.Id, c.Version, values)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		var current int32
+		if err = tx.QueryRow(ctx, `SELECT version FROM cats WHERE id = $1`, c.Id).Scan(&current); err != nil {
+			return err
+		}
+		return errors.New("version conflict: category " + strconv.Itoa(int(c.Id)) + " is at version " + strconv.Itoa(int(current)) + ", reload and try again")
+	}
+
+	return tx.Commit(ctx)
+}
+
+//the old single column write, now limited to patchable columns and typed values
+func updateCell(ctx context.Context, conn *pgxpool.Pool, cl cell) (int64, error) {
+	raw, _ := json.Marshal(cl.Value)
+	if rule, ok := patchable[cl.Column]; ok && rule.number {
+		raw = json.RawMessage(cl.Value)
+	}
+
+	v, msg := checkField(cl.Column, raw)
+	if msg != "" {
+		return 0, validationError{{cl.Column, msg}}
+	}
+
+	values := map[string]interface{}{cl.Column: v}
+	if errs := checkRelations(ctx, conn, cl.Id, values); len(errs) > 0 {
+		return 0, errs
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	n, err := writeFields(ctx, tx, cl.Id, 0, values)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, tx.Commit(ctx)
+}
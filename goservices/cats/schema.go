@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"go.mods/outbox"
+)
+
+//changes on top of the initial dump, every statement must be safe to run again on each start
+var migrations = []string{
+	`ALTER TABLE cats ADD COLUMN IF NOT EXISTS version integer DEFAULT 1 NOT NULL`,
+	`CREATE TABLE IF NOT EXISTS cats_i18n (
+		id serial PRIMARY KEY,
+		cat_id integer NOT NULL,
+		locale text NOT NULL,
+		name text DEFAULT ''::text NOT NULL,
+		title text DEFAULT ''::text NOT NULL,
+		description text DEFAULT ''::text NOT NULL,
+		keywords text DEFAULT ''::text NOT NULL,
+		h1 text DEFAULT ''::text NOT NULL,
+		text text DEFAULT ''::text NOT NULL,
+		UNIQUE (cat_id, locale)
+	)`,
+	`CREATE TABLE IF NOT EXISTS cats_attributes (
+		cat_id integer PRIMARY KEY,
+		schema jsonb NOT NULL
+	)`,
+	//one row per file, copies from before the index go first
+	`DELETE FROM cats_media a USING cats_media b WHERE a.album_id = b.album_id AND a.name = b.name AND a.id > b.id`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS cats_media_album_name_idx ON cats_media (album_id, name)`,
+}
+
+func migrate() error {
+	ctx := context.Background()
+	conn, err := pgxpool.Connect(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	//the outbox is shared with auth, whichever starts first makes it
+	for _, m := range append(append([]string{}, outbox.Migrations...), migrations...) {
+		if _, err = conn.Exec(ctx, m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
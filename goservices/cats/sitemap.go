@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+//sitemaps.org allows at most 50000 urls per file
+const sitemapMaxUrls = 50000
+
+//url layout of the public site, every part can be overridden from the env
+type seoConfig struct {
+	BaseUrl    string
+	StaticUrl  string
+	CatPath    string
+	TownPath   string
+	MasterPath string
+	Dir        string
+	DirUrl     string
+	MaxUrls    int
+}
+
+func envOr(key string, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func newSeoConfig() seoConfig {
+	base := strings.TrimRight(envOr("SITE_URL", "https://"+os.Getenv("DOMAIN_NAME")), "/")
+	max, err := strconv.Atoi(os.Getenv("SITEMAP_MAX_URLS"))
+	if err != nil || max < 1 || max > sitemapMaxUrls {
+		max = sitemapMaxUrls
+	}
+
+	return seoConfig{
+		BaseUrl:    base,
+		StaticUrl:  strings.TrimRight(envOr("STATIC_URL", base), "/"),
+		CatPath:    envOr("SITEMAP_CAT_PATH", "/{slug}"),
+		TownPath:   envOr("SITEMAP_TOWN_PATH", "/{town}/{slug}"),
+		MasterPath: envOr("SITEMAP_MASTER_PATH", "/masters/{id}"),
+		Dir:        envOr("SITEMAP_DIR", os.Getenv("UPLOADS_DIR")+"sitemap/"),
+		DirUrl:     strings.TrimRight(envOr("SITEMAP_URL", base), "/"),
+		MaxUrls:    max,
+	}
+}
+
+func (s seoConfig) catUrl(slug string) string {
+	return s.BaseUrl + strings.ReplaceAll(s.CatPath, "{slug}", slug)
+}
+
+func (s seoConfig) townUrl(town string, slug string) string {
+	return s.BaseUrl + strings.NewReplacer("{town}", town, "{slug}", slug).Replace(s.TownPath)
+}
+
+func (s seoConfig) masterUrl(id int32) string {
+	return s.BaseUrl + strings.ReplaceAll(s.MasterPath, "{id}", strconv.Itoa(int(id)))
+}
+
+type sitemapUrl struct {
+	Loc        string `xml:"loc"`
+	LastMod    string `xml:"lastmod,omitempty"`
+	ChangeFreq string `xml:"changefreq,omitempty"`
+	Priority   string `xml:"priority,omitempty"`
+}
+
+type urlSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	Urls    []sitemapUrl `xml:"url"`
+}
+
+type sitemapRef struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"sitemapindex"`
+	Xmlns    string       `xml:"xmlns,attr"`
+	Sitemaps []sitemapRef `xml:"sitemap"`
+}
+
+const sitemapXmlns = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+func lastMod(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format("2006-01-02")
+}
+
+func collectSitemapUrls(ctx context.Context, conn *pgxpool.Pool, conf seoConfig) ([]sitemapUrl, error) {
+	var urls []sitemapUrl
+
+	var cats []*catSummary
+	if err := pgxscan.Select(ctx, conn, &cats, `SELECT id, parent_id, name, slug, sort_order, image, created_at, extra FROM cats ORDER BY sort_order ASC`); err != nil {
+		return nil, err
+	}
+	for _, v := range cats {
+		priority := "0.8"
+		if v.ParentId == 0 {
+			priority = "1.0"
+		}
+		urls = append(urls, sitemapUrl{Loc: conf.catUrl(v.Slug), LastMod: lastMod(v.CreatedAt), ChangeFreq: "weekly", Priority: priority})
+	}
+
+	//landing pages only for towns where somebody works in that service
+	var landings []struct {
+		Town      string
+		Slug      string
+		CreatedAt time.Time
+	}
+	err := pgxscan.Select(ctx, conn, &landings, `SELECT DISTINCT t.slug AS town, c.slug, c.created_at FROM territories tr
+		JOIN towns t ON t.id = tr.town_id
+		JOIN choices ch ON ch.login_id = tr.login_id
+		JOIN cats c ON c.id = ch.service_id
+		WHERE t.slug != '' ORDER BY t.slug, c.slug`)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range landings {
+		urls = append(urls, sitemapUrl{Loc: conf.townUrl(v.Town, v.Slug), LastMod: lastMod(v.CreatedAt), ChangeFreq: "weekly", Priority: "0.6"})
+	}
+
+	var masters []struct {
+		Id         int32
+		LastOnline time.Time
+	}
+	if err = pgxscan.Select(ctx, conn, &masters, `SELECT id, last_online FROM logins WHERE level = 2 ORDER BY id ASC`); err != nil {
+		return nil, err
+	}
+	for _, v := range masters {
+		urls = append(urls, sitemapUrl{Loc: conf.masterUrl(v.Id), LastMod: lastMod(v.LastOnline), ChangeFreq: "monthly", Priority: "0.5"})
+	}
+
+	return urls, nil
+}
+
+func writeXml(path string, v interface{}) error {
+	b, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append([]byte(xml.Header), b...), 0644)
+}
+
+//parts left over from a run that had more urls than this one
+func removeStaleParts(conf seoConfig, keep []string) error {
+	parts, err := filepath.Glob(filepath.Join(conf.Dir, "sitemap-*.xml"))
+	if err != nil {
+		return err
+	}
+	kept := map[string]bool{}
+	for _, v := range keep {
+		kept[v] = true
+	}
+	for _, p := range parts {
+		if kept[filepath.Base(p)] {
+			continue
+		}
+		if err = os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+//writes sitemap.xml, or sitemap.xml as an index over sitemap-N.xml parts when there are too many urls
+//the files are served from SITEMAP_URL, the site root by default, a sitemap only covers urls under its own location
+func writeSitemap(ctx context.Context, conn *pgxpool.Pool, conf seoConfig) ([]string, error) {
+	urls, err := collectSitemapUrls(ctx, conn, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(conf.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if len(urls) <= conf.MaxUrls {
+		if err = writeXml(filepath.Join(conf.Dir, "sitemap.xml"), urlSet{Xmlns: sitemapXmlns, Urls: urls}); err != nil {
+			return nil, err
+		}
+		return []string{"sitemap.xml"}, removeStaleParts(conf, nil)
+	}
+
+	index := sitemapIndex{Xmlns: sitemapXmlns}
+	files := []string{"sitemap.xml"}
+	today := lastMod(time.Now())
+	for i := 0; i*conf.MaxUrls < len(urls); i++ {
+		end := (i + 1) * conf.MaxUrls
+		if end > len(urls) {
+			end = len(urls)
+		}
+
+		name := "sitemap-" + strconv.Itoa(i+1) + ".xml"
+		if err = writeXml(filepath.Join(conf.Dir, name), urlSet{Xmlns: sitemapXmlns, Urls: urls[i*conf.MaxUrls : end]}); err != nil {
+			return nil, err
+		}
+		files = append(files, name)
+		index.Sitemaps = append(index.Sitemaps, sitemapRef{Loc: conf.DirUrl + "/" + name, LastMod: today})
+	}
+
+	if err = writeXml(filepath.Join(conf.Dir, "sitemap.xml"), index); err != nil {
+		return nil, err
+	}
+
+	return files, removeStaleParts(conf, files)
+}
+
+func sitemap(ctx context.Context, conn *pgxpool.Pool) (string, error) {
+	conf := newSeoConfig()
+	files, err := writeSitemap(ctx, conn, conf)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(struct {
+		Dir   string   `json:"dir"`
+		Files []string `json:"files"`
+	}{conf.Dir, files})
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+//parents first, the category itself last
+func catPath(ctx context.Context, conn *pgxpool.Pool, c cat) ([]*catSummary, error) {
+	path := []*catSummary{{Id: c.Id, ParentId: c.ParentId, Name: c.Name, Slug: c.Slug, Image: c.Image}}
+	seen := map[int32]bool{c.Id: true}
+	for parent := c.ParentId; parent != 0 && !seen[parent]; {
+		var p catSummary
+		if err := pgxscan.Get(ctx, conn, &p, `SELECT id, parent_id, name, slug, sort_order, image, created_at, extra FROM cats WHERE id = $1`, parent); err != nil {
+			return nil, err
+		}
+		seen[p.Id] = true
+		path = append([]*catSummary{&p}, path...)
+		parent = p.ParentId
+	}
+	return path, nil
+}
+
+//breadcrumbs and Service snippets for a category page, optionally for a town landing page
+func jsonLd(ctx context.Context, conn *pgxpool.Pool, instructions string) (string, error) {
+	in := struct {
+		Id   int32  `json:"id"`
+		Slug string `json:"slug"`
+		Town string `json:"town"`
+	}{}
+	if err := json.Unmarshal([]byte(instructions), &in); err != nil {
+		return "", err
+	}
+
+	var c cat
+	var err error
+	if in.Id != 0 {
+		err = pgxscan.Get(ctx, conn, &c, `SELECT * FROM cats WHERE id=$1`, in.Id)
+	} else {
+		err = pgxscan.Get(ctx, conn, &c, `SELECT * FROM cats WHERE slug=$1`, in.Slug)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	conf := newSeoConfig()
+	path, err := catPath(ctx, conn, c)
+	if err != nil {
+		return "", err
+	}
+
+	var townName string
+	if in.Town != "" {
+		if err = conn.QueryRow(ctx, `SELECT name FROM towns WHERE slug = $1`, in.Town).Scan(&townName); err != nil {
+			return "", errors.New("unknown town " + in.Town)
+		}
+	}
+
+	type item map[string]interface{}
+	crumbs := []item{{"@type": "ListItem", "position": 1, "name": envOr("SITE_NAME", os.Getenv("PROJ_NAME")), "item": conf.BaseUrl + "/"}}
+	for i, v := range path {
+		crumbs = append(crumbs, item{"@type": "ListItem", "position": i + 2, "name": v.Name, "item": conf.catUrl(v.Slug)})
+	}
+
+	url := conf.catUrl(c.Slug)
+	if townName != "" {
+		url = conf.townUrl(in.Town, c.Slug)
+		crumbs = append(crumbs, item{"@type": "ListItem", "position": len(crumbs) + 1, "name": townName, "item": url})
+	}
+
+	service := item{
+		"@context":    "https://schema.org",
+		"@type":       "Service",
+		"name":        c.H1,
+		"description": c.Description,
+		"url":         url,
+	}
+	if c.H1 == "" {
+		service["name"] = c.Name
+	}
+	if len(path) > 1 {
+		service["serviceType"] = path[len(path)-2].Name
+	}
+	if c.Image != "" {
+		service["image"] = conf.StaticUrl + "/uploads/cats/" + strconv.Itoa(int(c.Id)) + "/" + c.Image
+	}
+	if townName != "" {
+		service["areaServed"] = item{"@type": "City", "name": townName}
+	}
+
+	//price range from what masters charge for this service
+	var prices struct {
+		Low   int32
+		High  int32
+		Count int32
+	}
+	err = pgxscan.Get(ctx, conn, &prices, `SELECT COALESCE(MIN(price), 0) AS low, COALESCE(MAX(price), 0) AS high, COUNT(*) AS count FROM choices WHERE service_id = $1 AND price > 0`, c.Id)
+	if err != nil {
+		return "", err
+	}
+	if prices.Count > 0 {
+		service["offers"] = item{
+			"@type":         "AggregateOffer",
+			"lowPrice":      prices.Low,
+			"highPrice":     prices.High,
+			"offerCount":    prices.Count,
+			"priceCurrency": envOr("CURRENCY", "RUB"),
+		}
+	}
+
+	b, err := json.Marshal(item{
+		"breadcrumbs": item{"@context": "https://schema.org", "@type": "BreadcrumbList", "itemListElement": crumbs},
+		"service":     service,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
@@ -0,0 +1,227 @@
+package attrs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+//the part of JSON Schema that order forms need: a flat object of typed fields
+type Property struct {
+	Type        string        `json:"type"`
+	Title       string        `json:"title,omitempty"`
+	Description string        `json:"description,omitempty"`
+	Unit        string        `json:"unit,omitempty"`
+	Enum        []interface{} `json:"enum,omitempty"`
+	Minimum     *float64      `json:"minimum,omitempty"`
+	Maximum     *float64      `json:"maximum,omitempty"`
+	MinLength   *int          `json:"minLength,omitempty"`
+	MaxLength   *int          `json:"maxLength,omitempty"`
+	Pattern     string        `json:"pattern,omitempty"`
+
+	re *regexp.Regexp
+}
+
+type Schema struct {
+	Type                 string               `json:"type"`
+	Properties           map[string]*Property `json:"properties"`
+	Required             []string             `json:"required,omitempty"`
+	AdditionalProperties *bool                `json:"additionalProperties,omitempty"`
+}
+
+type FieldError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	b, _ := json.Marshal(e)
+	return "invalid attributes: " + string(b)
+}
+
+var keyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+//parses a schema and checks that it only uses what Validate understands
+func Parse(raw []byte) (*Schema, error) {
+	var s Schema
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s); err != nil {
+		return nil, err
+	}
+
+	if s.Type != "object" {
+		return nil, errors.New(`schema type must be "object"`)
+	}
+
+	var errs Errors
+	for name, p := range s.Properties {
+		if !keyPattern.MatchString(name) {
+			errs = append(errs, FieldError{name, "names are lower case latin, digits and _"})
+			continue
+		}
+		if p == nil {
+			errs = append(errs, FieldError{name, "empty property"})
+			continue
+		}
+		switch p.Type {
+		case "string", "number", "integer", "boolean":
+		default:
+			errs = append(errs, FieldError{name, "type must be string, number, integer or boolean"})
+			continue
+		}
+		if p.Pattern != "" {
+			re, err := regexp.Compile(p.Pattern)
+			if err != nil {
+				errs = append(errs, FieldError{name, "bad pattern: " + err.Error()})
+				continue
+			}
+			p.re = re
+		}
+		for _, v := range p.Enum {
+			if msg := p.check(v, false); msg != "" {
+				errs = append(errs, FieldError{name, "enum value " + msg})
+				break
+			}
+		}
+	}
+	for _, r := range s.Required {
+		if _, ok := s.Properties[r]; !ok {
+			errs = append(errs, FieldError{r, "required but not defined"})
+		}
+	}
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+		return nil, errs
+	}
+
+	return &s, nil
+}
+
+//checks a value against a property, returns what's wrong or ""
+func (p *Property) check(v interface{}, withEnum bool) string {
+	switch p.Type {
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return "must be a string"
+		}
+		n := utf8.RuneCountInString(s)
+		if p.MinLength != nil && n < *p.MinLength {
+			return "shorter than " + strconv.Itoa(*p.MinLength)
+		}
+		if p.MaxLength != nil && n > *p.MaxLength {
+			return "longer than " + strconv.Itoa(*p.MaxLength)
+		}
+		if p.re != nil && !p.re.MatchString(s) {
+			return "does not match " + p.Pattern
+		}
+	case "number", "integer":
+		f, ok := v.(float64)
+		if !ok {
+			return "must be a number"
+		}
+		if p.Type == "integer" && f != math.Trunc(f) {
+			return "must be an integer"
+		}
+		if p.Minimum != nil && f < *p.Minimum {
+			return "less than " + strconv.FormatFloat(*p.Minimum, 'f', -1, 64)
+		}
+		if p.Maximum != nil && f > *p.Maximum {
+			return "more than " + strconv.FormatFloat(*p.Maximum, 'f', -1, 64)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return "must be true or false"
+		}
+	}
+
+	if withEnum && len(p.Enum) > 0 {
+		for _, e := range p.Enum {
+			if e == v {
+				return ""
+			}
+		}
+		return "not one of the allowed values"
+	}
+
+	return ""
+}
+
+//validates an order's attributes, an empty doc is treated as {}
+func (s *Schema) Validate(doc []byte) error {
+	if len(bytes.TrimSpace(doc)) == 0 {
+		doc = []byte("{}")
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(doc, &values); err != nil || values == nil {
+		return Errors{{"", "attributes must be an object"}}
+	}
+
+	var errs Errors
+	for _, r := range s.Required {
+		if _, ok := values[r]; !ok {
+			errs = append(errs, FieldError{r, "required"})
+		}
+	}
+	for k, v := range values {
+		p, ok := s.Properties[k]
+		if !ok {
+			if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				errs = append(errs, FieldError{k, "unknown attribute"})
+			}
+			continue
+		}
+		if msg := p.check(v, true); msg != "" {
+			errs = append(errs, FieldError{k, msg})
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+		return errs
+	}
+	return nil
+}
+
+//finds the schema that applies to cat $1, its own or the closest one up the cats tree
+//returns cat_id of the owner and schema, no rows when none applies
+const LookupSql = `WITH RECURSIVE up AS (
+		SELECT id, parent_id, 0 AS depth FROM cats WHERE id = $1
+		UNION ALL
+		SELECT c.id, c.parent_id, up.depth + 1 FROM cats c JOIN up ON c.id = up.parent_id WHERE up.depth < 32
+	)
+	SELECT a.cat_id, a.schema FROM up JOIN cats_attributes a ON a.cat_id = up.id ORDER BY up.depth LIMIT 1`
+
+//a filter on one attribute, either a bare value meaning eq or {"eq", "in", "gte", "lte"}
+type Condition struct {
+	Eq  interface{}   `json:"eq,omitempty"`
+	In  []interface{} `json:"in,omitempty"`
+	Gte *float64      `json:"gte,omitempty"`
+	Lte *float64      `json:"lte,omitempty"`
+}
+
+func (c *Condition) UnmarshalJSON(b []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		type plain Condition
+		var p plain
+		if err := json.Unmarshal(b, &p); err != nil {
+			return err
+		}
+		*c = Condition(p)
+		return nil
+	}
+	return json.Unmarshal(b, &c.Eq)
+}
+
+func ValidKey(k string) bool {
+	return keyPattern.MatchString(k)
+}
@@ -0,0 +1,131 @@
+package attrs
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const testSchema = `{
+	"type": "object",
+	"properties": {
+		"area": {"type": "number", "title": "Площадь", "unit": "м²", "minimum": 1, "maximum": 1000},
+		"rooms": {"type": "integer", "minimum": 1},
+		"material": {"type": "string", "enum": ["brick", "wood"]},
+		"code": {"type": "string", "minLength": 2, "maxLength": 4, "pattern": "^[A-Z]+$"},
+		"urgent": {"type": "boolean"}
+	},
+	"required": ["area"],
+	"additionalProperties": false
+}`
+
+func TestParse(t *testing.T) {
+	s, err := Parse([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Properties) != 5 || s.Properties["code"].re == nil {
+		t.Errorf("parsed %+v", s)
+	}
+
+	bad := []string{
+		`{"type": "array"}`,
+		`{"type": "object", "items": {}}`,
+		`{"type": "object", "properties": {"Area": {"type": "number"}}}`,
+		`{"type": "object", "properties": {"area": {"type": "object"}}}`,
+		`{"type": "object", "properties": {"area": null}}`,
+		`{"type": "object", "properties": {"code": {"type": "string", "pattern": "("}}}`,
+		`{"type": "object", "properties": {"rooms": {"type": "integer", "enum": [1, 1.5]}}}`,
+		`{"type": "object", "properties": {}, "required": ["area"]}`,
+	}
+	for _, b := range bad {
+		if _, err := Parse([]byte(b)); err == nil {
+			t.Errorf("Parse(%s) gave no error", b)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	s, err := Parse([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		doc  string
+		want Errors
+	}{
+		{`{"area": 50}`, nil},
+		{`{"area": 50, "rooms": 3, "material": "wood", "code": "AB", "urgent": true}`, nil},
+		{``, Errors{{"area", "required"}}},
+		{`[]`, Errors{{"", "attributes must be an object"}}},
+		{`null`, Errors{{"", "attributes must be an object"}}},
+		{`{"area": "50"}`, Errors{{"area", "must be a number"}}},
+		{`{"area": 0.5}`, Errors{{"area", "less than 1"}}},
+		{`{"area": 1000.5}`, Errors{{"area", "more than 1000"}}},
+		{`{"area": 50, "rooms": 2.5}`, Errors{{"rooms", "must be an integer"}}},
+		{`{"area": 50, "material": "stone"}`, Errors{{"material", "not one of the allowed values"}}},
+		{`{"area": 50, "code": "A"}`, Errors{{"code", "shorter than 2"}}},
+		{`{"area": 50, "code": "ABCDE"}`, Errors{{"code", "longer than 4"}}},
+		{`{"area": 50, "code": "ab"}`, Errors{{"code", "does not match ^[A-Z]+$"}}},
+		{`{"area": 50, "urgent": "yes"}`, Errors{{"urgent", "must be true or false"}}},
+		{`{"area": 50, "colour": "red"}`, Errors{{"colour", "unknown attribute"}}},
+		{`{"urgent": 1, "rooms": 0}`, Errors{{"area", "required"}, {"rooms", "less than 1"}, {"urgent", "must be true or false"}}},
+	}
+	for _, c := range cases {
+		err := s.Validate([]byte(c.doc))
+		if c.want == nil {
+			if err != nil {
+				t.Errorf("Validate(%s) = %v", c.doc, err)
+			}
+			continue
+		}
+		got, ok := err.(Errors)
+		if !ok || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Validate(%s) = %v, want %v", c.doc, err, c.want)
+		}
+	}
+}
+
+func TestValidateAdditional(t *testing.T) {
+	s, err := Parse([]byte(`{"type": "object", "properties": {"area": {"type": "number"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Validate([]byte(`{"area": 5, "colour": "red"}`)); err != nil {
+		t.Errorf("unknown attributes are allowed unless additionalProperties is false: %v", err)
+	}
+}
+
+func TestCondition(t *testing.T) {
+	cases := []struct {
+		in   string
+		want Condition
+	}{
+		{`"brick"`, Condition{Eq: "brick"}},
+		{`3`, Condition{Eq: 3.0}},
+		{`{"eq": true}`, Condition{Eq: true}},
+		{`{"in": ["brick", "wood"]}`, Condition{In: []interface{}{"brick", "wood"}}},
+	}
+	for _, c := range cases {
+		var got Condition
+		if err := json.Unmarshal([]byte(c.in), &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s = %+v, want %+v", c.in, got, c.want)
+		}
+	}
+
+	var r Condition
+	if err := json.Unmarshal([]byte(`{"gte": 10, "lte": 20}`), &r); err != nil || r.Gte == nil || *r.Gte != 10 || r.Lte == nil || *r.Lte != 20 {
+		t.Errorf("range %+v %v", r, err)
+	}
+}
+
+func TestValidKey(t *testing.T) {
+	for k, want := range map[string]bool{"area": true, "floor_2": true, "": false, "2floor": false, "Area": false, "a-b": false} {
+		if ValidKey(k) != want {
+			t.Errorf("ValidKey(%q) != %v", k, want)
+		}
+	}
+}
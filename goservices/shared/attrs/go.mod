@@ -0,0 +1,3 @@
+module go.mods/attrs
+
+go 1.17
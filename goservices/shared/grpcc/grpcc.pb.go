@@ -181,6 +181,165 @@ func (x *DataResponse) GetResult() string {
 	return ""
 }
 
+// events after last_event_id first, then live ones as they happen
+type SubscribeRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	LoginId     int32    `protobuf:"varint,1,opt,name=login_id,json=loginId,proto3" json:"login_id,omitempty"`
+	LastEventId int64    `protobuf:"varint,2,opt,name=last_event_id,json=lastEventId,proto3" json:"last_event_id,omitempty"`
+	Kinds       []string `protobuf:"bytes,3,rep,name=kinds,proto3" json:"kinds,omitempty"`
+}
+
+func (x *SubscribeRequest) Reset() {
+	*x = SubscribeRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_grpcc_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *SubscribeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SubscribeRequest) ProtoMessage() {}
+
+func (x *SubscribeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_grpcc_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SubscribeRequest.ProtoReflect.Descriptor instead.
+func (*SubscribeRequest) Descriptor() ([]byte, []int) {
+	return file_grpcc_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *SubscribeRequest) GetLoginId() int32 {
+	if x != nil {
+		return x.LoginId
+	}
+	return 0
+}
+
+func (x *SubscribeRequest) GetLastEventId() int64 {
+	if x != nil {
+		return x.LastEventId
+	}
+	return 0
+}
+
+func (x *SubscribeRequest) GetKinds() []string {
+	if x != nil {
+		return x.Kinds
+	}
+	return nil
+}
+
+type Event struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id      int64  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Kind    string `protobuf:"bytes,2,opt,name=kind,proto3" json:"kind,omitempty"`
+	LoginId int32  `protobuf:"varint,3,opt,name=login_id,json=loginId,proto3" json:"login_id,omitempty"`
+	OrderId int32  `protobuf:"varint,4,opt,name=order_id,json=orderId,proto3" json:"order_id,omitempty"`
+	OfferId int32  `protobuf:"varint,5,opt,name=offer_id,json=offerId,proto3" json:"offer_id,omitempty"`
+	Payload string `protobuf:"bytes,6,opt,name=payload,proto3" json:"payload,omitempty"`
+	Created string `protobuf:"bytes,7,opt,name=created,proto3" json:"created,omitempty"`
+}
+
+func (x *Event) Reset() {
+	*x = Event{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_grpcc_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Event) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Event) ProtoMessage() {}
+
+func (x *Event) ProtoReflect() protoreflect.Message {
+	mi := &file_grpcc_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Event.ProtoReflect.Descriptor instead.
+func (*Event) Descriptor() ([]byte, []int) {
+	return file_grpcc_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *Event) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Event) GetKind() string {
+	if x != nil {
+		return x.Kind
+	}
+	return ""
+}
+
+func (x *Event) GetLoginId() int32 {
+	if x != nil {
+		return x.LoginId
+	}
+	return 0
+}
+
+func (x *Event) GetOrderId() int32 {
+	if x != nil {
+		return x.OrderId
+	}
+	return 0
+}
+
+func (x *Event) GetOfferId() int32 {
+	if x != nil {
+		return x.OfferId
+	}
+	return 0
+}
+
+func (x *Event) GetPayload() string {
+	if x != nil {
+		return x.Payload
+	}
+	return ""
+}
+
+func (x *Event) GetCreated() string {
+	if x != nil {
+		return x.Created
+	}
+	return ""
+}
+
 var File_grpcc_proto protoreflect.FileDescriptor
 
 var file_grpcc_proto_rawDesc = []byte{
@@ -196,13 +355,35 @@ var file_grpcc_proto_rawDesc = []byte{
 	0x0b, 0x2e, 0x67, 0x72, 0x70, 0x63, 0x63, 0x2e, 0x44, 0x61, 0x74, 0x61, 0x52, 0x04, 0x64, 0x61,
 	0x74, 0x61, 0x22, 0x26, 0x0a, 0x0c, 0x44, 0x61, 0x74, 0x61, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e,
 	0x73, 0x65, 0x12, 0x16, 0x0a, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x01, 0x20, 0x01,
-	0x28, 0x09, 0x52, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x32, 0x4d, 0x0a, 0x14, 0x43, 0x6f,
-	0x6d, 0x6d, 0x75, 0x6e, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x53, 0x65, 0x72, 0x76, 0x69,
-	0x63, 0x65, 0x12, 0x35, 0x0a, 0x08, 0x50, 0x61, 0x73, 0x73, 0x44, 0x61, 0x74, 0x61, 0x12, 0x12,
-	0x2e, 0x67, 0x72, 0x70, 0x63, 0x63, 0x2e, 0x44, 0x61, 0x74, 0x61, 0x52, 0x65, 0x71, 0x75, 0x65,
-	0x73, 0x74, 0x1a, 0x13, 0x2e, 0x67, 0x72, 0x70, 0x63, 0x63, 0x2e, 0x44, 0x61, 0x74, 0x61, 0x52,
-	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x42, 0x0a, 0x5a, 0x08, 0x2e, 0x2e, 0x2f,
-	0x67, 0x72, 0x70, 0x63, 0x63, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x28, 0x09, 0x52, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x22, 0x67, 0x0a, 0x10, 0x53, 0x75,
+	0x62, 0x73, 0x63, 0x72, 0x69, 0x62, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x19,
+	0x0a, 0x08, 0x6c, 0x6f, 0x67, 0x69, 0x6e, 0x5f, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05,
+	0x52, 0x07, 0x6c, 0x6f, 0x67, 0x69, 0x6e, 0x49, 0x64, 0x12, 0x22, 0x0a, 0x0d, 0x6c, 0x61, 0x73,
+	0x74, 0x5f, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x5f, 0x69, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03,
+	0x52, 0x0b, 0x6c, 0x61, 0x73, 0x74, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x49, 0x64, 0x12, 0x14, 0x0a,
+	0x05, 0x6b, 0x69, 0x6e, 0x64, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x09, 0x52, 0x05, 0x6b, 0x69,
+	0x6e, 0x64, 0x73, 0x22, 0xb0, 0x01, 0x0a, 0x05, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x12, 0x0e, 0x0a,
+	0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x02, 0x69, 0x64, 0x12, 0x12, 0x0a,
+	0x04, 0x6b, 0x69, 0x6e, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6b, 0x69, 0x6e,
+	0x64, 0x12, 0x19, 0x0a, 0x08, 0x6c, 0x6f, 0x67, 0x69, 0x6e, 0x5f, 0x69, 0x64, 0x18, 0x03, 0x20,
+	0x01, 0x28, 0x05, 0x52, 0x07, 0x6c, 0x6f, 0x67, 0x69, 0x6e, 0x49, 0x64, 0x12, 0x19, 0x0a, 0x08,
+	0x6f, 0x72, 0x64, 0x65, 0x72, 0x5f, 0x69, 0x64, 0x18, 0x04, 0x20, 0x01, 0x28, 0x05, 0x52, 0x07,
+	0x6f, 0x72, 0x64, 0x65, 0x72, 0x49, 0x64, 0x12, 0x19, 0x0a, 0x08, 0x6f, 0x66, 0x66, 0x65, 0x72,
+	0x5f, 0x69, 0x64, 0x18, 0x05, 0x20, 0x01, 0x28, 0x05, 0x52, 0x07, 0x6f, 0x66, 0x66, 0x65, 0x72,
+	0x49, 0x64, 0x12, 0x18, 0x0a, 0x07, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x18, 0x06, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x07, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x12, 0x18, 0x0a, 0x07,
+	0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64, 0x18, 0x07, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x63,
+	0x72, 0x65, 0x61, 0x74, 0x65, 0x64, 0x32, 0x85, 0x01, 0x0a, 0x14, 0x43, 0x6f, 0x6d, 0x6d, 0x75,
+	0x6e, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x12,
+	0x35, 0x0a, 0x08, 0x50, 0x61, 0x73, 0x73, 0x44, 0x61, 0x74, 0x61, 0x12, 0x12, 0x2e, 0x67, 0x72,
+	0x70, 0x63, 0x63, 0x2e, 0x44, 0x61, 0x74, 0x61, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a,
+	0x13, 0x2e, 0x67, 0x72, 0x70, 0x63, 0x63, 0x2e, 0x44, 0x61, 0x74, 0x61, 0x52, 0x65, 0x73, 0x70,
+	0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x12, 0x36, 0x0a, 0x09, 0x53, 0x75, 0x62, 0x73, 0x63, 0x72,
+	0x69, 0x62, 0x65, 0x12, 0x17, 0x2e, 0x67, 0x72, 0x70, 0x63, 0x63, 0x2e, 0x53, 0x75, 0x62, 0x73,
+	0x63, 0x72, 0x69, 0x62, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x0c, 0x2e, 0x67,
+	0x72, 0x70, 0x63, 0x63, 0x2e, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x22, 0x00, 0x30, 0x01, 0x42, 0x0a,
+	0x5a, 0x08, 0x2e, 0x2e, 0x2f, 0x67, 0x72, 0x70, 0x63, 0x63, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74,
+	0x6f, 0x33,
 }
 
 var (
@@ -217,18 +398,22 @@ func file_grpcc_proto_rawDescGZIP() []byte {
 	return file_grpcc_proto_rawDescData
 }
 
-var file_grpcc_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_grpcc_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
 var file_grpcc_proto_goTypes = []interface{}{
-	(*Data)(nil),         // 0: grpcc.Data
-	(*DataRequest)(nil),  // 1: grpcc.DataRequest
-	(*DataResponse)(nil), // 2: grpcc.DataResponse
+	(*Data)(nil),             // 0: grpcc.Data
+	(*DataRequest)(nil),      // 1: grpcc.DataRequest
+	(*DataResponse)(nil),     // 2: grpcc.DataResponse
+	(*SubscribeRequest)(nil), // 3: grpcc.SubscribeRequest
+	(*Event)(nil),            // 4: grpcc.Event
 }
 var file_grpcc_proto_depIdxs = []int32{
 	0, // 0: grpcc.DataRequest.data:type_name -> grpcc.Data
 	1, // 1: grpcc.CommunicationService.PassData:input_type -> grpcc.DataRequest
-	2, // 2: grpcc.CommunicationService.PassData:output_type -> grpcc.DataResponse
-	2, // [2:3] is the sub-list for method output_type
-	1, // [1:2] is the sub-list for method input_type
+	3, // 2: grpcc.CommunicationService.Subscribe:input_type -> grpcc.SubscribeRequest
+	2, // 3: grpcc.CommunicationService.PassData:output_type -> grpcc.DataResponse
+	4, // 4: grpcc.CommunicationService.Subscribe:output_type -> grpcc.Event
+	3, // [3:5] is the sub-list for method output_type
+	1, // [1:3] is the sub-list for method input_type
 	1, // [1:1] is the sub-list for extension type_name
 	1, // [1:1] is the sub-list for extension extendee
 	0, // [0:1] is the sub-list for field type_name
@@ -276,6 +461,30 @@ func file_grpcc_proto_init() {
 				return nil
 			}
 		}
+		file_grpcc_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*SubscribeRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_grpcc_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Event); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -283,7 +492,7 @@ func file_grpcc_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_grpcc_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   3,
+			NumMessages:   5,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
@@ -311,6 +520,8 @@ const _ = grpc.SupportPackageIsVersion6
 type CommunicationServiceClient interface {
 	//Unary
 	PassData(ctx context.Context, in *DataRequest, opts ...grpc.CallOption) (*DataResponse, error)
+	//Server streaming
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (CommunicationService_SubscribeClient, error)
 }
 
 type communicationServiceClient struct {
@@ -330,10 +541,44 @@ func (c *communicationServiceClient) PassData(ctx context.Context, in *DataReque
 	return out, nil
 }
 
+func (c *communicationServiceClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (CommunicationService_SubscribeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_CommunicationService_serviceDesc.Streams[0], "/grpcc.CommunicationService/Subscribe", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &communicationServiceSubscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type CommunicationService_SubscribeClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type communicationServiceSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *communicationServiceSubscribeClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // CommunicationServiceServer is the server API for CommunicationService service.
 type CommunicationServiceServer interface {
 	//Unary
 	PassData(context.Context, *DataRequest) (*DataResponse, error)
+	//Server streaming
+	Subscribe(*SubscribeRequest, CommunicationService_SubscribeServer) error
 }
 
 // UnimplementedCommunicationServiceServer can be embedded to have forward compatible implementations.
@@ -343,6 +588,9 @@ type UnimplementedCommunicationServiceServer struct {
 func (*UnimplementedCommunicationServiceServer) PassData(context.Context, *DataRequest) (*DataResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method PassData not implemented")
 }
+func (*UnimplementedCommunicationServiceServer) Subscribe(*SubscribeRequest, CommunicationService_SubscribeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
 
 func RegisterCommunicationServiceServer(s *grpc.Server, srv CommunicationServiceServer) {
 	s.RegisterService(&_CommunicationService_serviceDesc, srv)
@@ -366,6 +614,27 @@ func _CommunicationService_PassData_Handler(srv interface{}, ctx context.Context
 	return interceptor(ctx, in, info, handler)
 }
 
+func _CommunicationService_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CommunicationServiceServer).Subscribe(m, &communicationServiceSubscribeServer{stream})
+}
+
+type CommunicationService_SubscribeServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type communicationServiceSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *communicationServiceSubscribeServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 var _CommunicationService_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "grpcc.CommunicationService",
 	HandlerType: (*CommunicationServiceServer)(nil),
@@ -375,6 +644,12 @@ var _CommunicationService_serviceDesc = grpc.ServiceDesc{
 			Handler:    _CommunicationService_PassData_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _CommunicationService_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
 	Metadata: "grpcc.proto",
 }
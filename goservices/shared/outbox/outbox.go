@@ -0,0 +1,250 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+//a change some other part of the system may care about, written in the transaction that made it
+//topics are "thing.what_happened", key is the id of the thing
+type Message struct {
+	Id      int64           `json:"id"`
+	Topic   string          `json:"topic"`
+	Key     string          `json:"key"`
+	Payload json.RawMessage `json:"payload"`
+	Txid    int64           `json:"-"`
+	Created time.Time       `json:"created"`
+}
+
+//every service that writes messages runs these with its own migrations, they are safe to run again
+var Migrations = []string{
+	`CREATE TABLE IF NOT EXISTS outbox (
+		id bigserial PRIMARY KEY,
+		topic text NOT NULL,
+		key text DEFAULT ''::text NOT NULL,
+		payload jsonb DEFAULT '{}'::jsonb NOT NULL,
+		txid bigint DEFAULT txid_current() NOT NULL,
+		created timestamp with time zone DEFAULT now() NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS outbox_offsets (
+		consumer text PRIMARY KEY,
+		last_id bigint DEFAULT 0 NOT NULL,
+		attempts integer DEFAULT 0 NOT NULL,
+		error text DEFAULT ''::text NOT NULL,
+		updated timestamp with time zone NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS outbox_dead (
+		id serial PRIMARY KEY,
+		consumer text NOT NULL,
+		message_id bigint NOT NULL,
+		error text NOT NULL,
+		created timestamp with time zone NOT NULL
+	)`,
+}
+
+//queues a message, it only exists if tx commits
+func Write(ctx context.Context, tx pgx.Tx, topic string, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `INSERT INTO outbox (topic, key, payload) VALUES ($1, $2, $3)`, topic, key, b)
+	return err
+}
+
+//runs inside the relay's transaction, database work commits together with the consumer's offset
+//anything done outside the database may be repeated, handlers must tolerate seeing a message twice
+type Handler func(ctx context.Context, tx pgx.Tx, m Message) error
+
+type consumer struct {
+	name   string
+	topics []string
+	handle Handler
+}
+
+//"order" takes order.created and order.updated, "order.created" only itself, no topics take everything
+func (c consumer) wants(topic string) bool {
+	if len(c.topics) == 0 {
+		return true
+	}
+	for _, t := range c.topics {
+		if topic == t || strings.HasPrefix(topic, t+".") {
+			return true
+		}
+	}
+	return false
+}
+
+//hands every message to every consumer in order, each consumer keeps its own offset
+//a message a consumer keeps failing on goes to outbox_dead after MaxAttempts so the rest don't wait forever
+type Relay struct {
+	Poll        time.Duration
+	Batch       int
+	MaxAttempts int32
+
+	mu        sync.Mutex
+	consumers []consumer
+}
+
+func NewRelay() *Relay {
+	return &Relay{Poll: time.Second, Batch: 100, MaxAttempts: 10}
+}
+
+//names are the offsets' keys, renaming a consumer starts it over from the first message
+func (r *Relay) Register(name string, topics []string, h Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.consumers = append(r.consumers, consumer{name, topics, h})
+}
+
+//relays until the process ends
+func (r *Relay) Start(databaseUrl string) {
+	go func() {
+		ctx := context.Background()
+		for {
+			conn, err := pgxpool.Connect(ctx, databaseUrl)
+			if err != nil {
+				log.Println("outbox relay can't connect: ", err)
+				time.Sleep(r.Poll)
+				continue
+			}
+
+			for {
+				if err = r.RunOnce(ctx, conn); err != nil {
+					log.Println("outbox relay failed: ", err)
+					break
+				}
+				time.Sleep(r.Poll)
+			}
+			conn.Close()
+			time.Sleep(r.Poll)
+		}
+	}()
+}
+
+//one pass over every consumer
+func (r *Relay) RunOnce(ctx context.Context, conn *pgxpool.Pool) error {
+	r.mu.Lock()
+	cs := append([]consumer{}, r.consumers...)
+	r.mu.Unlock()
+
+	for _, c := range cs {
+		//a full batch means there is probably more
+		for {
+			n, err := r.relay(ctx, conn, c)
+			if err != nil {
+				return errors.New(c.name + ": " + err.Error())
+			}
+			if n < r.Batch {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+//only messages from transactions older than every running one are read
+//ids are handed out before commit, so a later id can be visible while an earlier one isn't yet, the offset must not pass it
+const pending = `SELECT * FROM outbox WHERE id > $1 AND txid < txid_snapshot_xmin(txid_current_snapshot()) ORDER BY id LIMIT `
+
+func (r *Relay) relay(ctx context.Context, conn *pgxpool.Pool, c consumer) (int, error) {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `INSERT INTO outbox_offsets (consumer, updated) VALUES ($1, $2) ON CONFLICT (consumer) DO NOTHING`, c.name, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	//another replica is on it
+	var last int64
+	var attempts int32
+	err = tx.QueryRow(ctx, `SELECT last_id, attempts FROM outbox_offsets WHERE consumer = $1 FOR UPDATE SKIP LOCKED`, c.name).Scan(&last, &attempts)
+	if err == pgx.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.Query(ctx, pending+strconv.Itoa(r.Batch), last)
+	if err != nil {
+		return 0, err
+	}
+	var ms []Message
+	for rows.Next() {
+		var m Message
+		if err = rows.Scan(&m.Id, &m.Topic, &m.Key, &m.Payload, &m.Txid, &m.Created); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ms = append(ms, m)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	done, failure := 0, ""
+	for _, m := range ms {
+		if c.wants(m.Topic) {
+			if err = handle(ctx, tx, c, m); err != nil {
+				attempts++
+				failure = err.Error()
+				if attempts < r.MaxAttempts {
+					break
+				}
+
+				log.Println("outbox: "+c.name+" gave up on message "+strconv.FormatInt(m.Id, 10)+": ", err)
+				_, err = tx.Exec(ctx, `INSERT INTO outbox_dead (consumer, message_id, error, created) VALUES ($1, $2, $3, $4)`, c.name, m.Id, failure, time.Now())
+				if err != nil {
+					return 0, err
+				}
+			}
+		}
+		last, attempts, failure = m.Id, 0, ""
+		done++
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE outbox_offsets SET last_id = $1, attempts = $2, error = $3, updated = $4 WHERE consumer = $5`,
+		last, attempts, failure, time.Now(), c.name)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+
+	//a failure stops the batch short, don't come straight back for it
+	if done < len(ms) {
+		return 0, nil
+	}
+	return done, nil
+}
+
+//a savepoint per message, a failing handler leaves nothing behind
+func handle(ctx context.Context, tx pgx.Tx, c consumer, m Message) error {
+	sp, err := tx.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer sp.Rollback(ctx)
+
+	if err = c.handle(ctx, sp, m); err != nil {
+		return err
+	}
+	return sp.Commit(ctx)
+}
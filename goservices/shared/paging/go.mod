@@ -0,0 +1,3 @@
+module go.mods/paging
+
+go 1.17
@@ -0,0 +1,144 @@
+package paging
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+)
+
+const (
+	DefaultLimit = 20
+	MaxLimit     = 100
+)
+
+//a sort order, rows with equal values are always told apart by id
+type Key struct {
+	Column string
+	Cast   string
+	Desc   bool
+}
+
+//where a page ended, opaque to clients
+type Cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v,omitempty"`
+	Id    int64  `json:"i"`
+	Prev  bool   `json:"p,omitempty"`
+}
+
+func Encode(c Cursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func Decode(s string) (Cursor, error) {
+	var c Cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, errors.New("bad cursor")
+	}
+	if err = json.Unmarshal(b, &c); err != nil {
+		return c, errors.New("bad cursor")
+	}
+	return c, nil
+}
+
+//what list actions take in their instructions
+type Request struct {
+	Limit  int    `json:"limit"`
+	Cursor string `json:"cursor"`
+}
+
+//what list actions send back next to the rows
+type Page struct {
+	Next  string `json:"next"`
+	Prev  string `json:"prev"`
+	Limit int    `json:"limit"`
+}
+
+func (r Request) limit() int {
+	if r.Limit < 1 {
+		return DefaultLimit
+	}
+	if r.Limit > MaxLimit {
+		return MaxLimit
+	}
+	return r.Limit
+}
+
+//condition (empty on the first page), ORDER BY and LIMIT for the page; arg adds a query argument and returns its placeholder
+func (r Request) Plan(sort string, k Key, arg func(interface{}) string) (string, string, error) {
+	var c Cursor
+	if r.Cursor != "" {
+		var err error
+		if c, err = Decode(r.Cursor); err != nil {
+			return "", "", err
+		}
+		if c.Sort != sort {
+			return "", "", errors.New("cursor belongs to a different sort order")
+		}
+	}
+
+	//going back walks the index the other way
+	desc := k.Desc != c.Prev
+	dir, cmp := " ASC", " > "
+	if desc {
+		dir, cmp = " DESC", " < "
+	}
+
+	cond := ""
+	if r.Cursor != "" {
+		if k.Column == "id" {
+			cond = "id" + cmp + arg(c.Id)
+		} else {
+			cond = "(" + k.Column + ", id)" + cmp + "(" + arg(c.Value) + "::" + k.Cast + ", " + arg(c.Id) + ")"
+		}
+	}
+
+	order := " ORDER BY "
+	if k.Column != "id" {
+		order += k.Column + dir + ", "
+	}
+	order += "id" + dir + " LIMIT " + strconv.Itoa(r.limit()+1)
+
+	return cond, order, nil
+}
+
+//trims the look-ahead row, puts a backwards page in display order and builds the cursors around it
+//items is a pointer to the slice, key gives the sort value and id of row i
+func (r Request) Finish(items interface{}, sort string, key func(i int) (string, int64)) Page {
+	v := reflect.ValueOf(items).Elem()
+	limit := r.limit()
+	c, _ := Decode(r.Cursor)
+
+	more := v.Len() > limit
+	if more {
+		v.Set(v.Slice(0, limit))
+	}
+	if c.Prev {
+		swap := reflect.Swapper(v.Interface())
+		for i, j := 0, v.Len()-1; i < j; i, j = i+1, j-1 {
+			swap(i, j)
+		}
+	}
+
+	p := Page{Limit: limit}
+	n := v.Len()
+	if n == 0 {
+		return p
+	}
+
+	//a backwards page always has the page it came from after it
+	if more || c.Prev {
+		val, id := key(n - 1)
+		p.Next = Encode(Cursor{Sort: sort, Value: val, Id: id})
+	}
+	if (c.Prev && more) || (!c.Prev && r.Cursor != "") {
+		val, id := key(0)
+		p.Prev = Encode(Cursor{Sort: sort, Value: val, Id: id, Prev: true})
+	}
+
+	return p
+}
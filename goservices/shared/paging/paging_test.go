@@ -0,0 +1,175 @@
+package paging
+
+import (
+	"strconv"
+	"testing"
+)
+
+//collects query arguments the way the callers' where builders do
+type args []interface{}
+
+func (a *args) add(v interface{}) string {
+	*a = append(*a, v)
+	return "$" + strconv.Itoa(len(*a))
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	for _, c := range []Cursor{
+		{Sort: "id", Id: 42},
+		{Sort: "price", Value: "1500", Id: 7, Prev: true},
+		{Sort: "name", Value: "Иван \"Мастер\"", Id: 1},
+	} {
+		got, err := Decode(Encode(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c {
+			t.Errorf("round trip of %+v gave %+v", c, got)
+		}
+	}
+	for _, s := range []string{"not base64!", Encode(Cursor{})[:3] + "x", "bm90IGpzb24"} {
+		if _, err := Decode(s); err == nil {
+			t.Errorf("Decode(%q) gave no error", s)
+		}
+	}
+}
+
+func TestLimit(t *testing.T) {
+	cases := []struct{ in, want int }{{0, DefaultLimit}, {-5, DefaultLimit}, {1, 1}, {MaxLimit, MaxLimit}, {MaxLimit + 1, MaxLimit}}
+	for _, c := range cases {
+		if got := (Request{Limit: c.in}).limit(); got != c.want {
+			t.Errorf("limit %d = %d, want %d", c.in, got, c.want)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	price := Key{Column: "price", Cast: "integer"}
+	newest := Key{Column: "id", Desc: true}
+	cases := []struct {
+		name      string
+		req       Request
+		sort      string
+		key       Key
+		cond      string
+		order     string
+		arguments args
+	}{
+		{"first page by id", Request{Limit: 10}, "id", newest, "", " ORDER BY id DESC LIMIT 11", nil},
+		{"next page by id", Request{Limit: 10, Cursor: Encode(Cursor{Sort: "id", Id: 50})}, "id", newest,
+			"id < $1", " ORDER BY id DESC LIMIT 11", args{int64(50)}},
+		{"previous page by id", Request{Limit: 10, Cursor: Encode(Cursor{Sort: "id", Id: 50, Prev: true})}, "id", newest,
+			"id > $1", " ORDER BY id ASC LIMIT 11", args{int64(50)}},
+		{"first page by price", Request{}, "price", price, "", " ORDER BY price ASC, id ASC LIMIT 21", nil},
+		{"next page by price", Request{Cursor: Encode(Cursor{Sort: "price", Value: "900", Id: 3})}, "price", price,
+			"(price, id) > ($1::integer, $2)", " ORDER BY price ASC, id ASC LIMIT 21", args{"900", int64(3)}},
+		{"previous page by price", Request{Cursor: Encode(Cursor{Sort: "price", Value: "900", Id: 3, Prev: true})}, "price", price,
+			"(price, id) < ($1::integer, $2)", " ORDER BY price DESC, id DESC LIMIT 21", args{"900", int64(3)}},
+	}
+	for _, c := range cases {
+		var a args
+		cond, order, err := c.req.Plan(c.sort, c.key, a.add)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if cond != c.cond || order != c.order {
+			t.Errorf("%s: got %q %q, want %q %q", c.name, cond, order, c.cond, c.order)
+		}
+		if len(a) != len(c.arguments) {
+			t.Errorf("%s: arguments %v, want %v", c.name, a, c.arguments)
+			continue
+		}
+		for i := range a {
+			if a[i] != c.arguments[i] {
+				t.Errorf("%s: arguments %v, want %v", c.name, a, c.arguments)
+			}
+		}
+	}
+}
+
+func TestPlanRejectsCursors(t *testing.T) {
+	var a args
+	if _, _, err := (Request{Cursor: "%%%"}).Plan("id", Key{Column: "id"}, a.add); err == nil {
+		t.Error("a broken cursor was planned")
+	}
+	if _, _, err := (Request{Cursor: Encode(Cursor{Sort: "price", Id: 1})}).Plan("id", Key{Column: "id"}, a.add); err == nil {
+		t.Error("a cursor of another sort was planned")
+	}
+}
+
+type row struct {
+	id    int64
+	price int
+}
+
+func rows(ids ...int64) []row {
+	r := make([]row, len(ids))
+	for i, id := range ids {
+		r[i] = row{id: id, price: int(id) * 100}
+	}
+	return r
+}
+
+func finish(r Request, items *[]row) Page {
+	return r.Finish(items, "price", func(i int) (string, int64) {
+		return strconv.Itoa((*items)[i].price), (*items)[i].id
+	})
+}
+
+func ids(items []row) []int64 {
+	var out []int64
+	for _, r := range items {
+		out = append(out, r.id)
+	}
+	return out
+}
+
+func TestFinish(t *testing.T) {
+	//first page with a row to spare: trimmed, a next cursor and no previous one
+	items := rows(1, 2, 3)
+	p := finish(Request{Limit: 2}, &items)
+	if len(items) != 2 || p.Prev != "" || p.Limit != 2 {
+		t.Fatalf("first page: %v %+v", ids(items), p)
+	}
+	next, _ := Decode(p.Next)
+	if next != (Cursor{Sort: "price", Value: "200", Id: 2}) {
+		t.Errorf("next cursor %+v", next)
+	}
+
+	//last page: a way back and nowhere further
+	items = rows(3)
+	p = finish(Request{Limit: 2, Cursor: p.Next}, &items)
+	if p.Next != "" || p.Prev == "" {
+		t.Fatalf("last page: %+v", p)
+	}
+	prev, _ := Decode(p.Prev)
+	if prev != (Cursor{Sort: "price", Value: "300", Id: 3, Prev: true}) {
+		t.Errorf("prev cursor %+v", prev)
+	}
+
+	//a backwards page comes from the database reversed and goes out in display order
+	items = rows(4, 3, 2)
+	p = finish(Request{Limit: 2, Cursor: Encode(Cursor{Sort: "price", Value: "500", Id: 5, Prev: true})}, &items)
+	if got := ids(items); len(got) != 2 || got[0] != 3 || got[1] != 4 {
+		t.Fatalf("backwards page %v", got)
+	}
+	next, _ = Decode(p.Next)
+	prev, _ = Decode(p.Prev)
+	if next.Id != 4 || next.Prev || prev.Id != 3 || !prev.Prev {
+		t.Errorf("backwards page cursors %+v %+v", next, prev)
+	}
+
+	//the first page reached going back has nothing before it
+	items = rows(1)
+	p = finish(Request{Limit: 2, Cursor: Encode(Cursor{Sort: "price", Value: "200", Id: 2, Prev: true})}, &items)
+	if p.Prev != "" || p.Next == "" {
+		t.Errorf("first page going back: %+v", p)
+	}
+
+	//nothing found, no cursors
+	items = nil
+	if p = finish(Request{}, &items); p.Next != "" || p.Prev != "" || p.Limit != DefaultLimit {
+		t.Errorf("empty page: %+v", p)
+	}
+}
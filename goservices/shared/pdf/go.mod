@@ -0,0 +1,3 @@
+module go.mods/pdf
+
+go 1.17
@@ -0,0 +1,378 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//just enough PDF for generated paperwork: A4 pages, one embedded TrueType font, text and lines
+//the standard 14 fonts have no Cyrillic, so the font is embedded whole and text goes out as glyph ids
+
+//A4 in points, the origin is the bottom left corner
+const (
+	PageWidth  = 595.28
+	PageHeight = 841.89
+)
+
+type Font struct {
+	name       string
+	data       []byte
+	unitsPerEm float64
+	ascent     float64
+	descent    float64
+	bbox       [4]float64
+	advances   []uint16
+	cmap       map[rune]uint16
+}
+
+type Document struct {
+	font  *Font
+	pages []*Page
+	used  map[uint16]rune
+	title string
+}
+
+type Page struct {
+	doc     *Document
+	content bytes.Buffer
+}
+
+//reads the tables a PDF needs from a .ttf, only fonts with a unicode BMP cmap will do
+func ParseFont(name string, data []byte) (*Font, error) {
+	if len(data) < 12 {
+		return nil, errors.New("not a TrueType font")
+	}
+	tables := map[string][]byte{}
+	n := int(binary.BigEndian.Uint16(data[4:]))
+	for i := 0; i < n; i++ {
+		e := 12 + 16*i
+		if e+16 > len(data) {
+			return nil, errors.New("truncated font")
+		}
+		off, length := binary.BigEndian.Uint32(data[e+8:]), binary.BigEndian.Uint32(data[e+12:])
+		if int(off)+int(length) > len(data) {
+			return nil, errors.New("truncated font")
+		}
+		tables[string(data[e:e+4])] = data[off : off+length]
+	}
+	for _, t := range []string{"head", "hhea", "hmtx", "cmap"} {
+		if _, ok := tables[t]; !ok {
+			return nil, errors.New("font has no " + t + " table")
+		}
+	}
+
+	f := &Font{name: name, data: data}
+	head, hhea := tables["head"], tables["hhea"]
+	if len(head) < 54 || len(hhea) < 36 {
+		return nil, errors.New("truncated font")
+	}
+	f.unitsPerEm = float64(binary.BigEndian.Uint16(head[18:]))
+	for i := range f.bbox {
+		f.bbox[i] = f.scale(int16(binary.BigEndian.Uint16(head[36+2*i:])))
+	}
+	f.ascent = f.scale(int16(binary.BigEndian.Uint16(hhea[4:])))
+	f.descent = f.scale(int16(binary.BigEndian.Uint16(hhea[6:])))
+
+	hmtx := tables["hmtx"]
+	metrics := int(binary.BigEndian.Uint16(hhea[34:]))
+	if metrics == 0 || len(hmtx) < 4*metrics {
+		return nil, errors.New("bad hmtx table")
+	}
+	for i := 0; i < metrics; i++ {
+		f.advances = append(f.advances, binary.BigEndian.Uint16(hmtx[4*i:]))
+	}
+
+	cmap, err := parseCmap(tables["cmap"])
+	if err != nil {
+		return nil, err
+	}
+	f.cmap = cmap
+	return f, nil
+}
+
+func (f *Font) scale(v int16) float64 {
+	return float64(v) * 1000 / f.unitsPerEm
+}
+
+//glyphs past the last metric share its advance
+func (f *Font) width(gid uint16) float64 {
+	if int(gid) >= len(f.advances) {
+		gid = uint16(len(f.advances) - 1)
+	}
+	return float64(f.advances[gid]) * 1000 / f.unitsPerEm
+}
+
+//format 4 subtable of the windows unicode (3,1) or unicode (0,x) encoding
+func parseCmap(t []byte) (map[rune]uint16, error) {
+	if len(t) < 4 {
+		return nil, errors.New("bad cmap table")
+	}
+	var sub []byte
+	n := int(binary.BigEndian.Uint16(t[2:]))
+	for i := 0; i < n && 4+8*i+8 <= len(t); i++ {
+		e := t[4+8*i:]
+		platform, encoding := binary.BigEndian.Uint16(e), binary.BigEndian.Uint16(e[2:])
+		off := int(binary.BigEndian.Uint32(e[4:]))
+		if off+4 > len(t) || binary.BigEndian.Uint16(t[off:]) != 4 {
+			continue
+		}
+		if (platform == 3 && encoding == 1) || platform == 0 {
+			sub = t[off:]
+			break
+		}
+	}
+	if sub == nil {
+		return nil, errors.New("font has no unicode cmap")
+	}
+
+	segs := int(binary.BigEndian.Uint16(sub[6:])) / 2
+	if len(sub) < 16+8*segs {
+		return nil, errors.New("bad cmap table")
+	}
+	ends, starts, deltas, ranges := 14, 16+2*segs, 16+4*segs, 16+6*segs
+	m := map[rune]uint16{}
+	for s := 0; s < segs; s++ {
+		end := binary.BigEndian.Uint16(sub[ends+2*s:])
+		start := binary.BigEndian.Uint16(sub[starts+2*s:])
+		delta := binary.BigEndian.Uint16(sub[deltas+2*s:])
+		ro := int(binary.BigEndian.Uint16(sub[ranges+2*s:]))
+		for c := int(start); c <= int(end) && c != 0xFFFF; c++ {
+			var g uint16
+			if ro == 0 {
+				g = uint16(c) + delta
+			} else {
+				at := ranges + 2*s + ro + 2*(c-int(start))
+				if at+2 > len(sub) {
+					continue
+				}
+				if g = binary.BigEndian.Uint16(sub[at:]); g != 0 {
+					g += delta
+				}
+			}
+			if g != 0 {
+				m[rune(c)] = g
+			}
+		}
+	}
+	return m, nil
+}
+
+func New(font *Font) *Document {
+	return &Document{font: font, used: map[uint16]rune{}}
+}
+
+//shown by viewers instead of the file name
+func (d *Document) SetTitle(title string) {
+	d.title = title
+}
+
+func (d *Document) AddPage() *Page {
+	p := &Page{doc: d}
+	d.pages = append(d.pages, p)
+	return p
+}
+
+//width of s in points at size, for aligning text right or centering it
+func (d *Document) TextWidth(size float64, s string) float64 {
+	w := 0.0
+	for _, r := range s {
+		w += d.font.width(d.font.cmap[r])
+	}
+	return w * size / 1000
+}
+
+//cuts s into lines no wider than width, breaking on spaces where it can
+func (d *Document) Wrap(size float64, width float64, s string) []string {
+	var lines []string
+	for _, para := range strings.Split(s, "\n") {
+		line := ""
+		for _, word := range strings.Fields(para) {
+			next := word
+			if line != "" {
+				next = line + " " + word
+			}
+			if line != "" && d.TextWidth(size, next) > width {
+				lines = append(lines, line)
+				next = word
+			}
+			line = next
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func num(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+//x and y are the start of the baseline, characters the font lacks come out as its missing glyph
+func (p *Page) Text(x, y, size float64, s string) {
+	var hex strings.Builder
+	for _, r := range s {
+		g := p.doc.font.cmap[r]
+		if _, ok := p.doc.used[g]; !ok {
+			p.doc.used[g] = r
+		}
+		fmt.Fprintf(&hex, "%04X", g)
+	}
+	fmt.Fprintf(&p.content, "BT /F1 %s Tf %s %s Td <%s> Tj ET\n", num(size), num(x), num(y), hex.String())
+}
+
+func (p *Page) TextRight(x, y, size float64, s string) {
+	p.Text(x-p.doc.TextWidth(size, s), y, size, s)
+}
+
+func (p *Page) Line(x1, y1, x2, y2, width float64) {
+	fmt.Fprintf(&p.content, "%s w %s %s m %s %s l S\n", num(width), num(x1), num(y1), num(x2), num(y2))
+}
+
+func (p *Page) Rect(x, y, w, h, width float64) {
+	fmt.Fprintf(&p.content, "%s w %s %s %s %s re S\n", num(width), num(x), num(y), num(w), num(h))
+}
+
+func deflate(b []byte) []byte {
+	var buf bytes.Buffer
+	z := zlib.NewWriter(&buf)
+	z.Write(b)
+	z.Close()
+	return buf.Bytes()
+}
+
+//a literal string with the characters PDF treats specially escaped, non-ASCII goes out as UTF-16
+func text(s string) string {
+	ascii := true
+	for _, r := range s {
+		if r > 126 {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return "(" + strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`).Replace(s) + ")"
+	}
+	var hex strings.Builder
+	hex.WriteString("<FEFF")
+	for _, r := range s {
+		if r > 0xFFFF {
+			r -= 0x10000
+			fmt.Fprintf(&hex, "%04X%04X", 0xD800+(r>>10), 0xDC00+(r&0x3FF))
+			continue
+		}
+		fmt.Fprintf(&hex, "%04X", r)
+	}
+	return hex.String() + ">"
+}
+
+//lets viewers copy and search the text, glyph ids mean nothing outside the font
+func (d *Document) toUnicode(gids []uint16) []byte {
+	var b bytes.Buffer
+	b.WriteString("/CIDInit /ProcSet findresource begin\n12 dict begin\nbegincmap\n")
+	b.WriteString("/CIDSystemInfo << /Registry (Adobe) /Ordering (UCS) /Supplement 0 >> def\n")
+	b.WriteString("/CMapName /Adobe-Identity-UCS def\n/CMapType 2 def\n")
+	b.WriteString("1 begincodespacerange\n<0000> <FFFF>\nendcodespacerange\n")
+	for i := 0; i < len(gids); i += 100 {
+		chunk := gids[i:]
+		if len(chunk) > 100 {
+			chunk = chunk[:100]
+		}
+		fmt.Fprintf(&b, "%d beginbfchar\n", len(chunk))
+		for _, g := range chunk {
+			r := d.used[g]
+			if r > 0xFFFF {
+				r = 0xFFFD
+			}
+			fmt.Fprintf(&b, "<%04X> <%04X>\n", g, r)
+		}
+		b.WriteString("endbfchar\n")
+	}
+	b.WriteString("endcmap\nCMapName currentdict /CMap defineresource pop\nend\nend\n")
+	return b.Bytes()
+}
+
+//the whole file
+func (d *Document) Bytes() ([]byte, error) {
+	if len(d.pages) == 0 {
+		return nil, errors.New("document has no pages")
+	}
+
+	var out bytes.Buffer
+	var offsets []int
+	//objects are numbered from 1 in the order they are written
+	obj := func(body string, stream []byte) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\n", len(offsets), body)
+		if stream != nil {
+			out.WriteString("stream\n")
+			out.Write(stream)
+			out.WriteString("\nendstream\n")
+		}
+		out.WriteString("endobj\n")
+	}
+
+	gids := make([]uint16, 0, len(d.used))
+	for g := range d.used {
+		gids = append(gids, g)
+	}
+	sort.Slice(gids, func(i, j int) bool { return gids[i] < gids[j] })
+
+	var widths strings.Builder
+	for _, g := range gids {
+		fmt.Fprintf(&widths, "%d [%s] ", g, num(d.font.width(g)))
+	}
+
+	f := d.font
+	name := strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || strings.ContainsRune("()<>[]{}/%#", r) {
+			return -1
+		}
+		return r
+	}, f.name)
+	first := 8
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	obj("<< /Type /Catalog /Pages 2 0 R >>", nil)
+	var kids strings.Builder
+	for i := range d.pages {
+		fmt.Fprintf(&kids, "%d 0 R ", first+2*i)
+	}
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", kids.String(), len(d.pages)), nil)
+	obj(fmt.Sprintf("<< /Type /Font /Subtype /Type0 /BaseFont /%s /Encoding /Identity-H /DescendantFonts [4 0 R] /ToUnicode 7 0 R >>", name), nil)
+	obj(fmt.Sprintf("<< /Type /Font /Subtype /CIDFontType2 /BaseFont /%s /CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >> /FontDescriptor 5 0 R /DW %s /W [%s] /CIDToGIDMap /Identity >>",
+		name, num(f.width(0)), widths.String()), nil)
+	obj(fmt.Sprintf("<< /Type /FontDescriptor /FontName /%s /Flags 32 /FontBBox [%s %s %s %s] /ItalicAngle 0 /Ascent %s /Descent %s /CapHeight %s /StemV 80 /FontFile2 6 0 R >>",
+		name, num(f.bbox[0]), num(f.bbox[1]), num(f.bbox[2]), num(f.bbox[3]), num(f.ascent), num(f.descent), num(f.ascent)), nil)
+	font := deflate(f.data)
+	obj(fmt.Sprintf("<< /Length %d /Length1 %d /Filter /FlateDecode >>", len(font), len(f.data)), font)
+	cmap := deflate(d.toUnicode(gids))
+	obj(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>", len(cmap)), cmap)
+
+	for i, p := range d.pages {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>",
+			num(PageWidth), num(PageHeight), first+2*i+1), nil)
+		content := deflate(p.content.Bytes())
+		obj(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>", len(content)), content)
+	}
+
+	info := ""
+	if d.title != "" {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n<< /Title %s /Producer (go.mods/pdf) >>\nendobj\n", len(offsets), text(d.title))
+		info = fmt.Sprintf(" /Info %d 0 R", len(offsets))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, o := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", o)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R%s >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, info, xref)
+
+	return out.Bytes(), nil
+}
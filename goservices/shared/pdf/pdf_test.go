@@ -0,0 +1,210 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//the tests need a real font with Cyrillic, they skip where the distro has no DejaVu
+func testFont(t *testing.T) *Font {
+	t.Helper()
+	for _, p := range []string{"/usr/share/fonts/dejavu/DejaVuSans.ttf", "/usr/share/fonts/truetype/dejavu/DejaVuSans.ttf"} {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		f, err := ParseFont("DejaVuSans", b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	t.Skip("no DejaVu Sans font")
+	return nil
+}
+
+func TestParseFontRejectsGarbage(t *testing.T) {
+	for _, b := range [][]byte{nil, []byte("not a font"), append([]byte{0, 1, 0, 0, 0, 9}, make([]byte, 10)...)} {
+		if _, err := ParseFont("x", b); err == nil {
+			t.Errorf("ParseFont(%q) gave no error", b)
+		}
+	}
+}
+
+func TestParseFontCyrillic(t *testing.T) {
+	f := testFont(t)
+	seen := map[uint16]rune{}
+	for _, r := range "АБВЖЯабвжяЁё1,₽" {
+		g := f.cmap[r]
+		if g == 0 {
+			t.Errorf("%q maps to the missing glyph", r)
+			continue
+		}
+		if o, ok := seen[g]; ok {
+			t.Errorf("%q and %q map to the same glyph %d", r, o, g)
+		}
+		seen[g] = r
+		if f.width(g) <= 0 {
+			t.Errorf("%q has no width", r)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"Invoice", "(Invoice)"},
+		{`a(b)\c`, `(a\(b\)\\c)`},
+		{"Счёт", "<FEFF0421044704510442>"},
+		{"😀", "<FEFFD83DDE00>"},
+	}
+	for _, c := range cases {
+		if got := text(c.in); got != c.want {
+			t.Errorf("text(%q) = %s, want %s", c.in, got, c.want)
+		}
+	}
+}
+
+func TestWrap(t *testing.T) {
+	d := New(testFont(t))
+	s := "Оплата счёта означает согласие с условиями оказания услуг"
+	lines := d.Wrap(10, 100, s)
+	if len(lines) < 2 {
+		t.Fatalf("not wrapped: %q", lines)
+	}
+	for _, l := range lines {
+		if d.TextWidth(10, l) > 100 && strings.Contains(l, " ") {
+			t.Errorf("%q is wider than the line", l)
+		}
+	}
+	if strings.Join(lines, " ") != s {
+		t.Errorf("words lost: %q", lines)
+	}
+}
+
+func TestBytesWithoutPages(t *testing.T) {
+	if _, err := New(testFont(t)).Bytes(); err == nil {
+		t.Error("a document without pages rendered")
+	}
+}
+
+var lengthPattern = regexp.MustCompile(`/Length (\d+)`)
+
+//the objects of a rendered file as the xref lists them, streams inflated
+func parseObjects(t *testing.T, b []byte) (bodies []string, streams [][]byte) {
+	t.Helper()
+	if !bytes.HasPrefix(b, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(b, []byte("%%EOF\n")) {
+		t.Fatal("no header or trailer")
+	}
+	tail := b[bytes.LastIndex(b, []byte("startxref\n"))+len("startxref\n"):]
+	xref, err := strconv.Atoi(string(tail[:bytes.IndexByte(tail, '\n')]))
+	if err != nil {
+		t.Fatal("bad startxref: ", err)
+	}
+	if !bytes.HasPrefix(b[xref:], []byte("xref\n0 ")) {
+		t.Fatal("startxref doesn't point at the xref")
+	}
+	lines := strings.Split(string(b[xref:]), "\n")
+	size, err := strconv.Atoi(strings.TrimPrefix(lines[1], "0 "))
+	if err != nil {
+		t.Fatal("bad xref header: ", lines[1])
+	}
+	if !strings.Contains(string(b[xref:]), fmt.Sprintf("/Size %d ", size)) {
+		t.Errorf("trailer /Size isn't %d", size)
+	}
+
+	for i := 1; i < size; i++ {
+		entry := lines[2+i]
+		if len(entry) != 19 || !strings.HasSuffix(entry, " 00000 n ") {
+			t.Fatalf("bad xref entry %q", entry)
+		}
+		off, _ := strconv.Atoi(entry[:10])
+		head := fmt.Sprintf("%d 0 obj\n", i)
+		if !bytes.HasPrefix(b[off:], []byte(head)) {
+			t.Fatalf("xref entry %d points at %q", i, b[off:off+10])
+		}
+		obj := b[off+len(head):]
+		obj = obj[:bytes.Index(obj, []byte("endobj\n"))]
+		body := string(obj[:bytes.IndexByte(obj, '\n')])
+		bodies = append(bodies, body)
+
+		var stream []byte
+		if k := bytes.Index(obj, []byte("\nstream\n")); k >= 0 {
+			m := lengthPattern.FindStringSubmatch(body)
+			if m == nil {
+				t.Fatalf("object %d has a stream without /Length", i)
+			}
+			n, _ := strconv.Atoi(m[1])
+			raw := obj[k+len("\nstream\n"):]
+			if !bytes.HasPrefix(raw[n:], []byte("\nendstream\n")) {
+				t.Fatalf("object %d: /Length %d doesn't end the stream", i, n)
+			}
+			z, err := zlib.NewReader(bytes.NewReader(raw[:n]))
+			if err != nil {
+				t.Fatalf("object %d: %v", i, err)
+			}
+			if stream, err = ioutil.ReadAll(z); err != nil {
+				t.Fatalf("object %d: %v", i, err)
+			}
+		}
+		streams = append(streams, stream)
+	}
+	return bodies, streams
+}
+
+func TestBytes(t *testing.T) {
+	f := testFont(t)
+	d := New(f)
+	d.SetTitle("Счёт СЧ-2021-000001")
+	d.AddPage().Text(40, 800, 12, "Счёт на оплату")
+	p := d.AddPage()
+	p.TextRight(555, 800, 10, "1 500,00")
+	p.Line(40, 790, 555, 790, 0.5)
+
+	b, err := d.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodies, streams := parseObjects(t, b)
+
+	//catalog, pages, two fonts, descriptor, font file, cmap, a page and its content twice, info
+	if len(bodies) != 12 {
+		t.Fatalf("%d objects, want 12", len(bodies))
+	}
+	if !strings.Contains(bodies[1], "/Kids [8 0 R 10 0 R ] /Count 2") {
+		t.Errorf("pages: %s", bodies[1])
+	}
+	if !bytes.Equal(streams[5], f.data) {
+		t.Error("embedded font isn't the font")
+	}
+	if !strings.Contains(bodies[11], text("Счёт СЧ-2021-000001")) {
+		t.Errorf("info: %s", bodies[11])
+	}
+
+	content := string(streams[8])
+	var hex string
+	for _, r := range "Счёт" {
+		hex += fmt.Sprintf("%04X", f.cmap[r])
+	}
+	if !strings.Contains(content, "<"+hex) || !strings.Contains(content, "40.00 800.00 Td") {
+		t.Errorf("first page content: %s", content)
+	}
+	if !strings.Contains(string(streams[10]), "40.00 790.00 m 555.00 790.00 l S") {
+		t.Errorf("second page content: %s", streams[10])
+	}
+
+	//every glyph used maps back to its character, so the text can be copied
+	cmap := string(streams[6])
+	for _, r := range "Счёт наоплу1500," {
+		if entry := fmt.Sprintf("<%04X> <%04X>", f.cmap[r], r); !strings.Contains(cmap, entry) {
+			t.Errorf("ToUnicode has no %s for %q", entry, r)
+		}
+	}
+}